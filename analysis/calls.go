@@ -0,0 +1,466 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package analysis
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// CommandKind describes what a command name refers to.
+type CommandKind uint8
+
+const (
+	FuncCommand CommandKind = iota + 1
+	BuiltinCommand
+	ExternalCommand
+
+	// DynamicCommand is a command which cannot be resolved statically,
+	// such as "$cmd" or the code run by eval.
+	DynamicCommand
+)
+
+func (k CommandKind) String() string {
+	switch k {
+	case FuncCommand:
+		return "function"
+	case BuiltinCommand:
+		return "builtin"
+	case ExternalCommand:
+		return "external"
+	case DynamicCommand:
+		return "dynamic"
+	}
+	return "unknown"
+}
+
+// CallGraph is a static call graph of a number of scripts, along with the
+// scripts they source.
+type CallGraph struct {
+	// Scripts holds all the scripts, starting with the ones given to
+	// LoadCallGraph and followed by the ones they source.
+	Scripts []*Script
+}
+
+// Script is a shell file in a call graph.
+type Script struct {
+	Path string
+	File *syntax.File
+
+	// Main is the node for the code at the top level of the script,
+	// outside of any function.
+	Main *Func
+
+	// Funcs holds the functions declared in the script, by name.
+	Funcs map[string]*Func
+
+	// Sources holds the calls to "source" or "." in the script.
+	Sources []*Source
+
+	// linked holds the scripts which source this one or are sourced by
+	// it, directly or indirectly, including itself.
+	linked []*Script
+}
+
+// Func is a node in a call graph; either a function, or the top level of a
+// script. A function declared multiple times in a script is a single node.
+type Func struct {
+	Script *Script
+	Decl   *syntax.FuncDecl // nil for the top level
+
+	Calls   []*Call // calls made by the node
+	Callers []*Call // calls to the node, if it's a function
+}
+
+// Name returns the name of the function, or an empty string for the top
+// level of a script.
+func (f *Func) Name() string {
+	if f.Decl == nil {
+		return ""
+	}
+	return f.Decl.Name.Value
+}
+
+func (f *Func) String() string {
+	if f.Decl == nil {
+		return f.Script.Path
+	}
+	return f.Script.Path + ":" + f.Name()
+}
+
+// Call is a command invoked from a node in the call graph.
+type Call struct {
+	Caller *Func
+	Expr   *syntax.CallExpr
+
+	// Name is the name of the command. Wrappers like "command" and
+	// "exec" are skipped, so "exec foo" calls foo. It's empty if the
+	// name is not a literal.
+	Name string
+	Kind CommandKind
+
+	// Callee is the called function, if Kind is FuncCommand.
+	Callee *Func
+}
+
+// Source is a call to "source" or "." which reads a script.
+type Source struct {
+	Expr *syntax.CallExpr
+
+	// Path is the path to the sourced script, with relative paths
+	// resolved from the directory of the script sourcing it. It's empty
+	// if the path is not a literal, like in ". $dir/lib.sh".
+	Path string
+
+	// Script is the sourced script. It's nil if the path could not be
+	// resolved, or if the script could not be loaded, in which case Err
+	// is set.
+	Script *Script
+	Err    error
+}
+
+// LoadCallGraph parses the scripts at the given paths, as well as any
+// scripts which they source, and builds a call graph across all of them. If
+// parser is nil, a parser with the default options is used.
+//
+// Since shell is a dynamic language, this is an approximation. Sourced paths
+// are only followed if they're literals, and are resolved relative to the
+// directory of the script sourcing them, even though the shell uses its
+// working directory or $PATH. A command is resolved as a function if any of
+// the linked scripts declares it, where two scripts are linked if one
+// sources the other, directly or indirectly. Commands run by external
+// programs like "sudo" or "xargs" are not followed.
+func LoadCallGraph(parser *syntax.Parser, paths ...string) (*CallGraph, error) {
+	if parser == nil {
+		parser = syntax.NewParser()
+	}
+	l := &loader{
+		parser:  parser,
+		graph:   &CallGraph{},
+		scripts: make(map[string]*Script),
+	}
+	for _, path := range paths {
+		if _, err := l.load(path); err != nil {
+			return nil, err
+		}
+	}
+	// scripts are appended while following their sources
+	for i := 0; i < len(l.graph.Scripts); i++ {
+		script := l.graph.Scripts[i]
+		for _, src := range script.Sources {
+			if src.Path == "" {
+				continue
+			}
+			src.Script, src.Err = l.load(src.Path)
+		}
+	}
+	l.link()
+	for _, script := range l.graph.Scripts {
+		for _, fn := range script.funcs() {
+			for _, call := range fn.Calls {
+				script.resolveCall(call, call.Expr.Args, true)
+				if call.Callee != nil {
+					call.Callee.Callers = append(call.Callee.Callers, call)
+				}
+			}
+		}
+	}
+	return l.graph, nil
+}
+
+type loader struct {
+	parser  *syntax.Parser
+	graph   *CallGraph
+	scripts map[string]*Script
+}
+
+func (l *loader) load(path string) (*Script, error) {
+	path = filepath.Clean(path)
+	if script := l.scripts[path]; script != nil {
+		return script, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file, err := l.parser.Parse(f, path)
+	if err != nil {
+		return nil, err
+	}
+	script := &Script{
+		Path:  path,
+		File:  file,
+		Funcs: make(map[string]*Func),
+	}
+	script.Main = &Func{Script: script}
+	l.scripts[path] = script
+	l.graph.Scripts = append(l.graph.Scripts, script)
+	script.collect()
+	return script, nil
+}
+
+// link finds the scripts linked to each script.
+func (l *loader) link() {
+	adj := make(map[*Script][]*Script)
+	for _, script := range l.graph.Scripts {
+		for _, src := range script.Sources {
+			if src.Script != nil {
+				adj[script] = append(adj[script], src.Script)
+				adj[src.Script] = append(adj[src.Script], script)
+			}
+		}
+	}
+	for _, script := range l.graph.Scripts {
+		if script.linked != nil {
+			continue
+		}
+		// the scripts are kept in loading order, so that functions
+		// are looked up in the same order in all linked scripts
+		seen := map[*Script]bool{script: true}
+		stack := []*Script{script}
+		for len(stack) > 0 {
+			s := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, s2 := range adj[s] {
+				if !seen[s2] {
+					seen[s2] = true
+					stack = append(stack, s2)
+				}
+			}
+		}
+		var linked []*Script
+		for _, s := range l.graph.Scripts {
+			if seen[s] {
+				linked = append(linked, s)
+			}
+		}
+		for _, s := range linked {
+			s.linked = linked
+		}
+	}
+}
+
+// collect finds the functions, calls and sources in a script. The calls are
+// resolved later, once all the linked scripts are loaded.
+func (s *Script) collect() {
+	fns := []*Func{s.Main}
+	syntax.Apply(s.File, func(c *syntax.Cursor) bool {
+		switch x := c.Node().(type) {
+		case *syntax.FuncDecl:
+			fn := s.Funcs[x.Name.Value]
+			if fn == nil {
+				fn = &Func{Script: s, Decl: x}
+				s.Funcs[x.Name.Value] = fn
+			}
+			fns = append(fns, fn)
+		case *syntax.CallExpr:
+			if len(x.Args) == 0 {
+				break
+			}
+			fn := fns[len(fns)-1]
+			fn.Calls = append(fn.Calls, &Call{Caller: fn, Expr: x})
+			if name, _ := literal(x.Args[0]); name == "source" || name == "." {
+				s.addSource(x)
+			}
+		}
+		return true
+	}, func(c *syntax.Cursor) bool {
+		if _, ok := c.Node().(*syntax.FuncDecl); ok {
+			fns = fns[:len(fns)-1]
+		}
+		return true
+	})
+}
+
+// resolveCall sets the name and kind of a call, given its arguments.
+func (s *Script) resolveCall(call *Call, args []*syntax.Word, funcs bool) {
+	name, ok := literal(args[0])
+	if !ok {
+		call.Name, call.Kind = "", DynamicCommand
+		return
+	}
+	call.Name = name
+	if funcs {
+		if fn := s.lookupFunc(name); fn != nil {
+			call.Kind, call.Callee = FuncCommand, fn
+			return
+		}
+	}
+	switch {
+	case !isBuiltin(name):
+		call.Kind = ExternalCommand
+	case name == "eval":
+		call.Kind = DynamicCommand
+	case name == "command", name == "exec", name == "builtin":
+		call.Kind = BuiltinCommand
+		if rest := wrappedArgs(name, args[1:]); len(rest) > 0 {
+			// "command" and "exec" skip functions
+			s.resolveCall(call, rest, false)
+			if name == "builtin" && call.Kind == ExternalCommand {
+				// not a builtin; would fail
+				call.Kind = BuiltinCommand
+				call.Name = name
+			}
+		}
+	default:
+		call.Kind = BuiltinCommand
+	}
+}
+
+// lookupFunc finds the function with the given name in the script or any of
+// the scripts linked to it.
+func (s *Script) lookupFunc(name string) *Func {
+	if fn := s.Funcs[name]; fn != nil {
+		return fn
+	}
+	for _, script := range s.linked {
+		if fn := script.Funcs[name]; fn != nil {
+			return fn
+		}
+	}
+	return nil
+}
+
+// wrappedArgs returns the arguments making up the command run by a wrapper
+// like "command" or "exec", skipping any options. It returns nil if the
+// wrapper doesn't run a command, such as in "command -v foo".
+func wrappedArgs(wrapper string, args []*syntax.Word) []*syntax.Word {
+	for i := 0; i < len(args); i++ {
+		opt, ok := literal(args[i])
+		if !ok || opt == "" || opt[0] != '-' {
+			return args[i:]
+		}
+		if opt == "--" {
+			return args[i+1:]
+		}
+		switch wrapper {
+		case "command":
+			if strings.ContainsAny(opt, "vV") {
+				return nil
+			}
+		case "exec":
+			if strings.HasSuffix(opt, "a") {
+				i++ // exec -a name
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Script) addSource(x *syntax.CallExpr) {
+	src := &Source{Expr: x}
+	s.Sources = append(s.Sources, src)
+	if len(x.Args) < 2 {
+		return
+	}
+	path, ok := literal(x.Args[1])
+	if !ok || path == "" {
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(s.Path), path)
+	}
+	src.Path = path
+}
+
+// funcs returns the nodes of a script, starting with its top level and
+// followed by its functions in the order in which they are declared.
+func (s *Script) funcs() []*Func {
+	fns := []*Func{s.Main}
+	for _, fn := range s.Funcs {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns[1:], func(i, j int) bool {
+		p1, p2 := fns[1+i].Decl.Pos(), fns[1+j].Decl.Pos()
+		return p2.After(p1)
+	})
+	return fns
+}
+
+// Calls returns all the calls of the given kind, in the order in which the
+// scripts and their functions appear.
+func (g *CallGraph) Calls(kind CommandKind) []*Call {
+	var calls []*Call
+	for _, script := range g.Scripts {
+		for _, fn := range script.funcs() {
+			for _, call := range fn.Calls {
+				if call.Kind == kind {
+					calls = append(calls, call)
+				}
+			}
+		}
+	}
+	return calls
+}
+
+// ExternalCommands returns the sorted names of all the external programs
+// that the scripts may invoke. Note that the dynamic calls, as returned by
+// Calls(DynamicCommand), may invoke others.
+func (g *CallGraph) ExternalCommands() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, call := range g.Calls(ExternalCommand) {
+		if !seen[call.Name] {
+			seen[call.Name] = true
+			names = append(names, call.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// literal returns the value of a word, if it is made up of literals and
+// quoted strings only.
+func literal(w *syntax.Word) (string, bool) {
+	var buf bytes.Buffer
+	for _, part := range w.Parts {
+		switch x := part.(type) {
+		case *syntax.Lit:
+			if strings.ContainsAny(x.Value, "\\*?[~") {
+				return "", false
+			}
+			buf.WriteString(x.Value)
+		case *syntax.SglQuoted:
+			if x.Dollar {
+				return "", false
+			}
+			buf.WriteString(x.Value)
+		case *syntax.DblQuoted:
+			for _, part := range x.Parts {
+				lit, ok := part.(*syntax.Lit)
+				if !ok || strings.Contains(lit.Value, "\\") {
+					return "", false
+				}
+				buf.WriteString(lit.Value)
+			}
+		default:
+			return "", false
+		}
+	}
+	return buf.String(), true
+}
+
+// isBuiltin reports whether name is a Bash builtin which may be run as a
+// simple command. Declaration builtins like "local" and "export" are not
+// included, as they are parsed as *syntax.DeclClause.
+func isBuiltin(name string) bool {
+	switch name {
+	case ".", ":", "[", "alias", "bg", "bind", "break", "builtin",
+		"caller", "cd", "command", "compgen", "complete", "compopt",
+		"continue", "dirs", "disown", "echo", "enable", "eval", "exec",
+		"exit", "false", "fc", "fg", "getopts", "hash", "help",
+		"history", "jobs", "kill", "logout", "mapfile", "popd",
+		"printf", "pushd", "pwd", "read", "readarray", "return", "set",
+		"shift", "shopt", "source", "suspend", "test", "times", "trap",
+		"true", "type", "ulimit", "umask", "unalias", "unset", "wait":
+		return true
+	}
+	return false
+}
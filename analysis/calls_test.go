@@ -0,0 +1,238 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package analysis
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFiles(tb testing.TB, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "sh-analysis")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(body), 0666); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func callStrs(dir string, calls []*Call) []string {
+	rel := func(path string) string {
+		return filepath.ToSlash(strings.TrimPrefix(path, dir+string(filepath.Separator)))
+	}
+	funcStr := func(fn *Func) string {
+		if fn.Decl == nil {
+			return rel(fn.Script.Path)
+		}
+		return rel(fn.Script.Path) + ":" + fn.Name()
+	}
+	var strs []string
+	for _, call := range calls {
+		s := fmt.Sprintf("%s %s %q %s", funcStr(call.Caller),
+			call.Expr.Pos(), call.Name, call.Kind)
+		if call.Callee != nil {
+			s += " " + funcStr(call.Callee)
+		}
+		strs = append(strs, s)
+	}
+	return strs
+}
+
+func allCalls(g *CallGraph) []*Call {
+	var calls []*Call
+	for _, kind := range []CommandKind{FuncCommand, BuiltinCommand,
+		ExternalCommand, DynamicCommand} {
+		calls = append(calls, g.Calls(kind)...)
+	}
+	return calls
+}
+
+var callGraphTests = []struct {
+	in   string
+	want []string
+}{
+	{"foo=bar", nil},
+	{
+		"echo foo; ls -l",
+		[]string{
+			`a.sh 1:1 "echo" builtin`,
+			`a.sh 1:11 "ls" external`,
+		},
+	},
+	{
+		"f\nf() {\n\tgrep x\n\tg\n}\ng() { f; }",
+		[]string{
+			`a.sh 1:1 "f" function a.sh:f`,
+			`a.sh:f 4:2 "g" function a.sh:g`,
+			`a.sh:g 6:7 "f" function a.sh:f`,
+			`a.sh:f 3:2 "grep" external`,
+		},
+	},
+	{
+		"x=$(curl foo | jq .) cmd <(cat)",
+		[]string{
+			`a.sh 1:1 "cmd" external`,
+			`a.sh 1:5 "curl" external`,
+			`a.sh 1:16 "jq" external`,
+			`a.sh 1:28 "cat" external`,
+		},
+	},
+	{
+		"'ls'\n\"grep\" x\nl\\s\n~/bin/x\n$cmd\n\"$@\"\neval foo",
+		[]string{
+			`a.sh 1:1 "ls" external`,
+			`a.sh 2:1 "grep" external`,
+			`a.sh 3:1 "" dynamic`,
+			`a.sh 4:1 "" dynamic`,
+			`a.sh 5:1 "" dynamic`,
+			`a.sh 6:1 "" dynamic`,
+			`a.sh 7:1 "eval" dynamic`,
+		},
+	},
+	{
+		"command ls\ncommand -v git\ncommand -p -- cat\ncommand $x",
+		[]string{
+			`a.sh 2:1 "command" builtin`,
+			`a.sh 1:1 "ls" external`,
+			`a.sh 3:1 "cat" external`,
+			`a.sh 4:1 "" dynamic`,
+		},
+	},
+	{
+		"exec >/dev/null\nexec -a name foo\nbuiltin echo\nbuiltin ls",
+		[]string{
+			`a.sh 1:1 "exec" builtin`,
+			`a.sh 3:1 "echo" builtin`,
+			`a.sh 4:1 "builtin" builtin`,
+			`a.sh 2:1 "foo" external`,
+		},
+	},
+	{
+		"f() { :; }\ncommand f\nexec f",
+		[]string{
+			`a.sh:f 1:7 ":" builtin`,
+			`a.sh 2:1 "f" external`,
+			`a.sh 3:1 "f" external`,
+		},
+	},
+}
+
+func TestCallGraph(t *testing.T) {
+	t.Parallel()
+	for i, tc := range callGraphTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"a.sh": tc.in})
+			defer os.RemoveAll(dir)
+			g, err := LoadCallGraph(nil, filepath.Join(dir, "a.sh"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := callStrs(dir, allCalls(g))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("call graph mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCallGraphSource(t *testing.T) {
+	t.Parallel()
+	dir := writeFiles(t, map[string]string{
+		"main.sh": `
+. ./lib.sh
+source "sub dir/other.sh" arg
+source $dir/x.sh
+. missing.sh
+libf
+mainf() { otherf; }
+`,
+		"lib.sh":           "libf() { mainf; curl x; }\n. lib.sh\n",
+		"sub dir/other.sh": "otherf() { rm -rf /; }\n",
+		"unrelated.sh":     "otherf\n",
+	})
+	defer os.RemoveAll(dir)
+	g, err := LoadCallGraph(nil, filepath.Join(dir, "main.sh"),
+		filepath.Join(dir, "unrelated.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scripts []string
+	for _, script := range g.Scripts {
+		path, _ := filepath.Rel(dir, script.Path)
+		scripts = append(scripts, filepath.ToSlash(path))
+	}
+	wantScripts := []string{"main.sh", "unrelated.sh", "lib.sh", "sub dir/other.sh"}
+	if !reflect.DeepEqual(scripts, wantScripts) {
+		t.Fatalf("scripts mismatch\nwant: %q\ngot:  %q", wantScripts, scripts)
+	}
+	var sources []string
+	for _, src := range g.Scripts[0].Sources {
+		path, _ := filepath.Rel(dir, src.Path)
+		s := fmt.Sprintf("%s %s", src.Expr.Pos(), filepath.ToSlash(path))
+		if src.Path == "" {
+			s = fmt.Sprintf("%s dynamic", src.Expr.Pos())
+		}
+		switch {
+		case src.Err != nil:
+			s += " error"
+		case src.Script != nil:
+			s += " loaded"
+		}
+		sources = append(sources, s)
+	}
+	wantSources := []string{
+		"2:1 lib.sh loaded",
+		"3:1 sub dir/other.sh loaded",
+		"4:1 dynamic",
+		"5:1 missing.sh error",
+	}
+	if !reflect.DeepEqual(sources, wantSources) {
+		t.Fatalf("sources mismatch\nwant: %q\ngot:  %q", wantSources, sources)
+	}
+	got := callStrs(dir, g.Calls(FuncCommand))
+	want := []string{
+		`main.sh 6:1 "libf" function lib.sh:libf`,
+		`main.sh:mainf 7:11 "otherf" function sub dir/other.sh:otherf`,
+		`lib.sh:libf 1:10 "mainf" function main.sh:mainf`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("function calls mismatch\nwant: %q\ngot:  %q", want, got)
+	}
+	mainf := g.Scripts[0].Funcs["mainf"]
+	if got := callStrs(dir, mainf.Callers); len(got) != 1 ||
+		got[0] != want[2] {
+		t.Fatalf("wrong callers of mainf: %q", got)
+	}
+	// otherf is not a function in unrelated.sh
+	wantExt := []string{"curl", "otherf", "rm"}
+	if got := g.ExternalCommands(); !reflect.DeepEqual(got, wantExt) {
+		t.Fatalf("external commands mismatch\nwant: %q\ngot:  %q", wantExt, got)
+	}
+}
+
+func TestCallGraphError(t *testing.T) {
+	t.Parallel()
+	dir := writeFiles(t, map[string]string{"bad.sh": "foo("})
+	defer os.RemoveAll(dir)
+	if _, err := LoadCallGraph(nil, filepath.Join(dir, "bad.sh")); err == nil {
+		t.Fatal("expected a parse error")
+	}
+	if _, err := LoadCallGraph(nil, filepath.Join(dir, "missing.sh")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package analysis implements static analyses of shell programs, working on
+// the syntax trees produced by the syntax package.
+//
+// Since shell is a dynamic language, the analyses are necessarily
+// approximations. For example, a variable is resolved to a local variable
+// only if the function it appears in declares it as such, even though Bash
+// uses dynamic scoping at run time.
+//
+// This package is a work in progress and EXPERIMENTAL; its API is not
+// subject to the 1.x backwards compatibility guarantee.
+package analysis
@@ -0,0 +1,186 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package analysis
+
+import (
+	"fmt"
+	"strings"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// Rename renames a symbol to name, along with all of its references. The
+// syntax tree is modified in place, and so is the symbol table.
+//
+// Only the literals holding the references are changed, such as "foo" in
+// "foo=bar", "$foo", "${foo[@]}", "((foo++))" or "local foo". In
+// particular, strings are left alone, even if they are later used as code,
+// as in "trap 'foo' EXIT".
+//
+// The returned nodes are the ones which might reference the symbol in ways
+// that cannot be resolved statically, such as calls to eval or indirect
+// parameter expansions like ${!ref}. These are left untouched, so they
+// should be reviewed by hand.
+//
+// An error is returned if the new name is not valid, or if it would clash
+// with another symbol, in which case nothing is renamed. Variables which are
+// special to the shell like PATH or IFS, or which are exported to other
+// programs, are never renamed.
+func (info *Info) Rename(sym *Symbol, name string) ([]syntax.Node, error) {
+	if err := info.checkRename(sym, name); err != nil {
+		return nil, err
+	}
+	for _, ref := range sym.Refs {
+		ref.Lit.Value = name
+	}
+	switch sym.Kind {
+	case Variable:
+		delete(sym.Scope.Vars, sym.Name)
+		sym.Scope.Vars[name] = sym
+	case Function:
+		delete(info.Funcs, sym.Name)
+		info.Funcs[name] = sym
+	}
+	sym.Name = name
+	var dynamic []syntax.Node
+	for _, node := range info.Dynamic {
+		if dynamicRef(node, sym.Kind) {
+			dynamic = append(dynamic, node)
+		}
+	}
+	return dynamic, nil
+}
+
+func (info *Info) checkRename(sym *Symbol, name string) error {
+	if name == sym.Name {
+		return fmt.Errorf("%s is already named %q", sym.Kind, name)
+	}
+	switch sym.Kind {
+	case Variable:
+		if !validName(name) {
+			return fmt.Errorf("invalid variable name: %q", name)
+		}
+		for _, name := range [...]string{sym.Name, name} {
+			if specialVar(name) {
+				return fmt.Errorf("variable %s is special to the shell",
+					name)
+			}
+		}
+		if len(sym.Defs()) == 0 {
+			return fmt.Errorf("variable %s is not defined in the file",
+				sym.Name)
+		}
+		if sym.Exported {
+			return fmt.Errorf("variable %s is exported", sym.Name)
+		}
+		if other := sym.Scope.Lookup(name); other != nil {
+			return fmt.Errorf("variable %s already exists", name)
+		}
+		// the new name must not be shadowed by a local variable where
+		// the symbol is referenced either; check all the scopes below
+		// for simplicity, as variables are dynamically scoped
+		var shadow func(*Scope) bool
+		shadow = func(s *Scope) bool {
+			for _, child := range s.Children {
+				if child.Vars[name] != nil || shadow(child) {
+					return true
+				}
+			}
+			return false
+		}
+		if shadow(sym.Scope) {
+			return fmt.Errorf("variable %s already exists in a function",
+				name)
+		}
+	case Function:
+		if !validFuncName(name) {
+			return fmt.Errorf("invalid function name: %q", name)
+		}
+		if info.Funcs[name] != nil {
+			return fmt.Errorf("function %s already exists", name)
+		}
+		clash := false
+		syntax.Walk(info.File, func(node syntax.Node) bool {
+			if ce, ok := node.(*syntax.CallExpr); ok && len(ce.Args) > 0 {
+				if lit := wordLit(ce.Args[0]); lit != nil && lit.Value == name {
+					clash = true
+				}
+			}
+			return !clash
+		})
+		if clash {
+			return fmt.Errorf("command %s is called in the file", name)
+		}
+	}
+	return nil
+}
+
+// dynamicRef reports whether a node in Info.Dynamic might reference a symbol
+// of the given kind.
+func dynamicRef(node syntax.Node, kind SymbolKind) bool {
+	switch x := node.(type) {
+	case *syntax.CallExpr:
+		if wordLit(x.Args[0]) == nil {
+			// e.g. "$cmd" can only call a function
+			return kind == Function
+		}
+		return true // eval
+	default:
+		// ${!ref} or declare "$name"
+		return kind == Variable
+	}
+}
+
+// specialVar reports whether a variable is used by the shell itself, or is
+// commonly used by other programs via the environment. Renaming such a
+// variable, or renaming another variable to it, would change the behavior of
+// a program.
+func specialVar(name string) bool {
+	switch name {
+	case "PATH", "IFS", "HOME", "PWD", "OLDPWD", "CDPATH", "ENV",
+		"SHELL", "SHELLOPTS", "POSIXLY_CORRECT", "PS1", "PS2", "PS3",
+		"PS4", "PROMPT_COMMAND", "REPLY", "OPTARG", "OPTIND", "OPTERR",
+		"LINENO", "RANDOM", "SECONDS", "PPID", "UID", "EUID", "GROUPS",
+		"HOSTNAME", "HOSTTYPE", "OSTYPE", "MACHTYPE", "FUNCNAME",
+		"PIPESTATUS", "GLOBIGNORE", "FIGNORE", "TMOUT", "MAIL",
+		"MAILPATH", "MAILCHECK", "COLUMNS", "LINES", "TERM", "USER",
+		"LOGNAME", "LANG", "LANGUAGE", "TZ", "TMPDIR", "EDITOR",
+		"VISUAL", "PAGER", "DISPLAY", "IGNOREEOF", "INPUTRC",
+		"MAPFILE", "READLINE_LINE", "READLINE_POINT", "EPOCHREALTIME",
+		"EPOCHSECONDS", "SRANDOM":
+		return true
+	}
+	for _, prefix := range [...]string{"BASH", "LC_", "COMP_", "HIST", "LD_"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validFuncName reports whether name can be used as a function name, and
+// called without any quoting. This is stricter than what Bash allows.
+func validFuncName(name string) bool {
+	if name == "" || name[0] == '-' {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z':
+		case 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9':
+		case strings.ContainsRune("_-.:", r):
+		default:
+			return false
+		}
+	}
+	// reserved words and builtins like "local" are not parsed as calls
+	f, err := syntax.NewParser().Parse(strings.NewReader(name), "")
+	if err != nil || len(f.Stmts) != 1 {
+		return false
+	}
+	ce, ok := f.Stmts[0].Cmd.(*syntax.CallExpr)
+	return ok && len(ce.Assigns) == 0 && len(ce.Args) == 1 &&
+		wordLit(ce.Args[0]) != nil
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/syntax"
+)
+
+var renameTests = []struct {
+	in, at, name string
+	want         string
+	dynamic      []string
+}{
+	{
+		"foo=bar\necho $foo \"${foo}\" '$foo' foo ${#foo} ${foo:-x}",
+		"foo", "new",
+		"new=bar\necho $new \"${new}\" '$foo' foo ${#new} ${new:-x}",
+		nil,
+	},
+	{
+		"a=(1 2)\na[i]=3\necho ${a[i]} ${a[@]} $((a[0] + i))",
+		"a", "arr",
+		"arr=(1 2)\narr[i]=3\necho ${arr[i]} ${arr[@]} $((arr[0] + i))",
+		nil,
+	},
+	{
+		"key=1\ndeclare -A m=([key]=v)\nm[key]=w\necho ${m[key]} $key",
+		"key", "k",
+		"k=1\ndeclare -A m=([key]=v)\nm[key]=w\necho ${m[key]} $k",
+		nil,
+	},
+	{
+		"i=0\n((i++, j = i * 2))\nlet i+=1\nfor (( ; i < 3; i++)); do :; done",
+		"i", "n",
+		"n=0\n((n++, j = n * 2))\nlet n+=1\nfor (( ; n < 3; n++)); do :; done",
+		nil,
+	},
+	{
+		"read -r foo\nfor foo in a b; do :; done\nunset foo\ncat <<EOF\n$foo\nEOF",
+		"foo", "bar",
+		"read -r bar\nfor bar in a b; do :; done\nunset bar\ncat <<EOF\n$bar\nEOF",
+		nil,
+	},
+	{
+		"x=1\nf() {\n\tlocal x=2\n\techo $x\n}\necho $x",
+		"x", "y",
+		"y=1\nf() {\n\tlocal x=2\n\techo $x\n}\necho $y",
+		nil,
+	},
+	{
+		"x=1\nf() {\n\tlocal x=2\n\techo $x\n}\necho $x",
+		"local x", "y",
+		"x=1\nf() {\n\tlocal y=2\n\techo $y\n}\necho $x",
+		nil,
+	},
+	{
+		"f() { :; }\nf\nunset -f f\n\"f\" f\necho f",
+		"f", "g",
+		"g() { :; }\ng\nunset -f g\n\"f\" f\necho f",
+		[]string{"4:1"},
+	},
+	{
+		"f() { :; }\neval \"$1\"\n$cmd\necho ${!ref}",
+		"f", "g",
+		"g() { :; }\neval \"$1\"\n$cmd\necho ${!ref}",
+		[]string{"2:1", "3:1"},
+	},
+	{
+		"x=1\neval \"$1\"\n$cmd\necho ${!ref}\ndeclare \"$n\"=2",
+		"x", "y",
+		"y=1\neval \"$1\"\n$cmd\necho ${!ref}\ndeclare \"$n\"=2",
+		[]string{"2:1", "4:6", "5:9"},
+	},
+	{"x=1", "x", "x", "variable is already named \"x\"", nil},
+	{"x=1", "x", "1x", "invalid variable name: \"1x\"", nil},
+	{"x=1", "x", "a-b", "invalid variable name: \"a-b\"", nil},
+	{"echo $x", "x", "y", "variable x is not defined in the file", nil},
+	{"export x=1", "x=", "y", "variable x is exported", nil},
+	{"x=1 env", "x", "y", "variable x is exported", nil},
+	{"x=1\nx=2 cmd", "x", "y", "variable x is exported", nil},
+	{"PATH=/x", "PATH", "P", "variable PATH is special to the shell", nil},
+	{"read -r; IFS=:", "IFS", "y", "variable IFS is special to the shell", nil},
+	{"read -r REPLY", "REPLY", "y", "variable REPLY is special to the shell", nil},
+	{"LC_ALL=C", "LC_ALL", "y", "variable LC_ALL is special to the shell", nil},
+	{"x=1", "x", "HOME", "variable HOME is special to the shell", nil},
+	{"x=1\necho $y", "x", "y", "variable y already exists", nil},
+	{
+		"x=1\nf() { local y; }",
+		"x", "y",
+		"variable y already exists in a function",
+		nil,
+	},
+	{
+		"f() {\n\tlocal x\n\techo $y\n}",
+		"x", "y",
+		"variable y already exists",
+		nil,
+	},
+	{"f() { :; }", "f", "a b", "invalid function name: \"a b\"", nil},
+	{"f() { :; }", "f", "if", "invalid function name: \"if\"", nil},
+	{"f() { :; }", "f", "local", "invalid function name: \"local\"", nil},
+	{"f() { :; }", "f", "-g", "invalid function name: \"-g\"", nil},
+	{"f() { :; }\ng() { :; }", "f", "g", "function g already exists", nil},
+	{"f() { :; }\nls", "f", "ls", "command ls is called in the file", nil},
+	{"f() { :; }", "f", "g.h-i:j", "g.h-i:j() { :; }", nil},
+}
+
+func TestRename(t *testing.T) {
+	t.Parallel()
+	printer := syntax.NewPrinter()
+	for i, tc := range renameTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f := parse(t, tc.in)
+			info := Analyze(f)
+			offs := strings.Index(tc.in, tc.at)
+			if i := strings.LastIndex(tc.at, " "); i >= 0 {
+				offs += i + 1
+			}
+			var sym *Symbol
+			for lit, ref := range info.Refs {
+				if int(lit.Pos().Offset()) == offs {
+					sym = ref.Symbol
+				}
+			}
+			if sym == nil {
+				t.Fatalf("no symbol at %d in %q", offs, tc.in)
+			}
+			oldName := sym.Name
+			dynamic, err := info.Rename(sym, tc.name)
+			if err != nil {
+				if got := err.Error(); got != tc.want {
+					t.Fatalf("Rename error mismatch in %q\nwant: %q\ngot:  %q",
+						tc.in, tc.want, got)
+				}
+				if sym.Name != oldName {
+					t.Fatalf("Rename errored but renamed the symbol")
+				}
+				return
+			}
+			var buf bytes.Buffer
+			printer.Print(&buf, f)
+			if got := strings.TrimSuffix(buf.String(), "\n"); got != tc.want {
+				t.Fatalf("Rename mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.want, got)
+			}
+			var gotDyn []string
+			for _, node := range dynamic {
+				gotDyn = append(gotDyn, node.Pos().String())
+			}
+			if !reflect.DeepEqual(gotDyn, tc.dynamic) {
+				t.Fatalf("Rename dynamic mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.dynamic, gotDyn)
+			}
+			// the symbol table must be up to date
+			info2 := Analyze(parse(t, buf.String()))
+			if got, want := len(info2.Symbols()), len(info.Symbols()); got != want {
+				t.Fatalf("got %d symbols after renaming, want %d", got, want)
+			}
+			if sym.Name != tc.name {
+				t.Fatalf("symbol name was not updated: %q", sym.Name)
+			}
+			switch sym.Kind {
+			case Variable:
+				if sym.Scope.Vars[tc.name] != sym {
+					t.Fatalf("scope was not updated")
+				}
+			case Function:
+				if info.Funcs[tc.name] != sym {
+					t.Fatalf("functions were not updated")
+				}
+			}
+		})
+	}
+}
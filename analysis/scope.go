@@ -0,0 +1,566 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package analysis
+
+import (
+	"sort"
+	"strings"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// SymbolKind describes what a symbol names.
+type SymbolKind uint8
+
+const (
+	Variable SymbolKind = iota + 1
+	Function
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case Variable:
+		return "variable"
+	case Function:
+		return "function"
+	}
+	return "unknown"
+}
+
+// Symbol is a variable or function, along with all of its references.
+type Symbol struct {
+	Name string
+	Kind SymbolKind
+
+	// Scope is the scope which declares the symbol. Functions and
+	// variables which aren't local to a function belong to the file
+	// scope.
+	Scope *Scope
+
+	// Exported is true if the variable is exported to the environment,
+	// like via "export foo" or "declare -x foo", or if it's assigned for
+	// a single command like in "foo=bar cmd".
+	Exported bool
+
+	// Refs holds all the references to the symbol, in the order in which
+	// they appear in the syntax tree.
+	Refs []*Ref
+}
+
+// Defs returns the references which define the symbol.
+func (s *Symbol) Defs() []*Ref {
+	var refs []*Ref
+	for _, ref := range s.Refs {
+		if ref.Def {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Uses returns the references which use the symbol.
+func (s *Symbol) Uses() []*Ref {
+	var refs []*Ref
+	for _, ref := range s.Refs {
+		if ref.Use {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Ref is a reference to a symbol by its name.
+type Ref struct {
+	Symbol *Symbol
+
+	// Lit is the literal holding the name, such as an Assign.Name, a
+	// ParamExp.Param, or the first word of a function call.
+	Lit *syntax.Lit
+
+	// Scope is the scope in which the reference appears.
+	Scope *Scope
+
+	// Def is true if the reference sets or declares the symbol, such as
+	// "foo=bar", "read foo", "unset foo" or "foo() { ...; }". Use is true
+	// if the reference reads the variable or calls the function. Some
+	// references like "foo+=bar" or "((foo++))" do both.
+	Def, Use bool
+}
+
+// Scope is a scope in which variables can be declared. A file has a scope
+// for its global variables, and each function has a scope for its local
+// variables.
+type Scope struct {
+	Parent   *Scope
+	Children []*Scope
+
+	// Node is the *syntax.File or *syntax.FuncDecl creating the scope.
+	Node syntax.Node
+
+	// Vars holds the variables declared in the scope, by name.
+	Vars map[string]*Symbol
+}
+
+func newScope(parent *Scope, node syntax.Node) *Scope {
+	s := &Scope{Parent: parent, Node: node, Vars: make(map[string]*Symbol)}
+	if parent != nil {
+		parent.Children = append(parent.Children, s)
+	}
+	return s
+}
+
+// Lookup returns the variable with the given name in the scope or any of its
+// parents, or nil if there is no such variable.
+func (s *Scope) Lookup(name string) *Symbol {
+	for ; s != nil; s = s.Parent {
+		if sym := s.Vars[name]; sym != nil {
+			return sym
+		}
+	}
+	return nil
+}
+
+// Info holds the symbols found in a file by Analyze.
+type Info struct {
+	File *syntax.File
+
+	// Scope is the file scope.
+	Scope *Scope
+
+	// Funcs holds the functions declared in the file, by name.
+	Funcs map[string]*Symbol
+
+	// Refs holds all the references found in the file, by the literal
+	// holding the name.
+	Refs map[*syntax.Lit]*Ref
+
+	// Dynamic holds the nodes which may reference symbols in ways that
+	// cannot be resolved statically, such as calls to eval, commands with
+	// a non-literal name like "$cmd", or indirect parameter expansions
+	// like ${!ref} and ${!prefix*}.
+	Dynamic []syntax.Node
+}
+
+// Analyze resolves the variables and functions in a file, building a symbol
+// table with their definitions and uses.
+//
+// Variables are defined by assignments, declarations like "local" and
+// "declare", "read", "getopts", for loops, and arithmetic assignments like
+// "((foo++))". They are used by parameter expansions and arithmetic
+// expressions. Functions are defined by their declarations, and used by
+// calls where the command name is a literal.
+//
+// Variables are global, unless declared by "local", "declare" or "typeset"
+// without -g inside a function. Such a variable is local to the entire
+// function, even before it is declared.
+func Analyze(f *syntax.File) *Info {
+	a := &analyzer{
+		info: &Info{
+			File:  f,
+			Scope: newScope(nil, f),
+			Funcs: make(map[string]*Symbol),
+			Refs:  make(map[*syntax.Lit]*Ref),
+		},
+		scopes:     make(map[*syntax.FuncDecl]*Scope),
+		assoc:      make(map[string]bool),
+		arithWords: make(map[*syntax.Word]arithRef),
+		arrayElems: make(map[*syntax.ArrayElem]string),
+	}
+	a.scope = a.info.Scope
+	syntax.Apply(f, a.declare, a.leave)
+	a.scope = a.info.Scope
+	syntax.Apply(f, a.resolve, a.leave)
+	return a.info
+}
+
+type analyzer struct {
+	info  *Info
+	scope *Scope
+
+	scopes map[*syntax.FuncDecl]*Scope
+	assoc  map[string]bool
+
+	// arithWords holds the words in arithmetic expressions, so that
+	// parameter expansions within them like "a[i]" can be resolved
+	arithWords map[*syntax.Word]arithRef
+
+	// arrayElems holds the name of the array that each element of an
+	// array literal is assigned to, so that its index can be told
+	// apart from an associative array's key
+	arrayElems map[*syntax.ArrayElem]string
+}
+
+type arithRef struct{ def, use bool }
+
+func (a *analyzer) leave(c *syntax.Cursor) bool {
+	if _, ok := c.Node().(*syntax.FuncDecl); ok {
+		a.scope = a.scope.Parent
+	}
+	return true
+}
+
+// declare finds the scopes, the functions, and the local variables.
+func (a *analyzer) declare(c *syntax.Cursor) bool {
+	switch x := c.Node().(type) {
+	case *syntax.FuncDecl:
+		a.scope = newScope(a.scope, x)
+		a.scopes[x] = a.scope
+		name := x.Name.Value
+		if a.info.Funcs[name] == nil {
+			a.info.Funcs[name] = &Symbol{
+				Name:  name,
+				Kind:  Function,
+				Scope: a.info.Scope,
+			}
+		}
+	case *syntax.DeclClause:
+		flags := parseDecl(x)
+		for _, as := range x.Assigns {
+			if as.Name == nil {
+				continue
+			}
+			name := as.Name.Value
+			if flags.assoc {
+				a.assoc[name] = true
+			}
+			if flags.local && a.scope != a.info.Scope && a.scope.Vars[name] == nil {
+				a.scope.Vars[name] = &Symbol{
+					Name:  name,
+					Kind:  Variable,
+					Scope: a.scope,
+				}
+			}
+		}
+	}
+	return true
+}
+
+// resolve finds all the references and resolves them.
+func (a *analyzer) resolve(c *syntax.Cursor) bool {
+	switch x := c.Node().(type) {
+	case *syntax.FuncDecl:
+		a.ref(a.info.Funcs[x.Name.Value], x.Name, true, false)
+		a.scope = a.scopes[x]
+	case *syntax.DeclClause:
+		flags := parseDecl(x)
+		for _, as := range x.Assigns {
+			if as.Name == nil {
+				// e.g. declare "$name"
+				a.info.Dynamic = append(a.info.Dynamic, as)
+				continue
+			}
+			sym := a.lookup(as.Name.Value)
+			if flags.exported {
+				sym.Exported = true
+			}
+			a.ref(sym, as.Name, true, as.Append)
+		}
+	case *syntax.Assign:
+		if x.Array != nil && x.Name != nil {
+			for _, elem := range x.Array.Elems {
+				a.arrayElems[elem] = x.Name.Value
+			}
+		}
+		if _, ok := c.Parent().(*syntax.DeclClause); ok {
+			break // done above
+		}
+		if x.Name == nil {
+			break
+		}
+		sym := a.lookup(x.Name.Value)
+		if ce, ok := c.Parent().(*syntax.CallExpr); ok && len(ce.Args) > 0 {
+			sym.Exported = true
+		}
+		a.ref(sym, x.Name, true, x.Append)
+	case *syntax.WordIter:
+		a.ref(a.lookup(x.Name.Value), x.Name, true, false)
+	case *syntax.Word:
+		if !a.arithmetic(c) {
+			break
+		}
+		ar := arithRef{use: true}
+		switch p := c.Parent().(type) {
+		case *syntax.BinaryArithm:
+			if c.Name() != "X" {
+				break
+			}
+			switch p.Op {
+			case syntax.Assgn:
+				ar = arithRef{def: true}
+			case syntax.AddAssgn, syntax.SubAssgn, syntax.MulAssgn,
+				syntax.QuoAssgn, syntax.RemAssgn, syntax.AndAssgn,
+				syntax.OrAssgn, syntax.XorAssgn, syntax.ShlAssgn,
+				syntax.ShrAssgn:
+				ar = arithRef{def: true, use: true}
+			}
+		case *syntax.UnaryArithm:
+			if p.Op == syntax.Inc || p.Op == syntax.Dec {
+				ar = arithRef{def: true, use: true}
+			}
+		}
+		a.arithWords[x] = ar
+		if lit := wordLit(x); lit != nil && validName(lit.Value) {
+			a.ref(a.lookup(lit.Value), lit, ar.def, ar.use)
+		}
+	case *syntax.ParamExp:
+		if x.Excl && x.Index == nil {
+			a.info.Dynamic = append(a.info.Dynamic, x)
+		}
+		if x.Names != 0 || !validName(x.Param.Value) {
+			break
+		}
+		ar := arithRef{use: true}
+		if w, ok := c.Parent().(*syntax.Word); ok && len(w.Parts) == 1 {
+			if war, ok := a.arithWords[w]; ok {
+				ar = war
+			}
+		}
+		if x.Exp != nil && (x.Exp.Op == syntax.SubstAssgn ||
+			x.Exp.Op == syntax.SubstColAssgn) {
+			ar.def = true
+		}
+		a.ref(a.lookup(x.Param.Value), x.Param, ar.def, ar.use)
+	case *syntax.CallExpr:
+		a.call(x)
+	}
+	return true
+}
+
+// arithmetic reports whether the current node is an arithmetic expression.
+func (a *analyzer) arithmetic(c *syntax.Cursor) bool {
+	switch x := c.Parent().(type) {
+	case *syntax.ArithmExp, *syntax.ArithmCmd, *syntax.BinaryArithm,
+		*syntax.UnaryArithm, *syntax.ParenArithm, *syntax.CStyleLoop,
+		*syntax.LetClause:
+		return true
+	case *syntax.ParamExp:
+		switch c.Name() {
+		case "Slice.Offset", "Slice.Length":
+			return true
+		case "Index":
+			// associative arrays have string keys
+			return !a.assoc[x.Param.Value]
+		}
+	case *syntax.Assign:
+		return c.Name() == "Index" && !a.assoc[x.Name.Value]
+	case *syntax.ArrayElem:
+		name, ok := a.arrayElems[x]
+		return c.Name() == "Index" && ok && !a.assoc[name]
+	}
+	return false
+}
+
+func (a *analyzer) call(x *syntax.CallExpr) {
+	if len(x.Args) == 0 {
+		return
+	}
+	lit := wordLit(x.Args[0])
+	if lit == nil {
+		a.info.Dynamic = append(a.info.Dynamic, x)
+		return
+	}
+	if sym := a.info.Funcs[lit.Value]; sym != nil {
+		a.ref(sym, lit, false, true)
+		return
+	}
+	args := x.Args[1:]
+	switch lit.Value {
+	case "read":
+		a.readArgs(args)
+	case "getopts":
+		if len(args) < 2 {
+			break
+		}
+		if lit := wordLit(args[1]); lit != nil && validName(lit.Value) {
+			a.ref(a.lookup(lit.Value), lit, true, false)
+		}
+	case "unset":
+		funcs := false
+		for _, arg := range args {
+			lit := wordLit(arg)
+			if lit == nil {
+				continue
+			}
+			switch name := lit.Value; {
+			case name == "-f":
+				funcs = true
+			case name == "-v":
+				funcs = false
+			case funcs:
+				if sym := a.info.Funcs[name]; sym != nil {
+					a.ref(sym, lit, true, false)
+				}
+			case validName(name):
+				a.ref(a.lookup(name), lit, true, false)
+			}
+		}
+	case "eval":
+		a.info.Dynamic = append(a.info.Dynamic, x)
+	}
+}
+
+// readArgs finds the variables set by a read call.
+func (a *analyzer) readArgs(args []*syntax.Word) {
+	opts := true
+	for i := 0; i < len(args); i++ {
+		lit := wordLit(args[i])
+		if lit == nil {
+			opts = false
+			continue
+		}
+		val := lit.Value
+		if opts && val == "--" {
+			opts = false
+			continue
+		}
+		if opts && len(val) > 1 && val[0] == '-' {
+			for j := 1; j < len(val); j++ {
+				if !strings.ContainsRune("adinNptu", rune(val[j])) {
+					continue
+				}
+				// the rest of the word or the next word is
+				// the option's argument
+				if j == len(val)-1 && i+1 < len(args) {
+					i++
+					lit := wordLit(args[i])
+					if val[j] == 'a' && lit != nil && validName(lit.Value) {
+						a.ref(a.lookup(lit.Value), lit, true, false)
+					}
+				}
+				break
+			}
+			continue
+		}
+		opts = false
+		if validName(val) {
+			a.ref(a.lookup(val), lit, true, false)
+		}
+	}
+}
+
+// lookup finds the variable with the given name in the current scope. If
+// there is no such variable, it is added to the file scope.
+func (a *analyzer) lookup(name string) *Symbol {
+	if sym := a.scope.Lookup(name); sym != nil {
+		return sym
+	}
+	sym := &Symbol{Name: name, Kind: Variable, Scope: a.info.Scope}
+	a.info.Scope.Vars[name] = sym
+	return sym
+}
+
+func (a *analyzer) ref(sym *Symbol, lit *syntax.Lit, def, use bool) {
+	ref := &Ref{Symbol: sym, Lit: lit, Scope: a.scope, Def: def, Use: use}
+	sym.Refs = append(sym.Refs, ref)
+	a.info.Refs[lit] = ref
+}
+
+type declFlags struct {
+	local, exported, assoc bool
+}
+
+func parseDecl(x *syntax.DeclClause) declFlags {
+	var flags declFlags
+	if x.Variant != nil {
+		switch x.Variant.Value {
+		case "local", "declare", "typeset", "nameref":
+			flags.local = true
+		case "export":
+			flags.exported = true
+		}
+	}
+	for _, opt := range x.Opts {
+		lit := wordLit(opt)
+		if lit == nil || !strings.HasPrefix(lit.Value, "-") {
+			continue
+		}
+		for _, r := range lit.Value[1:] {
+			switch r {
+			case 'g':
+				flags.local = false
+			case 'x':
+				flags.exported = true
+			case 'A':
+				flags.assoc = true
+			}
+		}
+	}
+	return flags
+}
+
+// Symbols returns all the symbols in the file, sorted by the position of
+// their first reference.
+func (info *Info) Symbols() []*Symbol {
+	var syms []*Symbol
+	var addScope func(*Scope)
+	addScope = func(s *Scope) {
+		for _, sym := range s.Vars {
+			syms = append(syms, sym)
+		}
+		for _, child := range s.Children {
+			addScope(child)
+		}
+	}
+	addScope(info.Scope)
+	for _, sym := range info.Funcs {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		p1, p2 := firstPos(syms[i]), firstPos(syms[j])
+		if p1 == p2 {
+			return syms[i].Kind < syms[j].Kind
+		}
+		return p2.After(p1)
+	})
+	return syms
+}
+
+func firstPos(sym *Symbol) syntax.Pos {
+	if len(sym.Refs) == 0 {
+		return syntax.Pos{}
+	}
+	return sym.Refs[0].Lit.Pos()
+}
+
+// Undefined returns the uses of global variables which are never defined in
+// the file, grouped by variable. Note that these might still be set by the
+// environment, such as HOME, or by the shell itself, such as PWD or OPTARG.
+func (info *Info) Undefined() []*Ref {
+	var refs []*Ref
+	for _, sym := range info.Symbols() {
+		if sym.Kind == Variable && sym.Scope == info.Scope &&
+			len(sym.Defs()) == 0 {
+			refs = append(refs, sym.Uses()...)
+		}
+	}
+	return refs
+}
+
+// Unused returns the variables which are defined but never used in the file.
+// Exported variables are never considered unused, since other programs might
+// use them.
+func (info *Info) Unused() []*Symbol {
+	var syms []*Symbol
+	for _, sym := range info.Symbols() {
+		if sym.Kind == Variable && !sym.Exported && len(sym.Uses()) == 0 {
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
+// wordLit returns the literal making up a word, if it only consists of one.
+func wordLit(w *syntax.Word) *syntax.Lit {
+	if w == nil || len(w.Parts) != 1 {
+		return nil
+	}
+	lit, _ := w.Parts[0].(*syntax.Lit)
+	return lit
+}
+
+// validName reports whether s is a valid variable or function name, as
+// opposed to special parameters like $@ or positional ones like $1.
+func validName(s string) bool {
+	return s != "" && syntax.ValidName(s)
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package analysis
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/syntax"
+)
+
+func parse(tb testing.TB, src string) *syntax.File {
+	f, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return f
+}
+
+func refStr(ref *Ref) string {
+	sym := ref.Symbol
+	s := fmt.Sprintf("%s %s", ref.Lit.Pos(), sym.Name)
+	if sym.Kind == Function {
+		s += "()"
+	}
+	switch {
+	case ref.Def && ref.Use:
+		s += " def,use"
+	case ref.Def:
+		s += " def"
+	case ref.Use:
+		s += " use"
+	}
+	if fd, ok := sym.Scope.Node.(*syntax.FuncDecl); ok {
+		s += " local:" + fd.Name.Value
+	}
+	return s
+}
+
+func refStrs(info *Info) []string {
+	var refs []*Ref
+	for _, ref := range info.Refs {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[j].Lit.Pos().After(refs[i].Lit.Pos())
+	})
+	var strs []string
+	for _, ref := range refs {
+		strs = append(strs, refStr(ref))
+	}
+	return strs
+}
+
+var analyzeTests = []struct {
+	in   string
+	want []string
+}{
+	{"echo foo", nil},
+	{"echo $1 $@ ${#} $?", nil},
+	{
+		"foo=bar; echo $foo ${foo} \"${#foo}\"",
+		[]string{"1:1 foo def", "1:16 foo use", "1:22 foo use",
+			"1:31 foo use"},
+	},
+	{
+		"foo+=bar; foo=a cmd",
+		[]string{"1:1 foo def,use", "1:11 foo def"},
+	},
+	{
+		"a=(x y); echo ${a[1]} ${a[@]}",
+		[]string{"1:1 a def", "1:17 a use", "1:25 a use"},
+	},
+	{
+		"for i in 1 2; do echo $i; done",
+		[]string{"1:5 i def", "1:24 i use"},
+	},
+	{
+		"select i in 1 2; do echo $i; done",
+		[]string{"1:8 i def", "1:27 i use"},
+	},
+	{
+		"read -r -p prompt a b; read -a arr -d x; echo $a $b $arr",
+		[]string{"1:19 a def", "1:21 b def", "1:32 arr def",
+			"1:48 a use", "1:51 b use", "1:54 arr use"},
+	},
+	{
+		"read -ra arr -- -x; read -pfoo c",
+		[]string{"1:10 arr def", "1:32 c def"},
+	},
+	{
+		"while getopts ab: opt; do echo $opt; done",
+		[]string{"1:19 opt def", "1:33 opt use"},
+	},
+	{
+		"((i = 0, i++, j += i)); let 'k = j'; echo $((k * 2))",
+		[]string{"1:3 i def", "1:10 i def,use", "1:15 j def,use",
+			"1:20 i use", "1:46 k use"},
+	},
+	{
+		"for ((i = 0; i < n; i++)); do :; done",
+		[]string{"1:7 i def", "1:14 i use", "1:18 n use", "1:21 i def,use"},
+	},
+	{
+		"a[i+1]=x; echo ${a[j]} ${s:o:l}",
+		[]string{"1:1 a def", "1:3 i use", "1:18 a use", "1:20 j use",
+			"1:26 s use", "1:28 o use", "1:30 l use"},
+	},
+	{
+		"declare -A m; m[key]=x; echo ${m[key]}",
+		[]string{"1:12 m def", "1:15 m def", "1:32 m use"},
+	},
+	{
+		"declare -A m=([key]=v); a=([i]=x [j+1]=y)",
+		[]string{"1:12 m def", "1:25 a def", "1:29 i use", "1:35 j use"},
+	},
+	{
+		"echo ${foo:=bar} ${baz:-$qux}",
+		[]string{"1:8 foo def,use", "1:20 baz use", "1:26 qux use"},
+	},
+	{
+		"x=1\nf() {\n\tlocal x=2\n\techo $x $y\n\ty=3\n}\nf\necho $x",
+		[]string{"1:1 x def", "2:1 f() def", "3:8 x def local:f",
+			"4:8 x use local:f", "4:11 y use", "5:2 y def", "7:1 f() use",
+			"8:7 x use"},
+	},
+	{
+		"f() {\n\techo $x\n\tlocal x\n}\necho $x",
+		[]string{"1:1 f() def", "2:8 x use local:f", "3:8 x def local:f",
+			"5:7 x use"},
+	},
+	{
+		"f() {\n\tdeclare -g x=1\n\ttypeset y=2\n}",
+		[]string{"1:1 f() def", "2:13 x def", "3:10 y def local:f"},
+	},
+	{
+		"f() {\n\tlocal x\n\tg() { echo $x; }\n}",
+		[]string{"1:1 f() def", "2:8 x def local:f", "3:2 g() def",
+			"3:14 x use local:f"},
+	},
+	{
+		"g; f() { g; }; g() { :; }; unset -f g; unset -v f x",
+		[]string{"1:1 g() use", "1:4 f() def", "1:10 g() use",
+			"1:16 g() def", "1:37 g() def", "1:49 f def", "1:51 x def"},
+	},
+	{
+		"export A=1 B; readonly C=2",
+		[]string{"1:8 A def", "1:12 B def", "1:24 C def"},
+	},
+	{
+		"cat <<EOF\n$foo\nEOF",
+		[]string{"2:2 foo use"},
+	},
+	{
+		"echo '$foo' \"$bar\" \\$baz",
+		[]string{"1:15 bar use"},
+	},
+}
+
+func TestAnalyze(t *testing.T) {
+	t.Parallel()
+	for i, tc := range analyzeTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			info := Analyze(parse(t, tc.in))
+			got := refStrs(info)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Analyze mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAnalyzeScopes(t *testing.T) {
+	t.Parallel()
+	in := "f() {\n\tlocal a\n\tg() { local b; }\n}\nh() { :; }"
+	f := parse(t, in)
+	info := Analyze(f)
+	if info.Scope.Node != f || info.Scope.Parent != nil {
+		t.Fatalf("wrong file scope: %#v", info.Scope)
+	}
+	var names []string
+	var walk func(*Scope, string)
+	walk = func(s *Scope, indent string) {
+		name := "file"
+		if fd, ok := s.Node.(*syntax.FuncDecl); ok {
+			name = fd.Name.Value
+		}
+		var vars []string
+		for name := range s.Vars {
+			vars = append(vars, name)
+		}
+		sort.Strings(vars)
+		names = append(names, fmt.Sprintf("%s%s %v", indent, name, vars))
+		for _, child := range s.Children {
+			if child.Parent != s {
+				t.Fatalf("wrong parent in scope %s", name)
+			}
+			walk(child, indent+"\t")
+		}
+	}
+	walk(info.Scope, "")
+	want := []string{"file []", "\tf [a]", "\t\tg [b]", "\th []"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("wrong scopes\nwant: %q\ngot:  %q", want, names)
+	}
+	g := info.Scope.Children[0].Children[0]
+	if sym := g.Lookup("a"); sym == nil || sym.Scope != info.Scope.Children[0] {
+		t.Fatalf("Lookup did not find a in the parent scope: %#v", sym)
+	}
+	if sym := g.Lookup("c"); sym != nil {
+		t.Fatalf("Lookup found an unknown variable: %#v", sym)
+	}
+}
+
+func TestUndefinedUnused(t *testing.T) {
+	t.Parallel()
+	in := `
+a=1
+b=2
+export c=3
+echo $a $d $HOME
+f() {
+	local e=4 g
+	echo $g ${d}
+}
+`
+	info := Analyze(parse(t, in))
+	var undef []string
+	for _, ref := range info.Undefined() {
+		undef = append(undef, refStr(ref))
+	}
+	wantUndef := []string{"5:10 d use", "8:12 d use", "5:13 HOME use"}
+	if !reflect.DeepEqual(undef, wantUndef) {
+		t.Fatalf("Undefined mismatch\nwant: %q\ngot:  %q", wantUndef, undef)
+	}
+	var unused []string
+	for _, sym := range info.Unused() {
+		unused = append(unused, sym.Name)
+	}
+	wantUnused := []string{"b", "e"}
+	if !reflect.DeepEqual(unused, wantUnused) {
+		t.Fatalf("Unused mismatch\nwant: %q\ngot:  %q", wantUnused, unused)
+	}
+}
+
+func TestDynamic(t *testing.T) {
+	t.Parallel()
+	in := "eval \"$cmd\"; echo ${!ref} ${!pre*} ${!arr[@]}; declare \"$n\"=x; $cmd foo"
+	info := Analyze(parse(t, in))
+	var got []string
+	for _, node := range info.Dynamic {
+		got = append(got, fmt.Sprintf("%s %T", node.Pos(), node))
+	}
+	want := []string{
+		"1:1 *syntax.CallExpr",
+		"1:19 *syntax.ParamExp",
+		"1:27 *syntax.ParamExp",
+		"1:56 *syntax.Assign",
+		"1:64 *syntax.CallExpr",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Dynamic mismatch\nwant: %q\ngot:  %q", want, got)
+	}
+	if sym := info.Scope.Vars["ref"]; sym == nil || len(sym.Uses()) != 1 {
+		t.Fatalf("${!ref} is not a use of ref: %#v", sym)
+	}
+}
@@ -25,6 +25,8 @@ var (
 		Stdin:  os.Stdin,
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
+
+		ExecReplace: interp.DefaultExecReplace,
 	}
 )
 
@@ -73,35 +75,34 @@ func run(reader io.Reader, name string) error {
 	return runner.Run(prog)
 }
 
-type promptReader struct {
-	io.Reader
-	first bool
-}
-
-func (pr *promptReader) Read(p []byte) (int, error) {
-	if pr.first {
-		fmt.Printf("$ ")
-		pr.first = false
-	} else {
-		fmt.Printf("> ")
-	}
-	return pr.Reader.Read(p)
-}
-
 func interactive() error {
-	r := &promptReader{os.Stdin, true}
 	runner.Reset()
-	fn := func(s *syntax.Stmt) bool {
-		if err := runner.Stmt(s); err != nil {
-			code, ok := err.(interp.ExitCode)
-			if ok {
-				os.Exit(int(code))
+	fn := func(stmts []*syntax.Stmt) bool {
+		if parser.Incomplete() {
+			fmt.Printf("> ")
+			return true
+		}
+		for _, stmt := range stmts {
+			if err := runner.Stmt(stmt); err != nil {
+				code, ok := err.(interp.ExitCode)
+				if ok {
+					os.Exit(int(code))
+				}
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
 		}
-		r.first = true
+		fmt.Printf("$ ")
 		return true
 	}
-	return parser.Stmts(r, fn)
+	for {
+		fmt.Printf("$ ")
+		err := parser.Interactive(os.Stdin, fn)
+		if err == nil || syntax.IsIncomplete(err) {
+			// reached EOF
+			return err
+		}
+		// report the syntax error and keep reading lines
+		fmt.Fprintln(os.Stderr, err)
+	}
 }
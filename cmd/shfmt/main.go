@@ -13,7 +13,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strings"
 
+	"mvdan.cc/sh/analysis"
 	"mvdan.cc/sh/fileutil"
 	"mvdan.cc/sh/syntax"
 )
@@ -38,6 +40,7 @@ var (
 	minify      = flag.Bool("mn", false, "")
 
 	toJSON = flag.Bool("tojson", false, "")
+	rename = flag.String("rename", "", "")
 
 	parser            *syntax.Parser
 	printer           *syntax.Printer
@@ -84,6 +87,8 @@ Utilities:
 
   -f        recursively find all shell files and print the paths
   -tojson   print syntax tree to stdout as a typed JSON
+  -rename old=new
+            rename a variable or function
 `)
 	}
 	flag.Parse()
@@ -113,6 +118,14 @@ Utilities:
 	if *minify {
 		*simple = true
 	}
+	if *rename != "" {
+		i := strings.Index(*rename, "=")
+		if i <= 0 || i == len(*rename)-1 {
+			fmt.Fprintf(os.Stderr, "-rename must be of the form old=new\n")
+			os.Exit(1)
+		}
+		renameFrom, renameTo = (*rename)[:i], (*rename)[i+1:]
+	}
 	parser = syntax.NewParser(syntax.KeepComments, syntax.Variant(lang))
 	printer = syntax.NewPrinter(func(p *syntax.Printer) {
 		syntax.Indent(*indent)(p)
@@ -239,6 +252,11 @@ func formatBytes(src []byte, path string) error {
 	if err != nil {
 		return err
 	}
+	if renameFrom != "" {
+		if err := renameSymbol(prog, path); err != nil {
+			return err
+		}
+	}
 	if *simple {
 		syntax.Simplify(prog)
 	}
@@ -284,6 +302,55 @@ func formatBytes(src []byte, path string) error {
 	return nil
 }
 
+var renameFrom, renameTo string
+
+// renameSymbol renames the function or variable named renameFrom. Global
+// variables are preferred over local ones, and files which don't have any
+// such symbol are left alone. The references which cannot be renamed
+// statically are printed as warnings.
+func renameSymbol(prog *syntax.File, path string) error {
+	info := analysis.Analyze(prog)
+	var syms []*analysis.Symbol
+	if sym := info.Funcs[renameFrom]; sym != nil {
+		syms = append(syms, sym)
+	}
+	if sym := info.Scope.Vars[renameFrom]; sym != nil && len(sym.Defs()) > 0 {
+		syms = append(syms, sym)
+	}
+	if len(syms) == 0 {
+		for _, sym := range info.Symbols() {
+			if sym.Name == renameFrom && sym.Kind == analysis.Variable {
+				syms = append(syms, sym)
+			}
+		}
+	}
+	switch len(syms) {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("%s: %s is ambiguous; found %s and %s",
+			path, renameFrom, symbolDesc(syms[0]), symbolDesc(syms[1]))
+	}
+	sym := syms[0]
+	dynamic, err := info.Rename(sym, renameTo)
+	if err != nil {
+		return fmt.Errorf("%s: cannot rename %s: %v", path, renameFrom, err)
+	}
+	for _, node := range dynamic {
+		fmt.Fprintf(os.Stderr, "%s:%s: %s %s might be referenced dynamically\n",
+			path, node.Pos(), sym.Kind, renameFrom)
+	}
+	return nil
+}
+
+func symbolDesc(sym *analysis.Symbol) string {
+	if fd, ok := sym.Scope.Node.(*syntax.FuncDecl); ok {
+		return fmt.Sprintf("a local %s in %s", sym.Kind, fd.Name.Value)
+	}
+	return fmt.Sprintf("a %s", sym.Kind)
+}
+
 func writeTempFile(dir, prefix string, data []byte) (string, error) {
 	file, err := ioutil.TempFile(dir, prefix)
 	if err != nil {
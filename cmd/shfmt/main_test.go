@@ -78,6 +78,28 @@ func TestStdin(t *testing.T) {
 			t.Fatalf("got:\n%swant:\n%s", got, want)
 		}
 	})
+
+	t.Run("Rename", func(t *testing.T) {
+		renameFrom, renameTo = "foo", "bar"
+		defer func() { renameFrom, renameTo = "", "" }()
+		in = strings.NewReader("foo=1\necho \"$foo\" 'foo' ${#foo}\n")
+		buf.Reset()
+		if err := formatStdin(); err != nil {
+			t.Fatal(err)
+		}
+		want := "bar=1\necho \"$bar\" 'foo' ${#bar}\n"
+		if got := buf.String(); got != want {
+			t.Fatalf("got=%q want=%q", got, want)
+		}
+
+		in = strings.NewReader("foo=1\nbar=2\n")
+		buf.Reset()
+		err := formatStdin()
+		want = "<standard input>: cannot rename foo: variable bar already exists"
+		if err == nil || err.Error() != want {
+			t.Fatalf("got=%v want=%q", err, want)
+		}
+	})
 }
 
 type action uint
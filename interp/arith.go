@@ -6,51 +6,90 @@ package interp
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"mvdan.cc/sh/syntax"
 )
 
-func (r *Runner) arithm(expr syntax.ArithmExpr) int {
+// arithmError is an error encountered while evaluating an arithmetic
+// expression, such as a division by zero.
+type arithmError struct {
+	pos syntax.Pos
+	msg string
+}
+
+func (e *arithmError) Error() string {
+	return fmt.Sprintf("%v: %s", e.pos, e.msg)
+}
+
+func arithmErrf(pos syntax.Pos, format string, a ...interface{}) error {
+	return &arithmError{pos: pos, msg: fmt.Sprintf(format, a...)}
+}
+
+// arithm evaluates an arithmetic expression. Errors are printed and
+// stop the interpreter, just like with other expansion errors.
+func (r *Runner) arithm(expr syntax.ArithmExpr) int64 {
+	n, err := r.evalArithm(expr, 0)
+	if err != nil {
+		r.errf("%v\n", err)
+		r.exit = 1
+		r.lastExit()
+	}
+	return n
+}
+
+// arithmCmd is like arithm, but errors only result in an exit status
+// of 1, like in the "((expr))" and "let" commands.
+func (r *Runner) arithmCmd(expr syntax.ArithmExpr) (int64, bool) {
+	n, err := r.evalArithm(expr, 0)
+	if err != nil {
+		r.errf("%v\n", err)
+		r.exit = 1
+		return 0, false
+	}
+	return n, true
+}
+
+func (r *Runner) evalArithm(expr syntax.ArithmExpr, depth int) (int64, error) {
 	switch x := expr.(type) {
 	case *syntax.Word:
-		str := r.loneWord(x)
-		// recursively fetch vars
-		for str != "" {
-			val := r.getVar(str)
-			if val == "" {
-				break
-			}
-			str = val
-		}
-		// default to 0
-		return atoi(str)
+		return r.arithmStr(r.loneWord(x), x.Pos(), depth)
 	case *syntax.ParenArithm:
-		return r.arithm(x.X)
+		return r.evalArithm(x.X, depth)
 	case *syntax.UnaryArithm:
 		switch x.Op {
 		case syntax.Inc, syntax.Dec:
-			name := x.X.(*syntax.Word).Parts[0].(*syntax.Lit).Value
-			old := atoi(r.getVar(name))
+			name, index, err := r.arithmRef(x.X, depth)
+			if err != nil {
+				return 0, err
+			}
+			old, err := r.arithmRefVal(name, index, x.X.Pos(), depth)
+			if err != nil {
+				return 0, err
+			}
 			val := old
 			if x.Op == syntax.Inc {
 				val++
 			} else {
 				val--
 			}
-			r.setVarString(name, strconv.Itoa(val))
+			r.setArithmRef(name, index, val)
 			if x.Post {
-				return old
+				return old, nil
 			}
-			return val
+			return val, nil
+		}
+		val, err := r.evalArithm(x.X, depth)
+		if err != nil {
+			return 0, err
 		}
-		val := r.arithm(x.X)
 		switch x.Op {
 		case syntax.Not:
-			return oneIf(val == 0)
+			return int64(oneIf(val == 0)), nil
 		case syntax.Plus:
-			return val
+			return val, nil
 		default: // syntax.Minus
-			return -val
+			return -val, nil
 		}
 	case *syntax.BinaryArithm:
 		switch x.Op {
@@ -58,21 +97,181 @@ func (r *Runner) arithm(expr syntax.ArithmExpr) int {
 			syntax.MulAssgn, syntax.QuoAssgn, syntax.RemAssgn,
 			syntax.AndAssgn, syntax.OrAssgn, syntax.XorAssgn,
 			syntax.ShlAssgn, syntax.ShrAssgn:
-			return r.assgnArit(x)
+			return r.assgnArit(x, depth)
 		case syntax.Quest: // Colon can't happen here
-			cond := r.arithm(x.X)
+			cond, err := r.evalArithm(x.X, depth)
+			if err != nil {
+				return 0, err
+			}
 			b2 := x.Y.(*syntax.BinaryArithm) // must have Op==Colon
-			if cond == 1 {
-				return r.arithm(b2.X)
+			if cond != 0 {
+				return r.evalArithm(b2.X, depth)
 			}
-			return r.arithm(b2.Y)
+			return r.evalArithm(b2.Y, depth)
+		}
+		left, err := r.evalArithm(x.X, depth)
+		if err != nil {
+			return 0, err
 		}
-		return binArit(x.Op, r.arithm(x.X), r.arithm(x.Y))
+		// && and || only evaluate their right side if needed
+		switch {
+		case x.Op == syntax.AndArit && left == 0:
+			return 0, nil
+		case x.Op == syntax.OrArit && left != 0:
+			return 1, nil
+		}
+		right, err := r.evalArithm(x.Y, depth)
+		if err != nil {
+			return 0, err
+		}
+		return binArit(x.Op, left, right, x.Y.Pos())
 	default:
 		panic(fmt.Sprintf("unexpected arithm expr: %T", x))
 	}
 }
 
+// arithmStr evaluates a string found in an arithmetic expression. It
+// may be a number, the name of a variable, or an expression stored in
+// a variable, such as "1+2".
+func (r *Runner) arithmStr(str string, pos syntax.Pos, depth int) (int64, error) {
+	if depth > maxNameRefDepth {
+		return 0, arithmErrf(pos, "%s: expression recursion level exceeded", str)
+	}
+	str = strings.TrimSpace(str)
+	switch {
+	case str == "":
+		// unset and empty variables default to 0
+		return 0, nil
+	case '0' <= str[0] && str[0] <= '9' && strings.IndexFunc(str, notIntChar) < 0:
+		n, err := parseArithmInt(str)
+		if err != nil {
+			return 0, arithmErrf(pos, "%s: %v", str, err)
+		}
+		return n, nil
+	case syntax.ValidName(str):
+		vr, set := r.lookupVar(str)
+		if !set && r.opts[optNoUnset] {
+			return 0, arithmErrf(pos, "%s: unbound variable", str)
+		}
+		return r.arithmStr(r.varStr(vr, 0), pos, depth+1)
+	}
+	expr := parseArithmStr(str)
+	if expr == nil {
+		return 0, arithmErrf(pos, "%s: syntax error in expression", str)
+	}
+	n, err := r.evalArithm(expr, depth+1)
+	if aerr, ok := err.(*arithmError); ok {
+		// positions within expr are relative to str
+		aerr.pos = pos
+	}
+	return n, err
+}
+
+// parseArithmStr parses an arithmetic expression held by a variable.
+// Just like in other shells, it can only contain variable names and
+// numbers, so expansions such as "$(cmd)" are rejected. nil is
+// returned if str isn't a valid expression.
+func parseArithmStr(str string) syntax.ArithmExpr {
+	src := "((" + str + "))"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil || len(file.Stmts) != 1 {
+		return nil
+	}
+	st := file.Stmts[0]
+	cmd, ok := st.Cmd.(*syntax.ArithmCmd)
+	if !ok || st.Negated || st.Background || len(st.Redirs) > 0 {
+		return nil
+	}
+	valid := true
+	syntax.Walk(cmd.X, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.Word:
+			// numbers and names are handled by arithmStr, so
+			// any other lone literal like "@" is invalid
+			if _, ok := x.Parts[0].(*syntax.Lit); ok && node == cmd.X {
+				valid = false
+			}
+		case *syntax.ParamExp:
+			// only allow the "a[i]" form, and not "$a"
+			valid = valid && x.Dollar == x.Param.Pos()
+		case *syntax.SglQuoted, *syntax.DblQuoted, *syntax.CmdSubst,
+			*syntax.ArithmExp, *syntax.ProcSubst, *syntax.ExtGlob:
+			valid = false
+		}
+		return valid
+	})
+	if !valid {
+		return nil
+	}
+	return cmd.X
+}
+
+// notIntChar reports whether a character cannot be part of an integer
+// literal, as accepted by parseArithmInt.
+func notIntChar(c rune) bool {
+	switch {
+	case '0' <= c && c <= '9', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return false
+	case c == '@', c == '_', c == '#':
+		return false
+	}
+	return true
+}
+
+// parseArithmInt parses an integer literal as found in arithmetic
+// expressions. Apart from decimal, it supports the "0x" prefix for
+// hexadecimal, the "0" prefix for octal, and the "base#digits" form
+// with bases from 2 to 64.
+func parseArithmInt(str string) (int64, error) {
+	base := int64(10)
+	digits := str
+	if i := strings.IndexByte(str, '#'); i >= 0 {
+		n, err := strconv.ParseInt(str[:i], 10, 64)
+		if err != nil || n < 2 || n > 64 {
+			return 0, fmt.Errorf("invalid arithmetic base")
+		}
+		base, digits = n, str[i+1:]
+		if digits == "" {
+			return 0, fmt.Errorf("invalid integer constant")
+		}
+	} else if len(str) > 1 && str[0] == '0' {
+		base, digits = 8, str[1:]
+		if digits[0] == 'x' || digits[0] == 'X' {
+			base, digits = 16, digits[1:]
+		}
+	}
+	var n int64
+	for _, c := range digits {
+		var d int64
+		switch {
+		case '0' <= c && c <= '9':
+			d = int64(c - '0')
+		case 'a' <= c && c <= 'z':
+			d = int64(c-'a') + 10
+		case 'A' <= c && c <= 'Z':
+			d = int64(c - 'A')
+			if base > 36 {
+				d += 36
+			} else {
+				// case insensitive for bases up to 36
+				d += 10
+			}
+		case c == '@':
+			d = 62
+		case c == '_':
+			d = 63
+		default:
+			d = base // always too great
+		}
+		if d >= base {
+			return 0, fmt.Errorf("value too great for base")
+		}
+		// overflows wrap around, like in bash
+		n = n*base + d
+	}
+	return n, nil
+}
+
 func oneIf(b bool) int {
 	if b {
 		return 1
@@ -87,10 +286,73 @@ func atoi(s string) int {
 	return n
 }
 
-func (r *Runner) assgnArit(b *syntax.BinaryArithm) int {
-	name := b.X.(*syntax.Word).Parts[0].(*syntax.Lit).Value
-	val := atoi(r.getVar(name))
-	arg := r.arithm(b.Y)
+// arithmRef returns the name and index of the variable an arithmetic
+// assignment refers to, such as "a" or "a[i+1]". The index of an
+// indexed array is evaluated only once, so that "a[i++]++" only
+// increments i once.
+func (r *Runner) arithmRef(expr syntax.ArithmExpr, depth int) (string, syntax.ArithmExpr, error) {
+	if w, ok := expr.(*syntax.Word); ok && len(w.Parts) == 1 {
+		switch x := w.Parts[0].(type) {
+		case *syntax.Lit:
+			if syntax.ValidName(x.Value) {
+				return x.Value, nil, nil
+			}
+		case *syntax.ParamExp:
+			if x.Dollar != x.Param.Pos() || x.Index == nil {
+				break // not of the form "a[i]"
+			}
+			name := x.Param.Value
+			vr, _ := r.lookupVar(name)
+			if _, ok := vr.Value.(AssocArray); ok {
+				return name, x.Index, nil
+			}
+			i, err := r.evalArithm(x.Index, depth)
+			if err != nil {
+				return "", nil, err
+			}
+			return name, arithmLit(i), nil
+		}
+	}
+	return "", nil, arithmErrf(expr.Pos(), "attempted assignment to non-variable")
+}
+
+func (r *Runner) arithmRefVal(name string, index syntax.ArithmExpr, pos syntax.Pos, depth int) (int64, error) {
+	if index == nil {
+		return r.arithmStr(r.getVar(name), pos, depth+1)
+	}
+	vr, _ := r.lookupVar(name)
+	return r.arithmStr(r.varInd(vr, index, 0), pos, depth+1)
+}
+
+func (r *Runner) setArithmRef(name string, index syntax.ArithmExpr, val int64) {
+	r.setVar(name, index, Variable{
+		Value: StringVal(strconv.FormatInt(val, 10)),
+	})
+}
+
+// arithmLit returns a word holding a number, to be used as an already
+// evaluated arithmetic expression.
+func arithmLit(n int64) *syntax.Word {
+	return &syntax.Word{Parts: []syntax.WordPart{
+		&syntax.Lit{Value: strconv.FormatInt(n, 10)},
+	}}
+}
+
+func (r *Runner) assgnArit(b *syntax.BinaryArithm, depth int) (int64, error) {
+	name, index, err := r.arithmRef(b.X, depth)
+	if err != nil {
+		return 0, err
+	}
+	var val int64
+	if b.Op != syntax.Assgn {
+		if val, err = r.arithmRefVal(name, index, b.X.Pos(), depth); err != nil {
+			return 0, err
+		}
+	}
+	arg, err := r.evalArithm(b.Y, depth)
+	if err != nil {
+		return 0, err
+	}
 	switch b.Op {
 	case syntax.Assgn:
 		val = arg
@@ -101,9 +363,9 @@ func (r *Runner) assgnArit(b *syntax.BinaryArithm) int {
 	case syntax.MulAssgn:
 		val *= arg
 	case syntax.QuoAssgn:
-		val /= arg
+		val, err = binArit(syntax.Quo, val, arg, b.Y.Pos())
 	case syntax.RemAssgn:
-		val %= arg
+		val, err = binArit(syntax.Rem, val, arg, b.Y.Pos())
 	case syntax.AndAssgn:
 		val &= arg
 	case syntax.OrAssgn:
@@ -111,16 +373,19 @@ func (r *Runner) assgnArit(b *syntax.BinaryArithm) int {
 	case syntax.XorAssgn:
 		val ^= arg
 	case syntax.ShlAssgn:
-		val <<= uint(arg)
+		val = shiftArit(val, arg, true)
 	case syntax.ShrAssgn:
-		val >>= uint(arg)
+		val = shiftArit(val, arg, false)
+	}
+	if err != nil {
+		return 0, err
 	}
-	r.setVarString(name, strconv.Itoa(val))
-	return val
+	r.setArithmRef(name, index, val)
+	return val, nil
 }
 
-func intPow(a, b int) int {
-	p := 1
+func intPow(a, b int64) int64 {
+	p := int64(1)
 	for b > 0 {
 		if b&1 != 0 {
 			p *= a
@@ -131,48 +396,68 @@ func intPow(a, b int) int {
 	return p
 }
 
-func binArit(op syntax.BinAritOperator, x, y int) int {
+// shiftArit shifts x by y bits. Like on most machines bash runs on,
+// only the lowest 6 bits of y are used.
+func shiftArit(x, y int64, left bool) int64 {
+	if left {
+		return x << uint(y&63)
+	}
+	return x >> uint(y&63)
+}
+
+// binArit applies a binary operator. ypos is used to report errors
+// caused by the right operand, such as a division by zero.
+func binArit(op syntax.BinAritOperator, x, y int64, ypos syntax.Pos) (int64, error) {
 	switch op {
 	case syntax.Add:
-		return x + y
+		return x + y, nil
 	case syntax.Sub:
-		return x - y
+		return x - y, nil
 	case syntax.Mul:
-		return x * y
-	case syntax.Quo:
-		return x / y
-	case syntax.Rem:
-		return x % y
+		return x * y, nil
+	case syntax.Quo, syntax.Rem:
+		if y == 0 {
+			return 0, arithmErrf(ypos, "division by 0")
+		}
+		// note that Go, like bash, does not panic on
+		// math.MinInt64 / -1; the result simply wraps around
+		if op == syntax.Quo {
+			return x / y, nil
+		}
+		return x % y, nil
 	case syntax.Pow:
-		return intPow(x, y)
+		if y < 0 {
+			return 0, arithmErrf(ypos, "exponent less than 0")
+		}
+		return intPow(x, y), nil
 	case syntax.Eql:
-		return oneIf(x == y)
+		return int64(oneIf(x == y)), nil
 	case syntax.Gtr:
-		return oneIf(x > y)
+		return int64(oneIf(x > y)), nil
 	case syntax.Lss:
-		return oneIf(x < y)
+		return int64(oneIf(x < y)), nil
 	case syntax.Neq:
-		return oneIf(x != y)
+		return int64(oneIf(x != y)), nil
 	case syntax.Leq:
-		return oneIf(x <= y)
+		return int64(oneIf(x <= y)), nil
 	case syntax.Geq:
-		return oneIf(x >= y)
+		return int64(oneIf(x >= y)), nil
 	case syntax.And:
-		return x & y
+		return x & y, nil
 	case syntax.Or:
-		return x | y
+		return x | y, nil
 	case syntax.Xor:
-		return x ^ y
+		return x ^ y, nil
 	case syntax.Shr:
-		return x >> uint(y)
+		return shiftArit(x, y, false), nil
 	case syntax.Shl:
-		return x << uint(y)
+		return shiftArit(x, y, true), nil
 	case syntax.AndArit:
-		return oneIf(x != 0 && y != 0)
+		return int64(oneIf(x != 0 && y != 0)), nil
 	case syntax.OrArit:
-		return oneIf(x != 0 || y != 0)
+		return int64(oneIf(x != 0 || y != 0)), nil
 	default: // syntax.Comma
 		// x is executed but its result discarded
-		return y
+		return y, nil
 	}
 }
@@ -4,11 +4,12 @@
 package interp
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -22,7 +23,8 @@ func isBuiltin(name string) bool {
 		"wait", "builtin", "trap", "type", "source", ".", "command",
 		"dirs", "pushd", "popd", "umask", "alias", "unalias",
 		"fg", "bg", "getopts", "eval", "test", "[", "exec",
-		"return", "read", "shopt":
+		"return", "read", "shopt", "times", "ulimit", "hash",
+		"caller":
 		return true
 	}
 	return false
@@ -182,19 +184,78 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			return 2
 		}
 	case "pwd":
-		r.outf("%s\n", r.getVar("PWD"))
+		physical := false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			for _, flag := range args[0][1:] {
+				switch flag {
+				case 'L':
+					physical = false
+				case 'P':
+					physical = true
+				default:
+					r.errf("pwd: invalid option %q\n", args[0])
+					return 2
+				}
+			}
+			args = args[1:]
+		}
+		if physical {
+			r.outf("%s\n", r.physicalDir(r.Dir))
+		} else {
+			r.outf("%s\n", r.logicalDir())
+		}
 	case "cd":
+		physical := false
+		for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+			if args[0] == "--" {
+				args = args[1:]
+				break
+			}
+			for _, flag := range args[0][1:] {
+				switch flag {
+				case 'L':
+					physical = false
+				case 'P':
+					physical = true
+				default:
+					r.errf("cd: invalid option %q\n", args[0])
+					return 2
+				}
+			}
+			args = args[1:]
+		}
 		var path string
+		printDir := false
 		switch len(args) {
 		case 0:
 			path = r.getVar("HOME")
 		case 1:
 			path = args[0]
 		default:
-			r.errf("usage: cd [dir]\n")
+			r.errf("usage: cd [-L|-P] [dir]\n")
 			return 2
 		}
-		return r.changeDir(path)
+		if path == "-" {
+			vr, ok := r.lookupVar("OLDPWD")
+			if !ok {
+				r.errf("cd: OLDPWD not set\n")
+				return 1
+			}
+			path = r.varStr(vr, 0)
+			printDir = true
+		} else if found := r.searchCDPath(path); found != "" {
+			path = found
+			printDir = true
+		}
+		if physical {
+			path = r.physicalDir(r.relPath(path))
+		}
+		if code := r.changeDir(path); code != 0 {
+			return code
+		}
+		if printDir {
+			r.outf("%s\n", r.Dir)
+		}
 	case "wait":
 		if len(args) > 0 {
 			panic("wait with args not handled yet")
@@ -209,26 +270,126 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 		}
 		return r.builtinCode(pos, args[0], args[1:])
 	case "type":
+		all, kindOnly := false, false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			for _, flag := range args[0][1:] {
+				switch flag {
+				case 'a':
+					all = true
+				case 't':
+					kindOnly = true
+				default:
+					r.errf("type: invalid option %q\n", args[0])
+					return 2
+				}
+			}
+			args = args[1:]
+		}
 		anyNotFound := false
 		for _, arg := range args {
-			if _, ok := r.Funcs[arg]; ok {
-				r.outf("%s is a function\n", arg)
-				continue
-			}
-			if isBuiltin(arg) {
-				r.outf("%s is a shell builtin\n", arg)
-				continue
-			}
-			if path, err := exec.LookPath(arg); err == nil {
-				r.outf("%s is %s\n", arg, path)
-				continue
+			if !r.printType(arg, all, kindOnly) {
+				if !kindOnly {
+					r.errf("type: %s: not found\n", arg)
+				}
+				anyNotFound = true
 			}
-			r.errf("type: %s: not found\n", arg)
-			anyNotFound = true
 		}
 		if anyNotFound {
 			return 1
 		}
+	case "hash":
+		r.checkHashPath()
+		clear, remove, printPaths, reusable := false, false, false, false
+		setPath := ""
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			flags := args[0]
+			args = args[1:]
+			for _, flag := range flags[1:] {
+				switch flag {
+				case 'r':
+					r.hashTable = nil
+					clear = true
+				case 'd':
+					remove = true
+				case 't':
+					printPaths = true
+				case 'l':
+					reusable = true
+				case 'p':
+					if len(args) == 0 {
+						r.errf("hash: -p: option requires an argument\n")
+						return 1
+					}
+					setPath = args[0]
+					args = args[1:]
+				default:
+					r.errf("hash: invalid option %q\n", flags)
+					return 2
+				}
+			}
+		}
+		if len(args) == 0 {
+			if printPaths {
+				r.errf("hash: -t: option requires an argument\n")
+				return 1
+			}
+			if clear {
+				break // nothing to list
+			}
+			if len(r.hashTable) == 0 {
+				if !reusable {
+					r.outf("hash: hash table empty\n")
+				}
+				break
+			}
+			names := make([]string, 0, len(r.hashTable))
+			for name := range r.hashTable {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reusable {
+				r.outf("hits\tcommand\n")
+			}
+			for _, name := range names {
+				e := r.hashTable[name]
+				if reusable {
+					r.outf("builtin hash -p %s %s\n", e.path, name)
+				} else {
+					r.outf("%4d\t%s\n", e.hits, e.path)
+				}
+			}
+			break
+		}
+		code := 0
+		for _, name := range args {
+			switch {
+			case setPath != "":
+				r.writableHashTable()[name] = hashEntry{path: setPath}
+			case printPaths:
+				e, ok := r.hashTable[name]
+				switch {
+				case !ok:
+					r.errf("hash: %s: not found\n", name)
+					code = 1
+				case len(args) > 1:
+					r.outf("%s\t%s\n", name, e.path)
+				default:
+					r.outf("%s\n", e.path)
+				}
+			case remove:
+				if _, ok := r.hashTable[name]; ok {
+					delete(r.writableHashTable(), name)
+				}
+			case r.Funcs[name] != nil || isBuiltin(name):
+				// never looked up in $PATH
+			default:
+				if r.hashCommand(name) == "" {
+					r.errf("hash: %s: not found\n", name)
+					code = 1
+				}
+			}
+		}
+		return code
 	case "eval":
 		src := strings.Join(args, " ")
 		p := syntax.NewParser()
@@ -260,8 +421,13 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 		r.Params = args[1:]
 		oldInSource := r.inSource
 		r.inSource = true
+		r.pushFrame(Frame{Func: "source", Pos: pos, File: r.filename, Source: args[0]})
+		oldFilename := r.filename
+		r.filename = args[0]
 		r.stmts(file.StmtList)
 
+		r.filename = oldFilename
+		r.popFrame()
 		r.Params = oldParams
 		r.inSource = oldInSource
 		if code, ok := r.err.(returnCode); ok {
@@ -292,23 +458,28 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 		}
 		return oneIf(r.bashTest(expr, true) == "")
 	case "exec":
-		// TODO: Consider syscall.Exec, i.e. actually replacing
-		// the process. It's in theory what a shell should do,
-		// but in practice it would kill the entire Go process
-		// and it's not available on Windows.
 		if len(args) == 0 {
 			r.keepRedirs = true
 			break
 		}
-		r.exec(args)
+		// Replacing the process is opt-in, as it would kill
+		// the entire Go program. Subshells run within the same
+		// process, so they must not replace it either.
+		mod := r.Exec
+		if r.ExecReplace != nil && !r.inSubshell {
+			mod = r.ExecReplace
+		}
+		r.execModule(mod, args)
 		r.lastExit()
 		return r.exit
 	case "command":
-		show := false
+		show, verbose := false, false
 		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
 			switch args[0] {
 			case "-v":
 				show = true
+			case "-V":
+				verbose = true
 			default:
 				r.errf("command: invalid option %s\n", args[0])
 				return 2
@@ -318,6 +489,15 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 		if len(args) == 0 {
 			break
 		}
+		if verbose {
+			for _, arg := range args {
+				if !r.printType(arg, false, false) {
+					r.errf("command: %s: not found\n", arg)
+					return 1
+				}
+			}
+			break
+		}
 		if !show {
 			if isBuiltin(args[0]) {
 				return r.builtinCode(pos, args[0], args[1:])
@@ -330,7 +510,7 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			last = 0
 			if r.Funcs[arg] != nil || isBuiltin(arg) {
 				r.outf("%s\n", arg)
-			} else if path, err := exec.LookPath(arg); err == nil {
+			} else if path := r.typePath(arg); path != "" {
 				r.outf("%s\n", path)
 			} else {
 				last = 1
@@ -429,6 +609,7 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			return 2
 		}
 		r.setErr(returnCode(code))
+		return code
 	case "read":
 		raw := false
 		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
@@ -515,32 +696,54 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 	case "shopt":
 		mode := ""
 		posixOpts := false
+		reusable, quiet := false, false
 		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
-			switch args[0] {
-			case "-s", "-u":
-				mode = args[0]
-			case "-o":
-				posixOpts = true
-			case "-p", "-q":
-				panic(fmt.Sprintf("unhandled shopt flag: %s", args[0]))
-			default:
-				r.errf("shopt: invalid option %q\n", args[0])
-				return 2
+			// flags may be combined, like "-po"
+			for _, flag := range args[0][1:] {
+				switch flag {
+				case 's', 'u':
+					mode = "-" + string(flag)
+				case 'o':
+					posixOpts = true
+				case 'p':
+					reusable = true
+				case 'q':
+					quiet = true
+				default:
+					r.errf("shopt: invalid option %q\n", args[0])
+					return 2
+				}
 			}
 			args = args[1:]
 		}
+		printOpt := func(name string, enabled bool) {
+			switch {
+			case quiet:
+			case !reusable:
+				r.printOptLine(name, enabled)
+			case posixOpts:
+				r.printSetOptLine(name, enabled)
+			default:
+				flag := "-u"
+				if enabled {
+					flag = "-s"
+				}
+				r.outf("shopt %s %s\n", flag, name)
+			}
+		}
 		if len(args) == 0 {
 			if !posixOpts {
 				for i, name := range bashOptsTable {
-					r.printOptLine(name, r.opts[len(shellOptsTable)+i])
+					printOpt(name, r.opts[len(shellOptsTable)+i])
 				}
 				break
 			}
 			for i, opt := range &shellOptsTable {
-				r.printOptLine(opt.name, r.opts[i])
+				printOpt(opt.name, r.opts[i])
 			}
 			break
 		}
+		allEnabled := true
 		for _, arg := range args {
 			opt := r.optByName(arg, !posixOpts)
 			if opt == nil {
@@ -551,12 +754,89 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			case "-s", "-u":
 				*opt = mode == "-s"
 			default: // ""
-				r.printOptLine(arg, *opt)
+				printOpt(arg, *opt)
+				allEnabled = allEnabled && *opt
 			}
 		}
+		if !allEnabled {
+			return 1
+		}
+
+	case "umask":
+		reusable, symbolic := false, false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+			for _, flag := range args[0][1:] {
+				switch flag {
+				case 'p':
+					reusable = true
+				case 'S':
+					symbolic = true
+				default:
+					r.errf("umask: invalid option %q\n", args[0])
+					return 2
+				}
+			}
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			mask, err := parseUmask(args[0], r.umask)
+			if err != nil {
+				r.errf("umask: %v\n", err)
+				return 1
+			}
+			r.umask = mask
+			break
+		}
+		str := fmt.Sprintf("%04o", uint32(r.umask))
+		if symbolic {
+			str = umaskSymbolic(r.umask)
+		}
+		switch {
+		case reusable && symbolic:
+			r.outf("umask -S %s\n", str)
+		case reusable:
+			r.outf("umask %s\n", str)
+		default:
+			r.outf("%s\n", str)
+		}
+
+	case "caller":
+		stack := r.callStack
+		if len(args) == 0 {
+			if len(stack) == 0 {
+				r.outf("0 NULL\n")
+				break
+			}
+			fr := stack[len(stack)-1]
+			r.outf("%d %s\n", fr.Pos.Line(), callerFile(fr.File))
+			break
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			r.errf("caller: %s: invalid number\n", args[0])
+			return 2
+		}
+		if n >= len(stack) {
+			return 1
+		}
+		i := len(stack) - 1 - n
+		fn := "main"
+		if i > 0 {
+			fn = stack[i-1].Func
+		}
+		r.outf("%d %s %s\n", stack[i].Pos.Line(), fn, callerFile(stack[i].File))
+
+	case "ulimit":
+		return r.ulimit(args)
+
+	case "times":
+		user, sys := processTimes()
+		childUser, childSys := r.childTimes.get()
+		r.outf("%s %s\n", elapsedString(user, false), elapsedString(sys, false))
+		r.outf("%s %s\n", elapsedString(childUser, false), elapsedString(childSys, false))
 
 	default:
-		// "trap", "umask", "alias", "unalias", "fg", "bg",
+		// "trap", "alias", "unalias", "fg", "bg",
 		panic(fmt.Sprintf("unhandled builtin: %s", name))
 	}
 	return 0
@@ -570,6 +850,16 @@ func (r *Runner) printOptLine(name string, enabled bool) {
 	r.outf("%s\t%s\n", name, status)
 }
 
+// printSetOptLine prints an option in the form accepted by "set", to
+// be able to reuse the output as input.
+func (r *Runner) printSetOptLine(name string, enabled bool) {
+	flag := "+o"
+	if enabled {
+		flag = "-o"
+	}
+	r.outf("set %s %s\n", flag, name)
+}
+
 func (r *Runner) ifsFields(s string, n int, raw bool) []string {
 	type pos struct {
 		start, end int
@@ -669,11 +959,62 @@ func (r *Runner) changeDir(path string) int {
 		return 1
 	}
 	r.Dir = path
-	r.Vars["OLDPWD"] = r.Vars["PWD"]
-	r.Vars["PWD"] = Variable{Value: StringVal(path)}
+	oldpwd, _ := r.vars.get("PWD")
+	r.vars.set("OLDPWD", oldpwd)
+	r.vars.set("PWD", Variable{Value: StringVal(path)})
 	return 0
 }
 
+// searchCDPath finds a directory to cd into in $CDPATH. An empty
+// string is returned if $CDPATH doesn't apply or has no match, or if
+// the match is relative to the current directory.
+func (r *Runner) searchCDPath(path string) string {
+	if path == "" || filepath.IsAbs(path) || path == "." || path == ".." ||
+		strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") {
+		return ""
+	}
+	cdpath := r.getVar("CDPATH")
+	if cdpath == "" {
+		return ""
+	}
+	for _, dir := range strings.Split(cdpath, ":") {
+		full := filepath.Join(r.relPath(dir), path)
+		if info, err := r.stat(full); err == nil && info.IsDir() {
+			if dir == "" {
+				// the current directory
+				return ""
+			}
+			return full
+		}
+	}
+	return ""
+}
+
+// logicalDir returns the current directory including any symbolic
+// links followed to reach it, as kept in $PWD.
+func (r *Runner) logicalDir() string {
+	pwd := r.getVar("PWD")
+	if !filepath.IsAbs(pwd) {
+		return r.Dir
+	}
+	// $PWD may have been modified
+	info1, err1 := os.Stat(pwd)
+	info2, err2 := os.Stat(r.Dir)
+	if err1 != nil || err2 != nil || !os.SameFile(info1, info2) {
+		return r.Dir
+	}
+	return filepath.Clean(pwd)
+}
+
+// physicalDir returns a directory with all symbolic links resolved, or
+// the directory itself if they can't be.
+func (r *Runner) physicalDir(dir string) string {
+	if path, err := filepath.EvalSymlinks(dir); err == nil {
+		return path
+	}
+	return dir
+}
+
 func (r *Runner) relPath(path string) string {
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(r.Dir, path)
@@ -722,3 +1063,149 @@ func (g *getopts) Next(optstr string, args []string) (opt rune, optarg string, d
 
 	return opt, optarg, false
 }
+
+// parseUmask parses a umask in octal or in symbolic form, such as
+// "u=rwx,g=rx,o=". Symbolic modes are relative to the old mask.
+func parseUmask(s string, old os.FileMode) (os.FileMode, error) {
+	if s != "" && '0' <= s[0] && s[0] <= '9' {
+		n, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || n > 07777 {
+			return 0, fmt.Errorf("%s: octal number out of range", s)
+		}
+		return os.FileMode(n) & os.ModePerm, nil
+	}
+	// symbolic modes describe the allowed permissions, the opposite
+	// of the mask
+	perm := ^old & os.ModePerm
+	for _, clause := range strings.Split(s, ",") {
+		var who os.FileMode
+		i := 0
+	whoLoop:
+		for ; i < len(clause); i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 0700
+			case 'g':
+				who |= 0070
+			case 'o':
+				who |= 0007
+			case 'a':
+				who |= 0777
+			default:
+				break whoLoop
+			}
+		}
+		if who == 0 {
+			who = 0777
+		}
+		if i == len(clause) {
+			return 0, fmt.Errorf("%s: missing symbolic mode operator", s)
+		}
+		op := clause[i]
+		switch op {
+		case '+', '-', '=':
+		default:
+			return 0, fmt.Errorf("`%c': invalid symbolic mode operator", op)
+		}
+		var bits os.FileMode
+		for _, c := range clause[i+1:] {
+			switch c {
+			case 'r':
+				bits |= 0444
+			case 'w':
+				bits |= 0222
+			case 'x':
+				bits |= 0111
+			default:
+				return 0, fmt.Errorf("`%c': invalid symbolic mode character", c)
+			}
+		}
+		bits &= who
+		switch op {
+		case '+':
+			perm |= bits
+		case '-':
+			perm &^= bits
+		case '=':
+			perm = perm&^who | bits
+		}
+	}
+	return ^perm & os.ModePerm, nil
+}
+
+// umaskSymbolic formats a umask in symbolic form, such as
+// "u=rwx,g=rx,o=rx".
+func umaskSymbolic(mask os.FileMode) string {
+	perm := ^mask & os.ModePerm
+	var buf bytes.Buffer
+	for i, who := range [...]string{"u", "g", "o"} {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(who + "=")
+		bits := perm >> uint(6-3*i)
+		for j, c := range "rwx" {
+			if bits&(4>>uint(j)) != 0 {
+				buf.WriteRune(c)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// printType prints what a command name would run, as done by "type" and
+// "command -V". If all is true, all the matches are printed instead of
+// just the first, and if kindOnly is true, only the kinds of command
+// are printed, such as "builtin". It reports whether any was found.
+func (r *Runner) printType(name string, all, kindOnly bool) bool {
+	found := false
+	report := func(kind, format string, a ...interface{}) {
+		found = true
+		if kindOnly {
+			r.outf("%s\n", kind)
+		} else {
+			r.outf(format, a...)
+		}
+	}
+	if r.Funcs[name] != nil {
+		report("function", "%s is a function\n", name)
+	}
+	if isBuiltin(name) && (all || !found) {
+		report("builtin", "%s is a shell builtin\n", name)
+	}
+	if found && !all {
+		return true
+	}
+	if !all {
+		r.checkHashPath()
+		if e, ok := r.hashTable[name]; ok {
+			report("file", "%s is hashed (%s)\n", name, e.path)
+			return true
+		}
+	}
+	for _, path := range r.pathMatches(name, all) {
+		report("file", "%s is %s\n", name, path)
+	}
+	return found
+}
+
+// typePath returns the path of the program that a command would run,
+// without adding it to the hash table.
+func (r *Runner) typePath(name string) string {
+	r.checkHashPath()
+	if e, ok := r.hashTable[name]; ok {
+		return e.path
+	}
+	if paths := r.pathMatches(name, false); len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
+
+// callerFile returns the file name as printed by caller.
+func callerFile(name string) string {
+	if name == "" {
+		return "NULL"
+	}
+	return name
+}
@@ -0,0 +1,11 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import "syscall"
+
+// dup2 uses dup3, as some architectures like arm64 lack dup2.
+func dup2(oldfd, newfd int) error {
+	return syscall.Dup3(oldfd, newfd, 0)
+}
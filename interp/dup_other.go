@@ -0,0 +1,12 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !linux,!windows,!js
+
+package interp
+
+import "golang.org/x/sys/unix"
+
+func dup2(oldfd, newfd int) error {
+	return unix.Dup2(oldfd, newfd)
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build windows js
+
+package interp
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// replaceProcess always fails, as processes cannot be replaced on
+// Windows or JavaScript.
+func replaceProcess(path string, args, env []string, dir string, files [3]*os.File) error {
+	return fmt.Errorf("cannot replace the process on %s", runtime.GOOS)
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !windows,!js
+
+package interp
+
+import (
+	"os"
+	"syscall"
+)
+
+// replaceProcess replaces the current process with the program at path,
+// after moving the given files to the standard file descriptors. It
+// only returns if an error is encountered.
+func replaceProcess(path string, args, env []string, dir string, files [3]*os.File) error {
+	if dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+	}
+	for i, f := range files {
+		if fd := int(f.Fd()); fd != i {
+			if err := dup2(fd, i); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syscall.Exec(path, args, env); err != nil {
+		return &os.PathError{Op: "exec", Path: path, Err: err}
+	}
+	return nil
+}
@@ -4,9 +4,10 @@
 package interp
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
-	"os/user"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -149,7 +150,16 @@ func (r *Runner) Fields(words ...*syntax.Word) []string {
 					if !abs {
 						path = filepath.Join(baseDir, path)
 					}
-					matches = glob(path, r.opts[optGlobStar])
+					matches = r.glob(path)
+					if len(matches) == 0 && r.opts[optFailGlob] {
+						r.errf("no match: %s\n", r.fieldJoin(field))
+						r.exit = 1
+						r.lastExit()
+						return nil
+					}
+					if len(matches) == 0 && r.opts[optNullGlob] {
+						continue
+					}
 				}
 				if len(matches) == 0 {
 					fields = append(fields, r.fieldJoin(field))
@@ -273,7 +283,7 @@ func (r *Runner) wordField(wps []syntax.WordPart, ql quoteLevel) []fieldPart {
 			field = append(field, fieldPart{val: r.cmdSubst(x)})
 		case *syntax.ArithmExp:
 			field = append(field, fieldPart{
-				val: strconv.Itoa(r.arithm(x.X)),
+				val: strconv.FormatInt(r.arithm(x.X), 10),
 			})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
@@ -284,11 +294,57 @@ func (r *Runner) wordField(wps []syntax.WordPart, ql quoteLevel) []fieldPart {
 
 func (r *Runner) cmdSubst(cs *syntax.CmdSubst) string {
 	r2 := r.sub()
-	buf := r.strBuilder()
-	r2.Stdout = buf
+	// like bash, errexit is only kept with inherit_errexit
+	r2.opts[optErrExit] = r.opts[optErrExit] && r.opts[optInheritErrExit]
+	out := &limitWriter{buf: r.strBuilder(), limit: r.CmdSubstLimit}
+	r2.Stdout = out
+	var pw *os.File
+	var done chan struct{}
+	if r.runsPrograms(cs) {
+		// stream the output of programs through a pipe, which is
+		// closed once the limit is reached to stop them
+		var pr *os.File
+		var err error
+		if pr, pw, err = os.Pipe(); err == nil {
+			done = make(chan struct{})
+			go func() {
+				io.Copy(out, pr)
+				pr.Close()
+				close(done)
+			}()
+			r2.Stdout = pw
+		}
+	}
 	r2.stmts(cs.StmtList)
-	r.setErr(r2.err)
-	return strings.TrimRight(buf.String(), "\n")
+	if pw != nil {
+		pw.Close()
+		<-done
+	}
+	r.lastExpandExit = r2.exit
+	r.setSubErr(r2.err)
+	if out.truncated {
+		r.errf("command substitution: output truncated to %d bytes\n", out.limit)
+	}
+	return strings.TrimRight(out.buf.String(), "\n")
+}
+
+// limitWriter writes to a buffer until it holds limit bytes, if limit
+// is positive.
+type limitWriter struct {
+	buf       *bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 {
+		if room := w.limit - w.buf.Len(); len(p) > room {
+			w.buf.Write(p[:room])
+			w.truncated = true
+			return room, io.ErrClosedPipe
+		}
+	}
+	return w.buf.Write(p)
 }
 
 func (r *Runner) wordFields(wps []syntax.WordPart) [][]fieldPart {
@@ -364,7 +420,7 @@ func (r *Runner) wordFields(wps []syntax.WordPart) [][]fieldPart {
 			splitAdd(r.cmdSubst(x))
 		case *syntax.ArithmExp:
 			curField = append(curField, fieldPart{
-				val: strconv.Itoa(r.arithm(x.X)),
+				val: strconv.FormatInt(r.arithm(x.X), 10),
 			})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
@@ -377,6 +433,8 @@ func (r *Runner) wordFields(wps []syntax.WordPart) [][]fieldPart {
 	return fields
 }
 
+// expandUser performs tilde expansion on the start of a field, such as
+// "~", "~name", "~+" and "~-", or "~N" for the directory stack.
 func (r *Runner) expandUser(field string) string {
 	if len(field) == 0 || field[0] != '~' {
 		return field
@@ -387,22 +445,60 @@ func (r *Runner) expandUser(field string) string {
 		rest = name[i:]
 		name = name[:i]
 	}
-	if name == "" {
+	switch name {
+	case "":
 		return r.getVar("HOME") + rest
+	case "+":
+		if vr, ok := r.lookupVar("PWD"); ok {
+			return r.varStr(vr, 0) + rest
+		}
+		return field
+	case "-":
+		if vr, ok := r.lookupVar("OLDPWD"); ok {
+			return r.varStr(vr, 0) + rest
+		}
+		return field
+	}
+	if dir, ok := r.dirStackEntry(name); ok {
+		return dir + rest
 	}
-	u, err := user.Lookup(name)
+	u, err := r.LookupUser(r.ctx(), name)
 	if err != nil {
 		return field
 	}
 	return u.HomeDir + rest
 }
 
-func match(pattern, name string) bool {
+// dirStackEntry returns the directory stack entry referred to by "N",
+// "+N" or "-N", counting from the left or right of the output of dirs.
+func (r *Runner) dirStackEntry(s string) (string, bool) {
+	fromRight := strings.HasPrefix(s, "-")
+	if fromRight || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return "", false
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n >= len(r.dirStack) {
+		return "", false
+	}
+	if fromRight {
+		return r.dirStack[n], true
+	}
+	return r.dirStack[len(r.dirStack)-1-n], true
+}
+
+func match(pattern, name string, nocase bool) bool {
 	expr, err := syntax.TranslatePattern(pattern, true)
 	if err != nil {
 		return false
 	}
-	rx := regexp.MustCompile("^" + expr + "$")
+	expr = "^" + expr + "$"
+	if nocase {
+		expr = "(?i)" + expr
+	}
+	rx := regexp.MustCompile(expr)
 	return rx.MatchString(name)
 }
 
@@ -425,7 +521,7 @@ func hasGlob(path string) bool {
 
 var rxGlobStar = regexp.MustCompile(".*")
 
-func glob(pattern string, globStar bool) []string {
+func (r *Runner) glob(pattern string) []string {
 	parts := strings.Split(pattern, string(filepath.Separator))
 	matches := []string{"."}
 	if filepath.IsAbs(pattern) {
@@ -440,7 +536,7 @@ func glob(pattern string, globStar bool) []string {
 		parts = parts[1:]
 	}
 	for _, part := range parts {
-		if part == "**" && globStar {
+		if part == "**" && r.opts[optGlobStar] {
 			for i := range matches {
 				// "a/**" should match "a/ a/b a/b/c ..."; note
 				// how the zero-match case has a trailing
@@ -452,7 +548,7 @@ func glob(pattern string, globStar bool) []string {
 			for {
 				var newMatches []string
 				for _, dir := range latest {
-					newMatches = globDir(dir, rxGlobStar, newMatches)
+					newMatches = r.globDir(dir, rxGlobStar, false, newMatches)
 				}
 				if len(newMatches) == 0 {
 					// not another level of directories to
@@ -468,20 +564,27 @@ func glob(pattern string, globStar bool) []string {
 		if err != nil {
 			return nil
 		}
-		rx := regexp.MustCompile("^" + expr + "$")
+		expr = "^" + expr + "$"
+		if r.opts[optNoCaseGlob] {
+			expr = "(?i)" + expr
+		}
+		rx := regexp.MustCompile(expr)
+		// like in other shells, only patterns starting with a
+		// dot match hidden files, unless dotglob is set
+		dotted := strings.HasPrefix(part, ".")
 		var newMatches []string
 		for _, dir := range matches {
-			newMatches = globDir(dir, rx, newMatches)
+			newMatches = r.globDir(dir, rx, dotted, newMatches)
 		}
 		matches = newMatches
 	}
 	return matches
 }
 
-func globDir(dir string, rx *regexp.Regexp, matches []string) []string {
+func (r *Runner) globDir(dir string, rx *regexp.Regexp, dotted bool, matches []string) []string {
 	d, err := os.Open(dir)
 	if err != nil {
-		return nil
+		return matches
 	}
 	defer d.Close()
 
@@ -489,7 +592,7 @@ func globDir(dir string, rx *regexp.Regexp, matches []string) []string {
 	sort.Strings(names)
 
 	for _, name := range names {
-		if !strings.HasPrefix(rx.String(), `^\.`) && name[0] == '.' {
+		if !dotted && !r.opts[optDotGlob] && name[0] == '.' {
 			continue
 		}
 		if rx.MatchString(name) {
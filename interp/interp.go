@@ -8,13 +8,13 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math"
 	"os"
-	"os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"mvdan.cc/sh/syntax"
@@ -45,15 +45,37 @@ type Runner struct {
 	Exec ModuleExec
 	Open ModuleOpen
 
-	filename string // only if Node was a File
+	// LookupUser is used to find the home directories of users.
+	LookupUser ModuleLookupUser
+
+	// ExecReplace, if non-nil, is used instead of Exec by the exec
+	// builtin when it is given a program to run, as the program is
+	// meant to replace the shell. DefaultExecReplace implements
+	// this by replacing the current process.
+	//
+	// Subshells, including those of pipelines and command
+	// substitutions, always use Exec.
+	ExecReplace ModuleExec
+
+	filename string // current file; only if Node was a File, or if sourcing
+
+	// callStack holds the functions being called and the files being
+	// sourced, with the innermost call last.
+	callStack []Frame
 
 	// Separate maps, note that bash allows a name to be both a var
-	// and a func simultaneously
+	// and a func simultaneously. Vars holds the global variables
+	// when Run or Stmt return.
 	Vars  map[string]Variable
 	Funcs map[string]*syntax.Stmt
 
-	// like Vars, but local to a func i.e. "local foo=bar"
-	funcVars map[string]Variable
+	// vars holds the global variables while running, starting from
+	// Vars. It is shared with subshells via copy-on-write layers.
+	vars varStore
+
+	// like Vars, but local to each of the funcs being called i.e.
+	// "local foo=bar", with the innermost call last
+	scopes []funcScope
 
 	// like Vars, but local to a cmd i.e. "foo=bar prog args..."
 	cmdVars map[string]string
@@ -61,26 +83,67 @@ type Runner struct {
 	// >0 to break or continue out of N enclosing loops
 	breakEnclosing, contnEnclosing int
 
-	inLoop   bool
-	inFunc   bool
-	inSource bool
+	inLoop     bool
+	inFunc     bool
+	inSource   bool
+	inSubshell bool
 
 	err  error // current fatal error
 	exit int   // current (last) exit code
 
+	// lastExpandExit is the exit code of the last command
+	// substitution, used by commands consisting only of assignments.
+	lastExpandExit int
+
+	// noErrExit is set while running commands whose failure must not
+	// trigger errexit, such as if conditions and the non-final
+	// members of "&&" and "||" lists.
+	noErrExit bool
+
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
 
 	bgShells sync.WaitGroup
 
-	// Context can be used to cancel the interpreter before it finishes
+	// childTimes holds the CPU times of the executed programs. It is
+	// shared with subshells, so that timing a pipeline includes all
+	// of its programs.
+	childTimes *cpuTimes
+
+	// Context can be used to cancel the interpreter before it finishes.
+	//
+	// If it can be cancelled, the default exec module starts each
+	// program in its own process group, so that it can be stopped
+	// along with its descendants. Such programs are not in the
+	// terminal's foreground process group, so they cannot read from
+	// the terminal.
 	Context context.Context
 
 	opts [len(shellOptsTable) + len(bashOptsTable)]bool
 
 	dirStack []string
 
+	// envShared is set when Env is shared with a subshell, so it must
+	// be copied before being modified.
+	envShared bool
+
+	// hashTable remembers where the programs run by the shell were
+	// found in $PATH, which was hashPath at the time. Like Env, it is
+	// copied before being modified if hashShared is set.
+	hashTable  map[string]hashEntry
+	hashPath   string
+	hashShared bool
+
+	// umask is the file mode creation mask, used when creating files
+	// and passed on to executed programs. It starts as the process's.
+	umask os.FileMode
+
+	// rlimits holds the resource limits set via ulimit, to be applied
+	// to executed programs. The map is shared with subshells, so it
+	// must be copied before being modified.
+	rlimits map[byte]rlimit
+
 	optState getopts
 
 	ifsJoin string
@@ -103,6 +166,24 @@ type Runner struct {
 	// because Go doesn't currently support sending Interrupt on Windows.
 	KillTimeout time.Duration
 
+	// KillSignals, if not empty, replaces the default interrupt and
+	// kill signals sent to programs when the context is cancelled.
+	// Each signal is sent once its delay has passed since the
+	// previous one, until the program exits. KillTimeout is then
+	// ignored.
+	//
+	// The default exec module sends the signals to the program's
+	// entire process group. It starts each program in a new group
+	// whenever Context can be cancelled, so that programs lose the
+	// terminal's foreground; see Context.
+	KillSignals []KillSignal
+
+	// CmdSubstLimit, if positive, is the maximum number of bytes of
+	// output kept from a command substitution. Any further output is
+	// discarded, and the programs writing it are stopped via a
+	// broken pipe.
+	CmdSubstLimit int
+
 	fieldAlloc  [4]fieldPart
 	fieldsAlloc [4][]fieldPart
 	bufferAlloc bytes.Buffer
@@ -147,6 +228,7 @@ var shellOptsTable = [...]struct {
 	// that have no flag form
 	{"a", "allexport"},
 	{"e", "errexit"},
+	{"C", "noclobber"},
 	{"n", "noexec"},
 	{"f", "noglob"},
 	{"u", "nounset"},
@@ -155,7 +237,14 @@ var shellOptsTable = [...]struct {
 
 var bashOptsTable = [...]string{
 	// sorted alphabetically by name
+	"dotglob",
+	"failglob",
 	"globstar",
+	"inherit_errexit",
+	"lastpipe",
+	"nocaseglob",
+	"nocasematch",
+	"nullglob",
 }
 
 // To access the shell options arrays without a linear search when we
@@ -164,12 +253,20 @@ var bashOptsTable = [...]string{
 const (
 	optAllExport = iota
 	optErrExit
+	optNoClobber
 	optNoExec
 	optNoGlob
 	optNoUnset
 	optPipeFail
 
+	optDotGlob
+	optFailGlob
 	optGlobStar
+	optInheritErrExit
+	optLastPipe
+	optNoCaseGlob
+	optNoCaseMatch
+	optNullGlob
 )
 
 // Reset will set the unexported fields back to zero, fill any exported
@@ -182,16 +279,20 @@ const (
 func (r *Runner) Reset() error {
 	// reset the internal state
 	*r = Runner{
-		Env:         r.Env,
-		Dir:         r.Dir,
-		Params:      r.Params,
-		Context:     r.Context,
-		Stdin:       r.Stdin,
-		Stdout:      r.Stdout,
-		Stderr:      r.Stderr,
-		Exec:        r.Exec,
-		Open:        r.Open,
-		KillTimeout: r.KillTimeout,
+		Env:           r.Env,
+		Dir:           r.Dir,
+		Params:        r.Params,
+		Context:       r.Context,
+		Stdin:         r.Stdin,
+		Stdout:        r.Stdout,
+		Stderr:        r.Stderr,
+		Exec:          r.Exec,
+		ExecReplace:   r.ExecReplace,
+		Open:          r.Open,
+		LookupUser:    r.LookupUser,
+		KillTimeout:   r.KillTimeout,
+		KillSignals:   r.KillSignals,
+		CmdSubstLimit: r.CmdSubstLimit,
 
 		// emptied below, to reuse the space
 		Vars:     r.Vars,
@@ -205,6 +306,7 @@ func (r *Runner) Reset() error {
 			delete(r.Vars, k)
 		}
 	}
+	r.vars = varStore{top: r.Vars}
 	if r.cmdVars == nil {
 		r.cmdVars = make(map[string]string)
 	} else {
@@ -218,9 +320,13 @@ func (r *Runner) Reset() error {
 	if r.Env == nil {
 		r.Env, _ = EnvFromList(os.Environ())
 	}
+	if r.LookupUser == nil {
+		r.LookupUser = DefaultLookupUser
+	}
 	if _, ok := r.Env.Get("HOME"); !ok {
-		u, _ := user.Current()
-		r.Vars["HOME"] = Variable{Value: StringVal(u.HomeDir)}
+		if u, err := r.LookupUser(r.ctx(), ""); err == nil {
+			r.Vars["HOME"] = Variable{Value: StringVal(u.HomeDir)}
+		}
 	}
 	if r.Dir == "" {
 		dir, err := os.Getwd()
@@ -264,6 +370,8 @@ func (r *Runner) Reset() error {
 	if r.KillTimeout == 0 {
 		r.KillTimeout = 2 * time.Second
 	}
+	r.childTimes = &cpuTimes{}
+	r.umask = processUmask()
 	return nil
 }
 
@@ -276,13 +384,27 @@ func (r *Runner) ctx() Ctxt {
 		Stdout:      r.Stdout,
 		Stderr:      r.Stderr,
 		KillTimeout: r.KillTimeout,
+		KillSignals: r.KillSignals,
+		Umask:       r.umask,
+		childTimes:  r.childTimes,
+		rlimits:     r.rlimits,
 	}
 	c.Env = r.Env.Copy()
-	for name, vr := range r.Vars {
-		if !vr.Exported {
-			continue
+	r.vars.each(func(name string, vr Variable) {
+		if vr.Exported && vr.Value != nil {
+			c.Env.Set(name, r.varStr(vr, 0))
 		}
-		c.Env.Set(name, r.varStr(vr, 0))
+	})
+	for _, sc := range r.scopes {
+		sc.vars.each(func(name string, vr Variable) {
+			// local vars shadow the outer ones, even if they
+			// aren't exported
+			if vr.Exported && vr.Value != nil {
+				c.Env.Set(name, r.varStr(vr, 0))
+			} else {
+				c.Env.Delete(name)
+			}
+		})
 	}
 	for name, val := range r.cmdVars {
 		c.Env.Set(name, val)
@@ -306,6 +428,17 @@ func (r *Runner) lastExit() {
 	}
 }
 
+// setSubErr is like setErr, but for the error that stopped a subshell.
+// Exiting or returning from a subshell only stops the subshell itself,
+// so those errors are not propagated.
+func (r *Runner) setSubErr(err error) {
+	switch err.(type) {
+	case nil, ExitCode, returnCode:
+	default:
+		r.setErr(err)
+	}
+}
+
 // FromArgs populates the shell options and returns the remaining
 // arguments. For example, running FromArgs("-e", "--", "foo") will set
 // the "-e" option and return []string{"foo"}.
@@ -333,11 +466,7 @@ func (r *Runner) FromArgs(args ...string) ([]string, error) {
 			}
 			if len(args) == 0 && !enable {
 				for i, opt := range &shellOptsTable {
-					setFlag := "+o"
-					if r.opts[i] {
-						setFlag = "-o"
-					}
-					r.outf("set %s %s\n", setFlag, opt.name)
+					r.printSetOptLine(opt.name, r.opts[i])
 				}
 				break
 			}
@@ -357,6 +486,9 @@ func (r *Runner) FromArgs(args ...string) ([]string, error) {
 // Run starts the interpreter and returns any error.
 func (r *Runner) Run(node syntax.Node) error {
 	r.filename = ""
+	r.callStack = r.callStack[:0]
+	r.vars = varStore{top: r.Vars}
+	defer r.syncVars()
 	switch x := node.(type) {
 	case *syntax.File:
 		r.filename = x.Name
@@ -376,16 +508,42 @@ func (r *Runner) Run(node syntax.Node) error {
 }
 
 func (r *Runner) Stmt(stmt *syntax.Stmt) error {
+	r.vars = varStore{top: r.Vars}
+	defer r.syncVars()
 	r.stmt(stmt)
 	return r.err
 }
 
+// syncVars makes Vars hold the global variables once again.
+func (r *Runner) syncVars() {
+	r.Vars = r.vars.flatten()
+	r.vars = varStore{top: r.Vars}
+}
+
 func (r *Runner) out(s string) {
-	io.WriteString(r.Stdout, s)
+	_, err := io.WriteString(r.Stdout, s)
+	r.checkWrite(err)
 }
 
 func (r *Runner) outf(format string, a ...interface{}) {
-	fmt.Fprintf(r.Stdout, format, a...)
+	_, err := fmt.Fprintf(r.Stdout, format, a...)
+	r.checkWrite(err)
+}
+
+// exitSigpipe is the exit status of a program killed by SIGPIPE, which
+// package syscall lacks on some platforms.
+const exitSigpipe = ExitCode(128 + 13)
+
+// checkWrite stops the shell with status 141 if a write failed because
+// its output is no longer being read, like SIGPIPE does with programs.
+func (r *Runner) checkWrite(err error) {
+	if err == io.ErrClosedPipe {
+		r.setErr(exitSigpipe)
+		return
+	}
+	if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.EPIPE {
+		r.setErr(exitSigpipe)
+	}
 }
 
 func (r *Runner) errf(format string, a ...interface{}) {
@@ -434,15 +592,20 @@ func (r *Runner) stmtSync(st *syntax.Stmt) {
 			defer cls.Close()
 		}
 	}
+	oldNoErrExit := r.noErrExit
+	if st.Negated {
+		r.noErrExit = true
+	}
 	if st.Cmd == nil {
 		r.exit = 0
 	} else {
 		r.cmd(st.Cmd)
 	}
+	r.noErrExit = oldNoErrExit
 	if st.Negated {
 		r.exit = oneIf(r.exit == 0)
-	}
-	if r.exit != 0 && r.opts[optErrExit] {
+	} else if r.exit != 0 && !r.noErrExit && r.opts[optErrExit] &&
+		!errExitExempt(st.Cmd) {
 		r.lastExit()
 	}
 	if !r.keepRedirs {
@@ -450,24 +613,88 @@ func (r *Runner) stmtSync(st *syntax.Stmt) {
 	}
 }
 
+// errExitExempt reports whether a command failing must not trigger
+// errexit. Compound commands other than subshells can only fail
+// without having stopped the shell if the failure happened where
+// errexit was ignored, such as in "{ false && true; }".
+func errExitExempt(cm syntax.Command) bool {
+	switch x := cm.(type) {
+	case *syntax.Block, *syntax.IfClause, *syntax.WhileClause,
+		*syntax.ForClause, *syntax.CaseClause, *syntax.TimeClause:
+		return true
+	case *syntax.BinaryCmd:
+		return x.Op == syntax.AndStmt || x.Op == syntax.OrStmt
+	}
+	return false
+}
+
 func (r *Runner) sub() *Runner {
 	r2 := *r
 	r2.bgShells = sync.WaitGroup{}
 	r2.bufferAlloc = bytes.Buffer{}
-	// TODO: perhaps we could do a lazy copy here, or some sort of
-	// overlay to avoid copying all the time
-	r2.Env = r.Env.Copy()
-	r2.Vars = make(map[string]Variable, len(r.Vars))
-	for k, v := range r.Vars {
-		r2.Vars[k] = v
+	r2.inSubshell = true
+	// make appending to the call stack not modify the parent's
+	r2.callStack = r.callStack[:len(r.callStack):len(r.callStack)]
+	// variables are rarely modified by subshells, so share them
+	// instead of copying them
+	r.envShared, r2.envShared = true, true
+	r.hashShared, r2.hashShared = true, true
+	r2.vars = r.vars.fork()
+	r2.cmdVars = nil
+	if len(r.cmdVars) > 0 {
+		r2.cmdVars = make(map[string]string, len(r.cmdVars))
+		for k, v := range r.cmdVars {
+			r2.cmdVars[k] = v
+		}
 	}
-	r2.cmdVars = make(map[string]string, len(r.cmdVars))
-	for k, v := range r.cmdVars {
-		r2.cmdVars[k] = v
+	if len(r.scopes) > 0 {
+		r2.scopes = make([]funcScope, len(r.scopes))
+		for i := range r.scopes {
+			sc := &r.scopes[i]
+			r2.scopes[i] = funcScope{vars: sc.vars.fork(), opts: sc.opts}
+		}
 	}
 	return &r2
 }
 
+// pipe returns the pipe to connect two commands with. A real pipe is
+// used if either command may run a program, so that the program can
+// use it directly instead of having its input or output copied.
+func (r *Runner) pipe(x, y syntax.Node) (io.ReadCloser, io.WriteCloser) {
+	if r.runsPrograms(x) || r.runsPrograms(y) {
+		if pr, pw, err := os.Pipe(); err == nil {
+			return pr, pw
+		}
+	}
+	return io.Pipe()
+}
+
+// runsPrograms reports whether running a node may execute programs,
+// as opposed to only builtins. It errs on the side of true.
+func (r *Runner) runsPrograms(node syntax.Node) bool {
+	found := false
+	syntax.Walk(node, func(node syntax.Node) bool {
+		call, ok := node.(*syntax.CallExpr)
+		if found || !ok || len(call.Args) == 0 {
+			return !found
+		}
+		name := ""
+		if parts := call.Args[0].Parts; len(parts) == 1 {
+			if lit, ok := parts[0].(*syntax.Lit); ok {
+				name = lit.Value
+			}
+		}
+		switch name {
+		case "exec", "eval", "command", "builtin", "source", ".":
+			found = true
+		default:
+			found = !isBuiltin(name) || r.Funcs[name] != nil
+		}
+		return !found
+	})
+	return found
+}
+
 func (r *Runner) cmd(cm syntax.Command) {
 	if r.stop() {
 		return
@@ -479,8 +706,9 @@ func (r *Runner) cmd(cm syntax.Command) {
 		r2 := r.sub()
 		r2.stmts(x.StmtList)
 		r.exit = r2.exit
-		r.setErr(r2.err)
+		r.setSubErr(r2.err)
 	case *syntax.CallExpr:
+		r.lastExpandExit = 0
 		fields := r.Fields(x.Args...)
 		if len(fields) == 0 {
 			for _, as := range x.Assigns {
@@ -488,11 +716,16 @@ func (r *Runner) cmd(cm syntax.Command) {
 				vr.Value = r.assignVal(as, "")
 				r.setVar(as.Name.Value, as.Index, vr)
 			}
+			// "foo=$(false)" fails, and with it errexit
+			r.exit = r.lastExpandExit
 			break
 		}
 		for _, as := range x.Assigns {
 			val := r.assignVal(as, "")
 			// we know that inline vars must be strings
+			if r.cmdVars == nil {
+				r.cmdVars = make(map[string]string)
+			}
 			r.cmdVars[as.Name.Value] = string(val.(StringVal))
 			if as.Name.Value == "IFS" {
 				r.ifsUpdated()
@@ -508,18 +741,18 @@ func (r *Runner) cmd(cm syntax.Command) {
 		}
 	case *syntax.BinaryCmd:
 		switch x.Op {
-		case syntax.AndStmt:
-			r.stmt(x.X)
-			if r.exit == 0 {
-				r.stmt(x.Y)
-			}
-		case syntax.OrStmt:
+		case syntax.AndStmt, syntax.OrStmt:
+			// only the last command in the list may trigger
+			// errexit
+			oldNoErrExit := r.noErrExit
+			r.noErrExit = true
 			r.stmt(x.X)
-			if r.exit != 0 {
+			r.noErrExit = oldNoErrExit
+			if (r.exit == 0) == (x.Op == syntax.AndStmt) {
 				r.stmt(x.Y)
 			}
 		case syntax.Pipe, syntax.PipeAll:
-			pr, pw := io.Pipe()
+			pr, pw := r.pipe(x.X, x.Y)
 			r2 := r.sub()
 			r2.Stdout = pw
 			if x.Op == syntax.PipeAll {
@@ -527,7 +760,6 @@ func (r *Runner) cmd(cm syntax.Command) {
 			} else {
 				r2.Stderr = r.Stderr
 			}
-			r.Stdin = pr
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go func() {
@@ -535,16 +767,27 @@ func (r *Runner) cmd(cm syntax.Command) {
 				pw.Close()
 				wg.Done()
 			}()
-			r.stmt(x.Y)
+			// with lastpipe, the last command in the pipeline
+			// runs in the current shell
+			if r.opts[optLastPipe] {
+				r.Stdin = pr
+				r.stmt(x.Y)
+			} else {
+				r3 := r.sub()
+				r3.Stdin = pr
+				r3.stmt(x.Y)
+				r.exit = r3.exit
+				r.setSubErr(r3.err)
+			}
 			pr.Close()
 			wg.Wait()
 			if r.opts[optPipeFail] && r2.exit > 0 && r.exit == 0 {
 				r.exit = r2.exit
 			}
-			r.setErr(r2.err)
+			r.setSubErr(r2.err)
 		}
 	case *syntax.IfClause:
-		r.stmts(x.Cond)
+		r.condStmts(x.Cond)
 		if r.exit == 0 {
 			r.stmts(x.Then)
 			break
@@ -553,7 +796,7 @@ func (r *Runner) cmd(cm syntax.Command) {
 		r.stmts(x.Else)
 	case *syntax.WhileClause:
 		for !r.stop() {
-			r.stmts(x.Cond)
+			r.condStmts(x.Cond)
 			stop := (r.exit == 0) == x.Until
 			r.exit = 0
 			if stop || r.loopStmtsBroken(x.Do) {
@@ -561,6 +804,7 @@ func (r *Runner) cmd(cm syntax.Command) {
 			}
 		}
 	case *syntax.ForClause:
+		r.exit = 0
 		switch y := x.Loop.(type) {
 		case *syntax.WordIter:
 			name := y.Name.Value
@@ -571,33 +815,62 @@ func (r *Runner) cmd(cm syntax.Command) {
 				}
 			}
 		case *syntax.CStyleLoop:
-			r.arithm(y.Init)
-			for r.arithm(y.Cond) != 0 {
+			if y.Init != nil {
+				if _, ok := r.arithmCmd(y.Init); !ok {
+					break
+				}
+			}
+			for !r.stop() {
+				if y.Cond != nil {
+					cond, ok := r.arithmCmd(y.Cond)
+					if !ok || cond == 0 {
+						break
+					}
+				}
 				if r.loopStmtsBroken(x.Do) {
 					break
 				}
-				r.arithm(y.Post)
+				if y.Post != nil {
+					if _, ok := r.arithmCmd(y.Post); !ok {
+						break
+					}
+				}
 			}
 		}
 	case *syntax.FuncDecl:
 		r.setFunc(x.Name.Value, x.Body)
+		r.exit = 0
 	case *syntax.ArithmCmd:
-		r.exit = oneIf(r.arithm(x.X) == 0)
+		if val, ok := r.arithmCmd(x.X); ok {
+			r.exit = oneIf(val == 0)
+		}
 	case *syntax.LetClause:
-		var val int
+		var val int64
 		for _, expr := range x.Exprs {
-			val = r.arithm(expr)
+			var ok bool
+			if val, ok = r.arithmCmd(expr); !ok {
+				return
+			}
 		}
 		r.exit = oneIf(val == 0)
 	case *syntax.CaseClause:
+		r.exit = 0
 		str := r.loneWord(x.Word)
+		// set by ";&" to run the next body without matching
+		fall := false
 		for _, ci := range x.Items {
-			for _, word := range ci.Patterns {
-				pat := r.lonePattern(word)
-				if match(pat, str) {
-					r.stmts(ci.StmtList)
-					return
-				}
+			if !fall && !r.caseMatch(ci, str) {
+				continue
+			}
+			r.stmts(ci.StmtList)
+			switch ci.Op {
+			case syntax.Fallthrough:
+				fall = true
+			case syntax.Resume, syntax.ResumeKorn:
+				// keep testing the following patterns
+				fall = false
+			default:
+				return
 			}
 		}
 	case *syntax.TestClause:
@@ -608,7 +881,8 @@ func (r *Runner) cmd(cm syntax.Command) {
 			r.exit = 1
 		}
 	case *syntax.DeclClause:
-		local := false
+		r.exit = 0
+		local, global := false, false
 		var modes []string
 		valType := ""
 		switch x.Variant.Value {
@@ -638,6 +912,14 @@ func (r *Runner) cmd(cm syntax.Command) {
 				valType = s
 			case "-g":
 				local = false
+				global = true
+			case "-":
+				if x.Variant.Value != "local" {
+					r.errf("declare: invalid option %q\n", s)
+					r.exit = 2
+					return
+				}
+				r.saveLocalOpts()
 			default:
 				r.errf("declare: invalid option %q\n", s)
 				r.exit = 2
@@ -647,9 +929,30 @@ func (r *Runner) cmd(cm syntax.Command) {
 		for _, as := range x.Assigns {
 			for _, as := range r.expandAssigns(as) {
 				name := as.Name.Value
-				vr, _ := r.lookupVar(as.Name.Value)
-				vr.Value = r.assignVal(as, valType)
-				vr.Local = local
+				scope := scopeVisible
+				switch {
+				case local:
+					scope = scopeLocal
+				case global:
+					scope = scopeGlobal
+				}
+				vr, ok := r.lookupVarScope(name, scope)
+				if local && !vr.Local {
+					// a new local var; the export
+					// attribute is kept, as the var
+					// would shadow an exported one
+					visible, _ := r.lookupVar(name)
+					vr = Variable{Exported: visible.Exported}
+				}
+				if as.Naked {
+					// don't use the value of the
+					// visible var, like assignVal would
+					if !ok {
+						vr.Value = nil
+					}
+				} else {
+					vr.Value = r.assignVal(as, valType)
+				}
 				for _, mode := range modes {
 					switch mode {
 					case "-x":
@@ -660,37 +963,142 @@ func (r *Runner) cmd(cm syntax.Command) {
 						vr.NameRef = true
 					}
 				}
-				r.setVar(name, as.Index, vr)
+				r.setVarScope(name, as.Index, vr, scope)
 			}
 		}
 	case *syntax.TimeClause:
 		start := time.Now()
+		user, sys := r.cpuTimes()
 		if x.Stmt != nil {
 			r.stmt(x.Stmt)
 		}
-		format := "%s\t%s\n"
-		if x.PosixFormat {
-			format = "%s %s\n"
-		} else {
-			r.outf("\n")
-		}
 		real := time.Since(start)
-		r.outf(format, "real", elapsedString(real, x.PosixFormat))
-		// TODO: can we do these?
-		r.outf(format, "user", elapsedString(0, x.PosixFormat))
-		r.outf(format, "sys", elapsedString(0, x.PosixFormat))
+		user2, sys2 := r.cpuTimes()
+		r.printTimes(x.PosixFormat, real, user2-user, sys2-sys)
+	case *syntax.BadCmd:
+		r.errf("%s: cannot run a command with syntax errors\n", x.Pos())
+		r.exit = 2
 	default:
 		panic(fmt.Sprintf("unhandled command node: %T", x))
 	}
 }
 
-func elapsedString(d time.Duration, posix bool) string {
+func (r *Runner) caseMatch(ci *syntax.CaseItem, str string) bool {
+	for _, word := range ci.Patterns {
+		pat := r.lonePattern(word)
+		if match(pat, str, r.opts[optNoCaseMatch]) {
+			return true
+		}
+	}
+	return false
+}
+
+// cpuTimes returns the user and system CPU time used so far by the
+// interpreter and the programs it executed.
+func (r *Runner) cpuTimes() (user, sys time.Duration) {
+	user, sys = processTimes()
+	childUser, childSys := r.childTimes.get()
+	return user + childUser, sys + childSys
+}
+
+// defaultTimeFormat is used when $TIMEFORMAT is unset, just like bash.
+const defaultTimeFormat = "\nreal\t%3lR\nuser\t%3lU\nsys\t%3lS"
+
+func (r *Runner) printTimes(posix bool, real, user, sys time.Duration) {
 	if posix {
-		return fmt.Sprintf("%.2f", d.Seconds())
+		r.errf("real %s\nuser %s\nsys %s\n",
+			elapsedString(real, true),
+			elapsedString(user, true),
+			elapsedString(sys, true))
+		return
+	}
+	format := defaultTimeFormat
+	if vr, ok := r.lookupVar("TIMEFORMAT"); ok {
+		format = r.varStr(vr, 0)
+	}
+	if format == "" {
+		return // an empty format disables the output
+	}
+	s, err := formatTimes(format, real, user, sys)
+	if err != nil {
+		r.errf("TIMEFORMAT: %v\n", err)
+		return
+	}
+	r.errf("%s\n", s)
+}
+
+// formatTimes expands the directives in a $TIMEFORMAT string. %R, %U
+// and %S are replaced by the real, user and system times respectively.
+// An optional precision digit and an "l" for the long MmSS.FFs format
+// may precede them, such as in %3lR. %P is the CPU percentage, and %%
+// is a literal percent sign.
+func formatTimes(format string, real, user, sys time.Duration) (string, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch format[i] {
+		case '%':
+			buf.WriteByte('%')
+			continue
+		case 'P':
+			percent := 0.0
+			if real > 0 {
+				percent = float64(user+sys) / float64(real) * 100
+			}
+			fmt.Fprintf(&buf, "%.2f", percent)
+			continue
+		}
+		prec, long := 3, false
+		if c := format[i]; '0' <= c && c <= '9' {
+			if prec = int(c - '0'); prec > 3 {
+				prec = 3
+			}
+			i++
+		}
+		if i < len(format) && format[i] == 'l' {
+			long = true
+			i++
+		}
+		if i == len(format) {
+			return "", fmt.Errorf("missing format character")
+		}
+		var d time.Duration
+		switch format[i] {
+		case 'R':
+			d = real
+		case 'U':
+			d = user
+		case 'S':
+			d = sys
+		default:
+			return "", fmt.Errorf("`%c': invalid format character", format[i])
+		}
+		buf.WriteString(timeString(d, prec, long))
+	}
+	return buf.String(), nil
+}
+
+// timeString formats a duration in seconds with prec decimal digits. If
+// long is true, the minutes are separated, like in "1m2.500s".
+func timeString(d time.Duration, prec int, long bool) string {
+	if !long {
+		return strconv.FormatFloat(d.Seconds(), 'f', prec, 64)
 	}
 	min := int(d.Minutes())
-	sec := math.Remainder(d.Seconds(), 60.0)
-	return fmt.Sprintf("%dm%.3fs", min, sec)
+	sec := d.Seconds() - float64(min)*60
+	return fmt.Sprintf("%dm%.*fs", min, prec, sec)
+}
+
+func elapsedString(d time.Duration, posix bool) string {
+	if posix {
+		return timeString(d, 2, false)
+	}
+	return timeString(d, 3, true)
 }
 
 func (r *Runner) stmts(sl syntax.StmtList) {
@@ -699,6 +1107,15 @@ func (r *Runner) stmts(sl syntax.StmtList) {
 	}
 }
 
+// condStmts runs the statements of a condition, such as in if and while
+// clauses, where failures never trigger errexit.
+func (r *Runner) condStmts(sl syntax.StmtList) {
+	oldNoErrExit := r.noErrExit
+	r.noErrExit = true
+	r.stmts(sl)
+	r.noErrExit = oldNoErrExit
+}
+
 func (r *Runner) redir(rd *syntax.Redirect) (io.Closer, error) {
 	if rd.Hdoc != nil {
 		hdoc := r.loneWord(rd.Hdoc)
@@ -726,28 +1143,45 @@ func (r *Runner) redir(rd *syntax.Redirect) (io.Closer, error) {
 			*orig = r.Stderr
 		}
 		return nil, nil
-	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut,
+	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut, syntax.ClbOut,
 		syntax.RdrAll, syntax.AppAll:
 		// done further below
 	// case syntax.DplIn:
 	default:
 		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
 	}
+	path := r.relPath(arg)
 	mode := os.O_RDONLY
 	switch rd.Op {
 	case syntax.AppOut, syntax.AppAll:
 		mode = os.O_RDWR | os.O_CREATE | os.O_APPEND
 	case syntax.RdrOut, syntax.RdrAll:
 		mode = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		if !r.opts[optNoClobber] {
+			break
+		}
+		// noclobber only protects existing regular files, so
+		// that redirecting to e.g. /dev/null still works
+		info, err := r.stat(path)
+		switch {
+		case err != nil:
+			mode |= os.O_EXCL
+		case info.Mode().IsRegular():
+			err := fmt.Errorf("%s: cannot overwrite existing file", arg)
+			r.errf("%v\n", err)
+			return nil, err
+		}
+	case syntax.ClbOut:
+		mode = os.O_RDWR | os.O_CREATE | os.O_TRUNC
 	}
-	f, err := r.open(r.relPath(arg), mode, 0644, true)
+	f, err := r.open(path, mode, 0666&^r.umask, true)
 	if err != nil {
 		return nil, err
 	}
 	switch rd.Op {
 	case syntax.RdrIn:
 		r.Stdin = f
-	case syntax.RdrOut, syntax.AppOut:
+	case syntax.RdrOut, syntax.AppOut, syntax.ClbOut:
 		*orig = f
 	case syntax.RdrAll, syntax.AppAll:
 		r.Stdout = f
@@ -780,6 +1214,50 @@ type returnCode uint8
 
 func (returnCode) Error() string { return "returned" }
 
+// Frame is an entry in the call stack of a Runner, which is either a
+// function call or a sourced file.
+type Frame struct {
+	// Func is the name of the called function, or "source" if the
+	// frame is a sourced file.
+	Func string
+
+	// Pos is the position of the call, and File is the name of the
+	// file being run when it happened. That is either the name of the
+	// syntax.File given to Run, or the path given to source.
+	Pos  syntax.Pos
+	File string
+
+	// Source is the path of the sourced file, if Func is "source".
+	Source string
+}
+
+// CallStack returns the function calls and sourced files that are
+// currently being run, with the innermost one first.
+//
+// If Run stops due to an error, such as a call to exit or a failed
+// command with the errexit option, the call stack from the moment of
+// the error is kept until Run is called again.
+func (r *Runner) CallStack() []Frame {
+	stack := make([]Frame, len(r.callStack))
+	for i, fr := range r.callStack {
+		stack[len(stack)-1-i] = fr
+	}
+	return stack
+}
+
+func (r *Runner) pushFrame(fr Frame) {
+	r.callStack = append(r.callStack, fr)
+}
+
+// popFrame removes the innermost frame, unless the interpreter is
+// stopping due to an error, so that its call stack may be inspected.
+func (r *Runner) popFrame() {
+	switch r.err.(type) {
+	case nil, returnCode:
+		r.callStack = r.callStack[:len(r.callStack)-1]
+	}
+}
+
 func (r *Runner) call(pos syntax.Pos, args []string) {
 	if r.stop() {
 		return
@@ -790,14 +1268,15 @@ func (r *Runner) call(pos syntax.Pos, args []string) {
 		oldParams := r.Params
 		r.Params = args[1:]
 		oldInFunc := r.inFunc
-		oldFuncVars := r.funcVars
-		r.funcVars = nil
+		r.pushScope()
 		r.inFunc = true
+		r.pushFrame(Frame{Func: name, Pos: pos, File: r.filename})
 
 		r.stmt(body)
 
+		r.popFrame()
 		r.Params = oldParams
-		r.funcVars = oldFuncVars
+		r.popScope()
 		r.inFunc = oldInFunc
 		if code, ok := r.err.(returnCode); ok {
 			r.err = nil
@@ -807,14 +1286,23 @@ func (r *Runner) call(pos syntax.Pos, args []string) {
 	}
 	if isBuiltin(name) {
 		r.exit = r.builtinCode(pos, name, args[1:])
+		if code, ok := r.err.(ExitCode); ok {
+			// the builtin stopped the shell, e.g. via a
+			// broken pipe
+			r.exit = int(code)
+		}
 		return
 	}
 	r.exec(args)
 }
 
 func (r *Runner) exec(args []string) {
+	r.execModule(r.Exec, args)
+}
+
+func (r *Runner) execModule(mod ModuleExec, args []string) {
 	path := r.lookPath(args[0])
-	err := r.Exec(r.ctx(), path, args)
+	err := mod(r.ctx(), path, args)
 	switch x := err.(type) {
 	case nil:
 		r.exit = 0
@@ -914,18 +1402,98 @@ func splitList(path string) []string {
 	return fixed
 }
 
+// hashEntry is a program remembered in the hash table, along with the
+// number of times it has been run.
+type hashEntry struct {
+	path string
+	hits int
+}
+
+// lookPath finds the program to run for a command. Programs found in
+// $PATH are remembered in the hash table, so that they don't need to be
+// searched for again.
 func (r *Runner) lookPath(file string) string {
-	pathList := splitList(r.getVar("PATH"))
+	r.checkHashPath()
+	e, ok := r.hashTable[file]
+	if !ok || r.checkStat(e.path) == "" {
+		path := r.hashCommand(file)
+		if e, ok = r.hashTable[file]; !ok {
+			return path
+		}
+	}
+	e.hits++
+	r.writableHashTable()[file] = e
+	return e.path
+}
+
+// writableHashTable returns the hash table, ready to be modified.
+func (r *Runner) writableHashTable() map[string]hashEntry {
+	if r.hashTable == nil || r.hashShared {
+		table := make(map[string]hashEntry, len(r.hashTable)+1)
+		for k, v := range r.hashTable {
+			table[k] = v
+		}
+		r.hashTable = table
+		r.hashShared = false
+	}
+	return r.hashTable
+}
+
+// checkHashPath empties the hash table if $PATH changed since the
+// programs in it were found.
+func (r *Runner) checkHashPath() {
+	if path := r.getVar("PATH"); path != r.hashPath {
+		r.hashTable = nil
+		r.hashPath = path
+	}
+}
+
+// hashCommand searches $PATH for a command and adds it to the hash
+// table, if found. Relative paths are not remembered, as they depend
+// on the current directory.
+func (r *Runner) hashCommand(file string) string {
+	if _, ok := r.hashTable[file]; ok {
+		delete(r.writableHashTable(), file)
+	}
+	paths := r.pathMatches(file, false)
+	if len(paths) == 0 {
+		return ""
+	}
+	path := paths[0]
+	if !r.isPathCommand(file) || !filepath.IsAbs(path) {
+		return path
+	}
+	r.writableHashTable()[file] = hashEntry{path: path}
+	return path
+}
+
+// isPathCommand reports whether a command name is to be searched for in
+// $PATH, as opposed to being a path itself.
+func (r *Runner) isPathCommand(file string) bool {
 	chars := `/`
 	if runtime.GOOS == "windows" {
 		chars = `:\/`
+	}
+	return !strings.ContainsAny(file, chars)
+}
+
+// pathMatches returns the programs that a command may run, in the
+// order in which they are found in $PATH. If all is false, only the
+// first one is returned.
+func (r *Runner) pathMatches(file string, all bool) []string {
+	pathList := splitList(r.getVar("PATH"))
+	if runtime.GOOS == "windows" {
 		// so that "foo" always tries "./foo"
 		pathList = append([]string{"."}, pathList...)
 	}
 	exts := r.pathExts()
-	if strings.ContainsAny(file, chars) {
-		return r.findExecutable(file, exts)
+	if !r.isPathCommand(file) {
+		if f := r.findExecutable(file, exts); f != "" {
+			return []string{f}
+		}
+		return nil
 	}
+	var matches []string
 	for _, dir := range pathList {
 		var path string
 		switch dir {
@@ -936,10 +1504,13 @@ func (r *Runner) lookPath(file string) string {
 			path = filepath.Join(dir, file)
 		}
 		if f := r.findExecutable(path, exts); f != "" {
-			return f
+			matches = append(matches, f)
+			if !all {
+				break
+			}
 		}
 	}
-	return ""
+	return matches
 }
 
 func (r *Runner) pathExts() []string {
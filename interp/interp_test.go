@@ -53,6 +53,43 @@ let i=(2 + 3)
 	}
 }
 
+func BenchmarkRunSubshells(b *testing.B) {
+	// many vars and a large array, which subshells inherit
+	setup := `
+for ((i = 0; i < 200; i++)); do
+	declare v$i=$i
+	arr[i]=$i
+done
+`
+	benchmarks := []struct {
+		name, src string
+	}{
+		{"CmdSubst", "for ((i = 0; i < 100; i++)); do x=$(echo $i); done"},
+		{"Subshell", "for ((i = 0; i < 100; i++)); do (x=$i); done"},
+		{"Pipeline", "for ((i = 0; i < 100; i++)); do echo $i | { read x; }; done"},
+		{"Func", "f() { local y=$(echo $1); }; for ((i = 0; i < 100; i++)); do f $i; done"},
+	}
+	for _, bc := range benchmarks {
+		b.Run(bc.name, func(b *testing.B) {
+			file, err := syntax.NewParser().Parse(strings.NewReader(setup+bc.src), "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			r := Runner{
+				Stdout: ioutil.Discard,
+				Stderr: ioutil.Discard,
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset()
+				if err := r.Run(file); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 var hasBash44 bool
 
 func TestMain(m *testing.M) {
@@ -105,7 +142,7 @@ var fileCases = []struct {
 	{"printf", "usage: printf format [arguments]\nexit status 2 #JUSTERR"},
 	{"break", "break is only useful in a loop #JUSTERR"},
 	{"continue", "continue is only useful in a loop #JUSTERR"},
-	{"cd a b", "usage: cd [dir]\nexit status 2 #JUSTERR"},
+	{"cd a b", "usage: cd [-L|-P] [dir]\nexit status 2 #JUSTERR"},
 	{"shift a", "usage: shift [n]\nexit status 2 #JUSTERR"},
 	{
 		"shouldnotexist",
@@ -516,6 +553,26 @@ var fileCases = []struct {
 		"(echo() { printf 'bar\n'; }; echo); echo",
 		"bar\n\n",
 	},
+	{
+		"a=1; (unset a; echo ${a-unset}); echo $a",
+		"unset\n1\n",
+	},
+	{
+		"a=1; (a=2; (unset a; b=3; echo ${a-unset} $b); echo $a ${b-unset}); echo $a",
+		"unset 3\n2 unset\n1\n",
+	},
+	{
+		"a=0; (a=1; (a=2; (a=3; (a=4; (a=5; (a=6; (a=7; (a=8; (a=9; (a=10; (unset a; echo ${a-unset}); echo $a); echo $a); echo $a); echo $a); echo $a); echo $a); echo $a); echo $a); echo $a); echo $a); echo $a",
+		"unset\n10\n9\n8\n7\n6\n5\n4\n3\n2\n1\n0\n",
+	},
+	{
+		"a=1; f() { local a=2; (unset a; echo $a); echo $a; }; f; echo $a",
+		"\n2\n1\n",
+	},
+	{
+		"a=1; (a=2; echo $a) & a=3; wait; echo $a",
+		"2\n3\n",
+	},
 	{
 		"unset INTERP_GLOBAL & echo $INTERP_GLOBAL",
 		"value\n",
@@ -594,6 +651,54 @@ var fileCases = []struct {
 		`mkdir a; ln -s a b; [[ $(cd a && pwd) == "$(cd b && pwd)" ]]; echo $?`,
 		"1\n",
 	},
+	{
+		`mkdir a; ln -s a b; cd b; [[ $PWD == */b ]] && [[ $(pwd -L) == */b ]] && [[ $(pwd -P) == */a ]]`,
+		"",
+	},
+	{
+		`mkdir a; ln -s a b; cd -P b; [[ $PWD == */a ]] && [[ $(pwd) == */a ]]`,
+		"",
+	},
+	{
+		`mkdir a; ln -s a b; cd -P -L b; [[ $PWD == */b ]]`,
+		"",
+	},
+	{
+		`old="$PWD"; mkdir a; cd a; [[ $(cd -) == "$old" ]] && cd - >/dev/null && [[ $PWD == "$old" ]]`,
+		"",
+	},
+	{
+		"unset OLDPWD; cd -",
+		"cd: OLDPWD not set\nexit status 1 #JUSTERR",
+	},
+	{
+		`mkdir -p a/b; CDPATH=a; [[ $(cd b) == "$PWD/a/b" ]] && cd b >/dev/null && [[ $PWD == */a/b ]]`,
+		"",
+	},
+	{
+		`mkdir -p a/b b; CDPATH=a; cd ./b; [[ $PWD != */a/b ]] && cd .. && cd b >/dev/null && [[ $PWD == */a/b ]]`,
+		"",
+	},
+	{
+		`mkdir -p a/b b; CDPATH=:a; [[ $(cd b) == "" ]] && cd b && [[ $PWD != */a/b ]]`,
+		"",
+	},
+	{
+		`[[ ~+ == "$PWD" ]] && [[ ~+/foo == "$PWD/foo" ]]`,
+		"",
+	},
+	{
+		`mkdir a; cd a; [[ ~- == "$OLDPWD" ]] && [[ ~-/foo == "$OLDPWD/foo" ]]`,
+		"",
+	},
+	{
+		`mkdir a; pushd a >/dev/null; [[ ~0 == "$PWD" ]] && [[ ~+1 == "$OLDPWD" ]] && [[ ~-0 == ~1 ]]`,
+		"",
+	},
+	{
+		`echo ~2 ~-2 ~+2 ~1x`,
+		"~2 ~-2 ~+2 ~1x\n",
+	},
 	{
 		`mkdir a; chmod 0000 a; cd a`,
 		"exit status 1 #JUSTERR",
@@ -746,6 +851,30 @@ var fileCases = []struct {
 		"case foo in '*') echo x ;; f*) echo y ;; esac",
 		"y\n",
 	},
+	{
+		"case a in a) echo x ;& b) echo y ;& c) echo z ;; d) echo w ;; esac",
+		"x\ny\nz\n",
+	},
+	{
+		"case ab in a*) echo x ;;& b*) echo y ;;& *b) echo z ;;& *) echo w ;; esac",
+		"x\nz\nw\n",
+	},
+	{
+		"case a in a) echo x ;& b) echo y ;;& c) echo z ;; *) echo w ;; esac",
+		"x\ny\nw\n",
+	},
+	{
+		"case a in b) echo x ;& c) echo y ;; esac; echo $?",
+		"0\n",
+	},
+	{
+		"case a in a) false ;;& b) echo x ;; esac; echo $?",
+		"1\n",
+	},
+	{
+		"case a in a) echo x ;& esac",
+		"x\n",
+	},
 
 	// exec
 	{
@@ -802,6 +931,23 @@ var fileCases = []struct {
 	{"echo 'return 2' >a; source a", "exit status 2"},
 	{"echo 'echo foo; return; echo bar' >a; source a", "foo\n"},
 
+	// caller
+	{"caller", "0 NULL\n #IGNORE"},
+	{"caller 0", "exit status 1"},
+	{"caller foo", "caller: foo: invalid number\nexit status 2 #JUSTERR"},
+	{
+		"f() { caller; caller 0; caller 1; }; g() {\nf\n}; g",
+		"2 NULL\n2 g NULL\n3 main NULL\n #IGNORE",
+	},
+	{
+		"f() { caller 5; }; f",
+		"exit status 1",
+	},
+	{
+		"printf 'f() { caller 0; caller 1; }\\nf\\ncaller\\n' >a; g() { source a; }; g",
+		"2 source a\n1 g NULL\n1 NULL\n #IGNORE",
+	},
+
 	// command
 	{"command", ""},
 	{"command -o echo", "command: invalid option -o\nexit status 2 #JUSTERR"},
@@ -850,6 +996,30 @@ var fileCases = []struct {
 		"echo foo | false | true",
 		"",
 	},
+	{
+		"yes | head -n 2",
+		"y\ny\n",
+	},
+	{
+		"set -o pipefail; yes | head -n 1; echo $?",
+		"y\n141\n",
+	},
+	{
+		"x=$(yes | head -c 4); echo $x",
+		"y y\n",
+	},
+	{
+		"sh -c 'kill -9 $$'; echo $?",
+		"137\n",
+	},
+	{
+		"while true; do echo y; done | head -n 2",
+		"y\ny\n",
+	},
+	{
+		"set -o pipefail; while true; do echo y; done | head -n 1; echo $?",
+		"y\n141\n",
+	},
 
 	// redirects
 	{
@@ -1408,6 +1578,78 @@ var fileCases = []struct {
 		"a=$((1 + 2)); echo $a",
 		"3\n",
 	},
+	{
+		"echo $((0x1F)) $((010)) $((16#ff)) $((36#Z)) $((64#@_)) $((0x))",
+		"31 8 255 35 4031 0\n",
+	},
+	{
+		"echo $((9223372036854775807 + 1)) $((-9223372036854775808 / -1))",
+		"-9223372036854775808 -9223372036854775808\n",
+	},
+	{
+		"echo $((2 ** 63)) $((1 << 64)) $((0 && 1 / 0)) $((1 || 1 / 0))",
+		"-9223372036854775808 1 0 1\n",
+	},
+	{
+		"a='1 + 2'; b=a; echo $((b * 2))",
+		"6\n",
+	},
+	{
+		"echo $((1 / 0)); echo foo",
+		"1:13: division by 0\nexit status 1 #JUSTERR",
+	},
+	{
+		"a=0; echo $((5 % a))",
+		"1:18: division by 0\nexit status 1 #JUSTERR",
+	},
+	{
+		"((a /= 0)); echo $?; let 1/0; echo $?",
+		"1:8: division by 0\n1\n1:28: division by 0\n1\n",
+	},
+	{
+		"echo $((09))",
+		"1:9: 09: value too great for base\nexit status 1 #JUSTERR",
+	},
+	{
+		"a=2#102; echo $((a))",
+		"1:18: 2#102: value too great for base\nexit status 1 #JUSTERR",
+	},
+	{
+		"echo $((65#1))",
+		"1:9: 65#1: invalid arithmetic base\nexit status 1 #JUSTERR",
+	},
+	{
+		"echo $((2 ** -1))",
+		"1:14: exponent less than 0\nexit status 1 #JUSTERR",
+	},
+	{
+		"a=a; echo $((a))",
+		"1:14: a: expression recursion level exceeded\nexit status 1 #JUSTERR",
+	},
+	{
+		"a='$(echo foo)'; echo $((a))",
+		"1:26: $(echo foo): syntax error in expression\nexit status 1 #JUSTERR",
+	},
+	{
+		"for ((i = 0; i < 3; i++)); do echo $i; done",
+		"0\n1\n2\n",
+	},
+	{
+		"a=(1 2 3); ((a[1]++)); ((a[2] += 5)); echo ${a[@]} $((a[0] = 7)) ${a[0]}",
+		"1 3 8 7 7\n",
+	},
+	{
+		"a=(0 0); i=0; ((a[i++]++)); echo ${a[@]} $i",
+		"1 0 1\n",
+	},
+	{
+		"a=(1 2); ((a[-1] *= 3)); echo ${a[@]} ${a[-2]}",
+		"1 6 1\n",
+	},
+	{
+		"declare -A a; a[x]=3; ((a[x]++)); echo ${a[x]}",
+		"4\n",
+	},
 
 	// set/shift
 	{
@@ -1450,6 +1692,98 @@ var fileCases = []struct {
 		"set -e; local; echo foo",
 		"local: can only be used in a function\nexit status 1 #JUSTERR",
 	},
+	{
+		"set -e; false && true; false || true; echo foo",
+		"foo\n",
+	},
+	{
+		"set -e; true && false; echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; false || false; echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; { false && true; }; echo foo",
+		"foo\n",
+	},
+	{
+		"set -e; f() { false && true; }; f; echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; (false && true); echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; if false; then :; fi; while false; do :; done; echo foo",
+		"foo\n",
+	},
+	{
+		"set -e; until true; do :; done; echo foo",
+		"foo\n",
+	},
+	{
+		"set -e; f() { false; echo bar; }; if f; then :; fi; f || true; echo foo",
+		"bar\nbar\nfoo\n",
+	},
+	{
+		"set -e; if true; then false; fi; echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; ! true; ! { false; echo bar; }; echo foo",
+		"bar\nfoo\n",
+	},
+	{
+		"set -e; for i in 1; do false && true; done; echo foo",
+		"foo\n",
+	},
+	{
+		"set -e; case a in a) false;; esac; echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; (false; echo bar); echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; false | true; echo foo",
+		"foo\n",
+	},
+	{
+		"set -e; true | false; echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; set -o pipefail; false | true; echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; a=$(false; echo bar); echo foo $a",
+		"foo bar\n",
+	},
+	{
+		"set -e; shopt -s inherit_errexit; a=$(false; echo bar); echo foo $a",
+		"exit status 1",
+	},
+	{
+		"set -e; a=$(false); echo foo",
+		"exit status 1",
+	},
+	{
+		"a=$(exit 3); echo $?",
+		"3\n",
+	},
+	{
+		"(exit 3); echo $?; $(exit 4); echo $?",
+		"3\n4\n",
+	},
+	{
+		"f() { (return 2); echo $?; }; f",
+		"2\n",
+	},
 	{
 		"false | :",
 		"",
@@ -1490,11 +1824,35 @@ var fileCases = []struct {
 		"a=b; echo $a; set -u; echo $a",
 		"b\nb\n",
 	},
+	{
+		"set -u; a=1; echo $a ${b:-x} ${c-y}",
+		"1 x y\n",
+	},
+	{
+		"set -u; echo $((x))",
+		"1:17: x: unbound variable\nexit status 1 #JUSTERR",
+	},
 	{
 		"echo $a; set -u; echo $a",
 		"\na: unbound variable\nexit status 1 #JUSTERR",
 	},
+	{
+		"set -u; { time true; } 2>/dev/null; echo $?",
+		"0\n",
+	},
+	{
+		"set -u; [[ -v a ]] || echo unset",
+		"unset\n",
+	},
 	{"set -n; echo foo", ""},
+	{
+		"set -C; echo foo >a; echo bar >a; cat a",
+		"a: cannot overwrite existing file\nfoo\n #IGNORE",
+	},
+	{
+		"set -o noclobber; echo foo >a; echo bar >|a; echo baz >/dev/null; cat a",
+		"bar\n",
+	},
 	{"set -n; [ wrong", ""},
 	{"set -n; set +n; echo foo", ""},
 	{
@@ -1509,6 +1867,7 @@ var fileCases = []struct {
 		"set -a; set +o",
 		`set -o allexport
 set +o errexit
+set +o noclobber
 set +o noexec
 set +o noglob
 set +o nounset
@@ -1561,6 +1920,40 @@ set +o pipefail
 	{"shopt -u -o noexec; echo foo", "foo\n"},
 	{"shopt -u globstar; shopt globstar | grep 'off$' | wc -l", "1\n"},
 	{"shopt -s globstar; shopt globstar | grep 'off$' | wc -l", "0\n"},
+	{"shopt -p globstar nullglob; shopt -po noclobber", "shopt -u globstar\nshopt -u nullglob\nset +o noclobber\nexit status 1"},
+	{"shopt -p | wc -l", "8\n #IGNORE"},
+	{"shopt -s dotglob; shopt -q dotglob && echo foo", "foo\n"},
+	{"shopt -q dotglob nullglob", "exit status 1"},
+	{"shopt globstar", "globstar\toff\nexit status 1"},
+	{
+		"shopt -s expand_aliases",
+		"shopt: invalid option name \"expand_aliases\"\nexit status 1 #JUSTERR",
+	},
+
+	{
+		"shopt -s nocasematch; case ABC in abc) echo foo;; esac",
+		"foo\n",
+	},
+	{
+		"shopt -s nocasematch; [[ ABC == a* ]] && [[ ABC =~ b ]] && echo foo",
+		"foo\n",
+	},
+	{
+		"[[ ABC == a* ]] || [[ ABC =~ b ]] || echo foo",
+		"foo\n",
+	},
+	{
+		"echo foo | read a; echo $a",
+		"\n",
+	},
+	{
+		"shopt -s lastpipe; echo foo | read a; echo $a",
+		"foo\n",
+	},
+	{
+		"echo foo | exit 3; echo $?",
+		"3\n",
+	},
 
 	// IFS
 	{`echo -n "$IFS"`, " \t\n"},
@@ -1586,6 +1979,46 @@ set +o pipefail
 	{"echo() { :; }; type echo | sed 1q", "echo is a function\n"},
 	{"type bash | grep -q -E 'bash is (/|[A-Z]:).*'", ""},
 	{"type noexist", "type: noexist: not found\nexit status 1 #JUSTERR"},
+	{"type -a noexist", "type: noexist: not found\nexit status 1 #JUSTERR"},
+	{"f() { :; }; type -t f echo bash noexist", "function\nbuiltin\nfile\nexit status 1"},
+	{"type -a echo | sed 1q", "echo is a shell builtin\n"},
+	{"[[ $(type -a bash | wc -l) -ge 1 ]]", ""},
+	{"bash -c :; type bash | grep -q -E 'bash is hashed [(](/|[A-Z]:).*[)]'", ""},
+	{"command -V echo", "echo is a shell builtin\n"},
+	{"command -V noexist", "command: noexist: not found\nexit status 1 #JUSTERR"},
+
+	// hash
+	{"hash", "hash: hash table empty\n"},
+	{"hash echo; hash", "hash: hash table empty\n"},
+	{"hash noexist", "hash: noexist: not found\nexit status 1 #JUSTERR"},
+	{"hash -t bash", "hash: bash: not found\nexit status 1 #JUSTERR"},
+	{"hash -t", "hash: -t: option requires an argument\nexit status 1 #JUSTERR"},
+	{"hash -x", "hash: invalid option \"-x\"\nexit status 2 #JUSTERR"},
+	{
+		"hash bash; hash | sed 's/\t.*//'",
+		"hits\n   0\n",
+	},
+	{
+		"bash -c :; bash -c :; hash | sed 's/\t.*//'",
+		"hits\n   2\n",
+	},
+	{
+		"bash -c :; [[ $(hash -t bash) == $(command -v bash) ]]",
+		"",
+	},
+	{"bash -c :; hash -r", ""},
+	{"bash -c :; hash -r; hash", "hash: hash table empty\n"},
+	{"bash -c :; hash -d bash; hash", "hash: hash table empty\n"},
+	{"bash -c :; PATH=/nonexistent:$PATH; hash", "hash: hash table empty\n"},
+	{"bash -c :; (hash -r); hash -t bash >/dev/null", ""},
+	{
+		"hash -p /foo/bar bar; hash -l; hash -t bar",
+		"builtin hash -p /foo/bar bar\n/foo/bar\n",
+	},
+	{
+		"hash -p \"$(command -v sh)\" foo; foo -c 'echo foo'",
+		"foo\n",
+	},
 
 	// eval
 	{"eval", ""},
@@ -1803,6 +2236,78 @@ set +o pipefail
 		"f() { a=1; declare b=2; export c=3; readonly d=4; declare -g e=5; }; f; echo $a $b $c $d $e",
 		"1 3 4 5\n",
 	},
+	{
+		"f1() { echo $a; a=c; }; f2() { local a=b; f1; echo $a; }; a=x; f2; echo $a",
+		"b\nc\nx\n",
+	},
+	{
+		"f1() { local a; echo ${a-unset}; }; a=x; f1",
+		"unset\n",
+	},
+	{
+		"f1() { local a=1; local a; echo $a; }; f1",
+		"1\n",
+	},
+	{
+		"f1() { local a=b; unset a; echo ${a-unset}; }; a=x; f1; echo $a",
+		"unset\nx\n",
+	},
+	{
+		"f1() { unset a; echo ${a-unset}; }; f2() { local a=b; f1; echo ${a-unset}; }; a=x; f2",
+		"x\nx\n",
+	},
+	{
+		"f1() { declare -g a=g; echo $a; }; f2() { local a=l; f1; }; f2; echo $a",
+		"l\ng\n",
+	},
+	{
+		"f() { export a=b; }; f; echo $a; sh -c 'echo $a'",
+		"b\nb\n",
+	},
+	{
+		"f() { local a=b; export a; sh -c 'echo $a'; }; f; sh -c 'echo ${a-unset}'",
+		"b\nunset\n",
+	},
+	{
+		"export a=x; f() { local a=b; sh -c 'echo $a'; }; f",
+		"b\n",
+	},
+	{
+		"export a=x; f() { local a; sh -c 'echo ${a-unset}'; a=6; sh -c 'echo $a'; }; f",
+		"unset\n6\n",
+	},
+	{
+		"export a; sh -c 'echo ${a-unset}'; a=1; sh -c 'echo $a'",
+		"unset\n1\n",
+	},
+	{
+		"ab=1 ac=2; f() { local ab=3; echo ${!a*}; }; f",
+		"ab ac\n",
+	},
+	{
+		"f() { local a=b; (a=c); echo $a; a=d | cat; echo $a; }; f",
+		"b\nb\n",
+	},
+	{
+		"readonly a=x; f() { local a=b; }; f",
+		"a: readonly variable\nexit status 1 #JUSTERR",
+	},
+	{
+		"f() { local IFS=,; a=(x y); echo \"${a[*]}\"; }; f; a=(x y); echo \"${a[*]}\"",
+		"x,y\nx y\n",
+	},
+	{
+		"f() { local -; set -f; [[ -o noglob ]] && echo on; }; f; [[ -o noglob ]] || echo off",
+		"on\noff\n",
+	},
+	{
+		"f() { set -f; }; f; [[ -o noglob ]] && echo on",
+		"on\n",
+	},
+	{
+		"declare -",
+		"declare: invalid option \"-\"\nexit status 2 #JUSTERR",
+	},
 
 	// name references
 	{"declare -n foo=bar; bar=etc; [[ -R foo ]]", ""},
@@ -1921,6 +2426,27 @@ set +o pipefail
 		"a/b/c\n",
 	},
 
+	{
+		"touch .hidden a; echo *; shopt -s dotglob; echo *",
+		"a\n.hidden a\n",
+	},
+	{
+		"touch a.x; echo *.X; shopt -s nocaseglob; echo *.X",
+		"*.X\na.x\n",
+	},
+	{
+		"shopt -s nullglob; set -- foo *.x bar; echo $# $@",
+		"2 foo bar\n",
+	},
+	{
+		"shopt -s failglob; echo *.x; echo foo",
+		"no match: *.x\nexit status 1 #JUSTERR",
+	},
+	{
+		"shopt -s failglob; touch a.x; echo *.x",
+		"a.x\n",
+	},
+
 	// brace expansion; more exhaustive tests in the syntax package
 	{"echo a}b", "a}b\n"},
 	{"echo {a,b{c,d}", "{a,bc {a,bd\n"},
@@ -1942,6 +2468,90 @@ set +o pipefail
 	{"{ time echo -n; } |& wc", "      4       6      42\n"},
 	{"{ time -p; } |& wc", "      3       6      29\n"},
 	{"{ time -p echo -n; } |& wc", "      3       6      29\n"},
+	{"TIMEFORMAT=''; { time echo foo; } 2>&1", "foo\n"},
+	{"TIMEFORMAT='x%%y'; { time true; } 2>&1", "x%y\n"},
+	{"TIMEFORMAT='%0R %0lR'; { time true; } 2>&1", "0 0m0s\n"},
+	{
+		"TIMEFORMAT='%X'; { time true; } 2>&1",
+		"TIMEFORMAT: `X': invalid format character\n #IGNORE",
+	},
+	{"times | wc -l", "2\n"},
+
+	// umask
+	{"umask 022; umask", "0022\n"},
+	{"umask 0077; umask -S", "u=rwx,g=,o=\n"},
+	{"umask 022; umask -p; umask -pS", "umask 0022\numask -S u=rwx,g=rx,o=rx\n"},
+	{"umask 022; umask u=rwx,g=rx,o=; umask", "0027\n"},
+	{"umask 022; umask a+w; umask", "0000\n"},
+	{"umask 022; umask g-w,o-rwx; umask -S", "u=rwx,g=rx,o=\n"},
+	{"umask 022; umask =; umask", "0777\n"},
+	{
+		"umask 999",
+		"umask: 999: octal number out of range\nexit status 1 #JUSTERR",
+	},
+	{
+		"umask u=q",
+		"umask: `q': invalid symbolic mode character\nexit status 1 #JUSTERR",
+	},
+	{
+		"umask u*r",
+		"umask: `*': invalid symbolic mode operator\nexit status 1 #JUSTERR",
+	},
+	{
+		"umask 077; >a; ls -l a | cut -c1-10",
+		"-rw-------\n",
+	},
+	{
+		"umask 027; touch a; ls -l a | cut -c1-10",
+		"-rw-r-----\n",
+	},
+	{
+		"umask 0; >a; ls -l a | cut -c1-10",
+		"-rw-rw-rw-\n",
+	},
+	{
+		"umask 077; (umask 0); umask",
+		"0077\n",
+	},
+
+	// ulimit
+	{"ulimit -f 10; ulimit -f; ulimit", "10\n10\n"},
+	{"ulimit -c 0; ulimit -c; ulimit -Hc", "0\n0\n"},
+	{
+		"ulimit -Sn 100; ulimit -n; ulimit -Sn hard; [ $(ulimit -n) = $(ulimit -Hn) ] && echo same",
+		"100\nsame\n",
+	},
+	{
+		"ulimit -f 10; (ulimit -f 5; ulimit -f); ulimit -f",
+		"5\n10\n",
+	},
+	{
+		"ulimit -f 10; ulimit -c 20; ulimit -f -c",
+		"file size                   (blocks, -f) 10\n" +
+			"core file size              (blocks, -c) 20\n",
+	},
+	{"ulimit -a | grep -c '(-n)'", "1\n"},
+	{
+		"ulimit -f foo",
+		"ulimit: foo: invalid number\nexit status 1 #JUSTERR",
+	},
+	{
+		"ulimit -Sn 50; ulimit -Hn 100; ulimit -Sn 200",
+		"ulimit: open files: cannot modify limit: invalid argument\nexit status 1 #JUSTERR",
+	},
+	// programs are subject to the limits from the start
+	{
+		"ulimit -Sn 100; sh -c 'ulimit -n'",
+		"100\n",
+	},
+	{
+		"ulimit -t 100; ulimit -Sc 0; sh -c 'ulimit -t; ulimit -c'",
+		"100\n0\n",
+	},
+	{
+		"ulimit -c 0; sh -c 'echo $0 $1' foo bar; env | grep -c RLIMITS",
+		"foo bar\n0\nexit status 1",
+	},
 
 	// exec
 	{"exec", ""},
@@ -2121,13 +2731,16 @@ func (c *concBuffer) String() string {
 
 // wc: leading whitespace padding
 // touch -d @: no way to set unix timestamps
-var skipOnDarwin = regexp.MustCompile(`\bwc\b|touch -d @`)
+// ulimit: resource limits are only supported on linux
+var skipOnDarwin = regexp.MustCompile(`\bwc\b|touch -d @|ulimit`)
 
 // chmod: very different by design
 // mkfifo: very different by design
 // ln -s: requires linked path to exist, stat does not work well
 // ~root: username does not exist
-var skipOnWindows = regexp.MustCompile(`chmod|mkfifo|ln -s|~root`)
+// umask: no file mode creation mask
+// ulimit: no resource limits
+var skipOnWindows = regexp.MustCompile(`chmod|mkfifo|ln -s|~root|umask|ulimit|kill -9`)
 
 func skipFileReason(src string) string {
 	if runtime.GOOS == "darwin" && skipOnDarwin.MatchString(src) {
@@ -2375,6 +2988,85 @@ func TestRunnerAltNodes(t *testing.T) {
 	}
 }
 
+func TestRunnerCallStack(t *testing.T) {
+	t.Parallel()
+	in := "f() {\n\tg\n}\ng() { foo; exit 3; }\nf"
+	file, err := syntax.NewParser().Parse(strings.NewReader(in), "main.sh")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	var stacks [][]Frame
+	r := Runner{}
+	r.Exec = func(ctx Ctxt, path string, args []string) error {
+		stacks = append(stacks, r.CallStack())
+		return nil
+	}
+	r.Reset()
+	if err := r.Run(file); err != ExitCode(3) {
+		t.Fatalf("wanted exit status 3, got: %v", err)
+	}
+	// the stack at the time of the error is kept
+	stacks = append(stacks, r.CallStack())
+	want := "g main.sh:2:2, f main.sh:5:1"
+	if len(stacks) != 2 {
+		t.Fatalf("wanted 2 call stacks, got %d", len(stacks))
+	}
+	for _, stack := range stacks {
+		var parts []string
+		for _, fr := range stack {
+			parts = append(parts, fmt.Sprintf("%s %s:%s", fr.Func, fr.File, fr.Pos))
+		}
+		if got := strings.Join(parts, ", "); got != want {
+			t.Fatalf("wrong call stack:\nwant: %s\ngot:  %s", want, got)
+		}
+	}
+	if err := r.Run(file); err != ExitCode(3) {
+		t.Fatalf("wanted exit status 3, got: %v", err)
+	}
+	r.Run(&syntax.File{})
+	if got := r.CallStack(); len(got) != 0 {
+		t.Fatalf("wanted an empty call stack, got: %+v", got)
+	}
+}
+
+func TestRunnerCmdSubstLimit(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"x=$(echo foo); echo $x", "foo\n"},
+		{"x=$(for i in 1 2 3; do echo abcd; done); echo $x", "abcd abcd\n"},
+		{"x=$(yes); echo ${#x} $?", "9 141\n"},
+		{"x=$(echo abcdefghijklm | cat); echo $x", "abcdefghij\n"},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			file, err := syntax.NewParser().Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatalf("could not parse: %v", err)
+			}
+			var stdout, stderr bytes.Buffer
+			r := Runner{
+				Stdout:        &stdout,
+				Stderr:        &stderr,
+				CmdSubstLimit: 10,
+			}
+			r.Reset()
+			if err := r.Run(file); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := stdout.String(); got != tc.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+					tc.in, tc.want, got)
+			}
+			truncated := strings.Contains(stderr.String(), "truncated")
+			if wantTrunc := tc.want != "foo\n"; truncated != wantTrunc {
+				t.Fatalf("wrong stderr in %q: %q", tc.in, stderr.String())
+			}
+		})
+	}
+}
+
 func TestElapsedString(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
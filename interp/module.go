@@ -9,8 +9,10 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -26,6 +28,45 @@ type Ctxt struct {
 	Stdout      io.Writer
 	Stderr      io.Writer
 	KillTimeout time.Duration
+
+	// KillSignals, if not empty, are the signals sent to stop
+	// programs when Context is cancelled, instead of those given
+	// by KillTimeout.
+	KillSignals []KillSignal
+
+	// Umask is the file mode creation mask of the interpreter. The
+	// default modules apply it to the files they create and to the
+	// programs they execute.
+	Umask os.FileMode
+
+	childTimes *cpuTimes
+	rlimits    map[byte]rlimit
+}
+
+// cpuTimes accumulates the user and system CPU times of processes. It
+// is safe for concurrent use.
+type cpuTimes struct {
+	mu        sync.Mutex
+	user, sys time.Duration
+}
+
+func (c *cpuTimes) add(user, sys time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.user += user
+	c.sys += sys
+	c.mu.Unlock()
+}
+
+func (c *cpuTimes) get() (user, sys time.Duration) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user, c.sys
 }
 
 // UnixPath fixes absolute unix paths on Windows, for example converting
@@ -38,6 +79,51 @@ func (c *Ctxt) UnixPath(path string) string {
 	return strings.Replace(path, `\`, `/`, -1)
 }
 
+// KillSignal is a signal sent to stop a program, once Delay has passed
+// since the previous signal was sent.
+type KillSignal struct {
+	Signal os.Signal
+	Delay  time.Duration
+}
+
+// killSignals returns the signals to send to stop a program when the
+// context is cancelled.
+func killSignals(ctx Ctxt) []KillSignal {
+	switch {
+	case len(ctx.KillSignals) > 0:
+		return ctx.KillSignals
+	case ctx.KillTimeout <= 0 || runtime.GOOS == "windows":
+		// Go doesn't support sending Interrupt on Windows
+		return []KillSignal{{Signal: os.Kill}}
+	}
+	return []KillSignal{
+		{Signal: os.Interrupt},
+		{Signal: os.Kill, Delay: ctx.KillTimeout},
+	}
+}
+
+// stopProcess sends the signals to a process, or to its process group,
+// once done is closed. It gives up as soon as exited is closed.
+func stopProcess(p *os.Process, group bool, signals []KillSignal, done, exited <-chan struct{}) {
+	select {
+	case <-done:
+	case <-exited:
+		return
+	}
+	for _, ks := range signals {
+		if ks.Delay > 0 {
+			timer := time.NewTimer(ks.Delay)
+			select {
+			case <-timer.C:
+			case <-exited:
+				timer.Stop()
+				return
+			}
+		}
+		_ = signalProcess(p, ks.Signal, group)
+	}
+}
+
 // ModuleExec is the module responsible for executing a program. It is
 // executed for all CallExpr nodes where the first argument is neither a
 // declared function nor a builtin.
@@ -66,29 +152,34 @@ func DefaultExec(ctx Ctxt, path string, args []string) error {
 		Stderr: ctx.Stderr,
 	}
 
-	err := cmd.Start()
+	// Programs that may need to be stopped are put in their own
+	// process group, so that any programs they start are stopped
+	// too. Others stay in ours, as they may need to use the
+	// terminal.
+	done := ctx.Context.Done()
+	group := done != nil
+	if group {
+		setProcGroup(&cmd)
+	}
+	if len(ctx.rlimits) > 0 {
+		rlimitCmd(&cmd, ctx.rlimits)
+	}
+	err := startCmd(&cmd, ctx.Umask)
 	if err == nil {
-		if done := ctx.Context.Done(); done != nil {
-			go func() {
-				<-done
-
-				if ctx.KillTimeout <= 0 || runtime.GOOS == "windows" {
-					_ = cmd.Process.Signal(os.Kill)
-					return
-				}
-
-				// TODO: don't temporarily leak this goroutine
-				// if the program stops itself with the
-				// interrupt.
-				go func() {
-					time.Sleep(ctx.KillTimeout)
-					_ = cmd.Process.Signal(os.Kill)
-				}()
-				_ = cmd.Process.Signal(os.Interrupt)
-			}()
+		exited := make(chan struct{})
+		if done != nil {
+			go stopProcess(cmd.Process, group, killSignals(ctx), done, exited)
 		}
 
 		err = cmd.Wait()
+		close(exited)
+		if group && ctx.Context.Err() != nil {
+			// stop any programs left behind in the group
+			_ = signalProcess(cmd.Process, os.Kill, true)
+		}
+		if state := cmd.ProcessState; state != nil {
+			ctx.childTimes.add(state.UserTime(), state.SystemTime())
+		}
 	}
 
 	switch x := err.(type) {
@@ -96,8 +187,13 @@ func DefaultExec(ctx Ctxt, path string, args []string) error {
 		// started, but errored - default to 1 if OS
 		// doesn't have exit statuses
 		if status, ok := x.Sys().(syscall.WaitStatus); ok {
-			if status.Signaled() && ctx.Context.Err() != nil {
-				return ctx.Context.Err()
+			if status.Signaled() {
+				if ctx.Context.Err() != nil {
+					return ctx.Context.Err()
+				}
+				// like shells, such as when a broken pipe
+				// results in 141
+				return ExitCode(128 + status.Signal())
 			}
 			return ExitCode(status.ExitStatus())
 		}
@@ -111,6 +207,36 @@ func DefaultExec(ctx Ctxt, path string, args []string) error {
 	}
 }
 
+// DefaultExecReplace is a ModuleExec meant to be used as
+// Runner.ExecReplace. It replaces the current process with the program
+// via syscall.Exec, so it does not return if it succeeds.
+//
+// The program inherits the exported environment, the working directory
+// and the umask, and its standard streams are set to ctx.Stdin,
+// ctx.Stdout and ctx.Stderr. If any of them isn't an *os.File, on
+// Windows where processes cannot be replaced, or if any resource limits
+// were set via ulimit, it falls back to DefaultExec. The limits are never
+// set on the current process, as they would apply to all of it.
+func DefaultExecReplace(ctx Ctxt, path string, args []string) error {
+	if path == "" || runtime.GOOS == "windows" || len(ctx.rlimits) > 0 {
+		return DefaultExec(ctx, path, args)
+	}
+	var files [3]*os.File
+	for i, stream := range [...]interface{}{ctx.Stdin, ctx.Stdout, ctx.Stderr} {
+		f, ok := stream.(*os.File)
+		if !ok {
+			return DefaultExec(ctx, path, args)
+		}
+		files[i] = f
+	}
+	setUmask(ctx.Umask)
+	if err := replaceProcess(path, args, execEnv(ctx.Env), ctx.Dir, files); err != nil {
+		fmt.Fprintf(ctx.Stderr, "%v\n", err)
+		return ExitCode(126)
+	}
+	return nil
+}
+
 // ModuleOpen is the module responsible for opening a file. It is
 // executed for all files that are opened directly by the shell, such as
 // in redirects. Files opened by executed programs are not included.
@@ -127,7 +253,25 @@ func DefaultExec(ctx Ctxt, path string, args []string) error {
 type ModuleOpen func(ctx Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
 
 func DefaultOpen(ctx Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
-	return os.OpenFile(path, flag, perm)
+	if flag&os.O_CREATE == 0 || runtime.GOOS == "windows" {
+		return os.OpenFile(path, flag, perm)
+	}
+	// The process's umask is applied when creating a file, which
+	// may differ from the interpreter's. Set the permissions of new
+	// files explicitly, without changing the process-wide umask.
+	created := flag&os.O_EXCL != 0
+	if !created {
+		_, err := os.Lstat(path)
+		created = os.IsNotExist(err)
+	}
+	f, err := os.OpenFile(path, flag, perm)
+	if err == nil && created {
+		if err := f.Chmod(perm &^ ctx.Umask); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, err
 }
 
 func OpenDevImpls(next ModuleOpen) ModuleOpen {
@@ -147,3 +291,18 @@ type devNull struct{}
 func (devNull) Read(p []byte) (int, error)  { return 0, io.EOF }
 func (devNull) Write(p []byte) (int, error) { return len(p), nil }
 func (devNull) Close() error                { return nil }
+
+// ModuleLookupUser is the module responsible for looking up users, such
+// as in tilde expansions like "~name". An empty name means the current
+// user, which Reset uses to set $HOME if it isn't in the environment.
+//
+// Restricting it allows sandboxing the interpreter, as otherwise the
+// home directory of any user can be found via tilde expansion.
+type ModuleLookupUser func(ctx Ctxt, name string) (*user.User, error)
+
+func DefaultLookupUser(ctx Ctxt, name string) (*user.User, error) {
+	if name == "" {
+		return user.Current()
+	}
+	return user.Lookup(name)
+}
@@ -9,9 +9,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/user"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -19,11 +21,13 @@ import (
 )
 
 var modCases = []struct {
-	name string
-	exec ModuleExec
-	open ModuleOpen
-	src  string
-	want string
+	name        string
+	exec        ModuleExec
+	execReplace ModuleExec
+	open        ModuleOpen
+	lookupUser  ModuleLookupUser
+	src         string
+	want        string
 }{
 	{
 		name: "ExecBlacklist",
@@ -82,6 +86,23 @@ var modCases = []struct {
 		src:  "{ malicious; echo foo; } & wait",
 		want: "",
 	},
+	{
+		name: "ExecReplace",
+		execReplace: func(ctx Ctxt, path string, args []string) error {
+			fmt.Fprintf(ctx.Stdout, "replaced by %s\n", args[0])
+			return ExitCode(3)
+		},
+		src:  "exec >/dev/null; exec echo foo >&2; echo bar",
+		want: "replaced by echo\nexit status 3",
+	},
+	{
+		name: "ExecReplaceSubshell",
+		execReplace: func(ctx Ctxt, path string, args []string) error {
+			return fmt.Errorf("replaced by %s", args[0])
+		},
+		src:  "(exec echo foo); echo bar | (exec cat); a=$(exec echo baz); echo $a",
+		want: "foo\nbar\nbaz\n",
+	},
 	{
 		name: "OpenForbidNonDev",
 		open: OpenDevImpls(func(ctx Ctxt, path string, flags int, mode os.FileMode) (io.ReadWriteCloser, error) {
@@ -90,6 +111,17 @@ var modCases = []struct {
 		src:  "echo foo >/dev/null; echo bar >/tmp/x",
 		want: "non-dev: /tmp/x",
 	},
+	{
+		name: "LookupUserSandbox",
+		lookupUser: func(ctx Ctxt, name string) (*user.User, error) {
+			if name != "guest" {
+				return nil, fmt.Errorf("unknown user: %s", name)
+			}
+			return &user.User{Username: name, HomeDir: "/home/guest"}, nil
+		},
+		src:  "echo ~guest/foo ~root ~noexist",
+		want: "/home/guest/foo ~root ~noexist\n",
+	},
 }
 
 func TestRunnerModules(t *testing.T) {
@@ -107,6 +139,9 @@ func TestRunnerModules(t *testing.T) {
 				Stderr: &cb,
 				Exec:   tc.exec,
 				Open:   tc.open,
+
+				ExecReplace: tc.execReplace,
+				LookupUser:  tc.lookupUser,
 			}
 			r.Reset()
 			if err := r.Run(file); err != nil {
@@ -220,3 +255,75 @@ func TestKillTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestKillProcessGroup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sleeps and timeouts are slow")
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping process group tests on windows")
+	}
+	tests := []struct {
+		src         string
+		want        string
+		killSignals []KillSignal
+	}{
+		// the background sleep ignores the interrupt, but is
+		// killed along with its parent
+		{
+			`sh -c "sleep 10 & echo ready; wait"`,
+			"",
+			nil,
+		},
+		// the signals are sent to the entire group
+		{
+			`sh -c "trap 'echo terminated; exit 0' TERM; echo ready; while true; do sleep 0.01; done" 2>/dev/null`,
+			"terminated\n",
+			[]KillSignal{{Signal: syscall.SIGTERM}},
+		},
+		// escalated once the first signal is ignored
+		{
+			`sh -c "trap '' TERM; echo ready; sleep 10"`,
+			"",
+			[]KillSignal{
+				{Signal: syscall.SIGTERM},
+				{Signal: os.Kill, Delay: 20 * time.Millisecond},
+			},
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			t.Parallel()
+			file, err := syntax.NewParser().Parse(strings.NewReader(test.src), "")
+			if err != nil {
+				t.Fatalf("could not parse: %v", err)
+			}
+			var rbuf readyBuffer
+			rbuf.seenReady.Add(1)
+			ctx, cancel := context.WithCancel(context.Background())
+			r := Runner{
+				Context:     ctx,
+				Stdout:      &rbuf,
+				Stderr:      &rbuf,
+				KillTimeout: 20 * time.Millisecond,
+				KillSignals: test.killSignals,
+			}
+			if err := r.Reset(); err != nil {
+				t.Fatalf("could not reset: %v", err)
+			}
+			go func() {
+				rbuf.seenReady.Wait()
+				cancel()
+			}()
+			start := time.Now()
+			r.Run(file)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("programs were not stopped, took %v", elapsed)
+			}
+			if got := rbuf.buf.String(); got != test.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", test.want, got)
+			}
+		})
+	}
+}
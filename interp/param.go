@@ -83,13 +83,18 @@ func (r *Runner) paramExp(pe *syntax.ParamExp) string {
 		} else {
 			vr, set = r.lookupVar(name)
 		}
+		if !set && r.opts[optNoUnset] && !substExp(pe.Exp) {
+			r.errf("%s: unbound variable\n", name)
+			r.exit = 1
+			r.lastExit()
+		}
 	}
 	str := r.varStr(vr, 0)
 	if index != nil {
 		str = r.varInd(vr, index, 0)
 	}
 	slicePos := func(expr syntax.ArithmExpr) int {
-		p := r.arithm(expr)
+		p := int(r.arithm(expr))
 		if p < 0 {
 			p = len(str) + p
 			if p < 0 {
@@ -268,6 +273,21 @@ func (r *Runner) paramExp(pe *syntax.ParamExp) string {
 	return str
 }
 
+// substExp reports whether an expansion provides a value for unset
+// parameters, such as ${a:-b}, which makes it valid with nounset.
+func substExp(exp *syntax.Expansion) bool {
+	if exp == nil {
+		return false
+	}
+	switch exp.Op {
+	case syntax.SubstPlus, syntax.SubstColPlus, syntax.SubstMinus,
+		syntax.SubstColMinus, syntax.SubstQuest, syntax.SubstColQuest,
+		syntax.SubstAssgn, syntax.SubstColAssgn:
+		return true
+	}
+	return false
+}
+
 func removePattern(str, pattern string, fromEnd, greedy bool) string {
 	expr, err := syntax.TranslatePattern(pattern, greedy)
 	if err != nil {
@@ -7,8 +7,10 @@ package interp
 
 import (
 	"os"
+	"os/exec"
 	"os/user"
 	"strconv"
+	"sync"
 	"syscall"
 )
 
@@ -47,3 +49,55 @@ func hasPermissionToDir(info os.FileInfo) bool {
 
 	return false
 }
+
+// umaskMu guards the process-wide umask, as it can only be read by
+// setting it. It is held for reading while starting a program with the
+// current umask, and for writing while the umask is changed.
+var umaskMu sync.RWMutex
+
+// procUmask caches the umask of the current process. Reading it again
+// would mean changing it again, and the rest of the program is not
+// expected to change it.
+var procUmask = -1
+
+// processUmask returns the umask of the current process.
+func processUmask() os.FileMode {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	if procUmask < 0 {
+		procUmask = syscall.Umask(0)
+		syscall.Umask(procUmask)
+	}
+	return os.FileMode(procUmask)
+}
+
+// startCmd starts cmd with the given umask. A child process inherits
+// the umask of its parent, so if it differs from the process umask, the
+// latter is changed while the child is being started. Since the umask
+// is process-wide, files created meanwhile by the rest of the program
+// are subject to it too.
+func startCmd(cmd *exec.Cmd, umask os.FileMode) error {
+	want := int(umask.Perm())
+	umaskMu.RLock()
+	if procUmask == want {
+		defer umaskMu.RUnlock()
+		return cmd.Start()
+	}
+	umaskMu.RUnlock()
+
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(want)
+	defer syscall.Umask(old)
+	procUmask = old
+	return cmd.Start()
+}
+
+// setUmask sets the umask of the current process, which is about to be
+// replaced by another program.
+func setUmask(umask os.FileMode) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	procUmask = int(umask.Perm())
+	syscall.Umask(procUmask)
+}
@@ -3,9 +3,25 @@
 
 package interp
 
-import "os"
+import (
+	"os"
+	"os/exec"
+)
 
 // hasPermissionToDir is a no-op on Windows.
 func hasPermissionToDir(info os.FileInfo) bool {
 	return true
 }
+
+// processUmask returns zero, as Windows has no umask.
+func processUmask() os.FileMode {
+	return 0
+}
+
+// startCmd starts cmd, ignoring the umask.
+func startCmd(cmd *exec.Cmd, umask os.FileMode) error {
+	return cmd.Start()
+}
+
+// setUmask does nothing, as Windows has no umask.
+func setUmask(umask os.FileMode) {}
@@ -0,0 +1,20 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build windows js
+
+package interp
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcGroup does nothing, as processes can't be signalled by group
+// on Windows or JavaScript.
+func setProcGroup(cmd *exec.Cmd) {}
+
+// signalProcess sends a signal to a process. Only os.Kill is supported.
+func signalProcess(p *os.Process, sig os.Signal, group bool) error {
+	return p.Signal(sig)
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !windows,!js
+
+package interp
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcGroup makes cmd start in a new process group, led by the
+// program itself. Its descendants stay in the group unless they leave
+// it, so that they can all be signalled at once.
+func setProcGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcess sends a signal to a process, or to its entire process
+// group if group is true. The group can be signalled even after the
+// process has been waited for, as long as any of its members remain.
+func signalProcess(p *os.Process, sig os.Signal, group bool) error {
+	if s, ok := sig.(syscall.Signal); ok && group {
+		return syscall.Kill(-p.Pid, s)
+	}
+	return p.Signal(sig)
+}
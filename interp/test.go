@@ -33,7 +33,7 @@ func (r *Runner) bashTest(expr syntax.TestExpr, classic bool) string {
 				}
 			} else { // [[
 				pat := r.lonePattern(yw)
-				if match(pat, str) == (x.Op == syntax.TsMatch) {
+				if match(pat, str, r.opts[optNoCaseMatch]) == (x.Op == syntax.TsMatch) {
 					return "1"
 				}
 			}
@@ -55,6 +55,9 @@ func (r *Runner) bashTest(expr syntax.TestExpr, classic bool) string {
 func (r *Runner) binTest(op syntax.BinTestOperator, x, y string) bool {
 	switch op {
 	case syntax.TsReMatch:
+		if r.opts[optNoCaseMatch] {
+			y = "(?i)" + y
+		}
 		re, err := regexp.Compile(y)
 		if err != nil {
 			r.exit = 2
@@ -0,0 +1,12 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build js
+
+package interp
+
+import "time"
+
+// processTimes is not supported on this platform, so no CPU time is
+// ever reported.
+func processTimes() (user, sys time.Duration) { return 0, 0 }
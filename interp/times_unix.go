@@ -0,0 +1,21 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !windows,!js
+
+package interp
+
+import (
+	"syscall"
+	"time"
+)
+
+// processTimes returns the user and system CPU time used by the current
+// process so far.
+func processTimes() (user, sys time.Duration) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	return time.Duration(ru.Utime.Nano()), time.Duration(ru.Stime.Nano())
+}
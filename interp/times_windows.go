@@ -0,0 +1,30 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"syscall"
+	"time"
+)
+
+// processTimes returns the user and system CPU time used by the current
+// process so far.
+func processTimes() (user, sys time.Duration) {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, 0
+	}
+	var creation, exit, kernel, usr syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &usr); err != nil {
+		return 0, 0
+	}
+	return filetimeDuration(usr), filetimeDuration(kernel)
+}
+
+// filetimeDuration converts a Filetime holding a duration, counted in
+// intervals of 100 nanoseconds.
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	n := int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+	return time.Duration(n * 100)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+)
+
+// rlimit is a pair of soft and hard resource limits.
+type rlimit struct {
+	cur, max uint64
+}
+
+// rlimInfinity means that a resource is not limited.
+const rlimInfinity = ^uint64(0)
+
+// ulimitResource is a resource that can be limited via ulimit.
+type ulimitResource struct {
+	flag  byte
+	desc  string
+	units string // only if the values are not a count
+	scale uint64 // what a unit is worth in the limit's values
+}
+
+// ulimitResources are the resources supported by the ulimit builtin,
+// sorted by flag as in the output of "ulimit -a".
+var ulimitResources = [...]ulimitResource{
+	{'c', "core file size", "blocks", 1024},
+	{'f', "file size", "blocks", 1024},
+	{'n', "open files", "", 1},
+	{'s', "stack size", "kbytes", 1024},
+	{'t', "cpu time", "seconds", 1},
+	{'u', "max user processes", "", 1},
+	{'v', "virtual memory", "kbytes", 1024},
+}
+
+func ulimitResourceByFlag(flag byte) *ulimitResource {
+	for i := range ulimitResources {
+		if res := &ulimitResources[i]; res.flag == flag {
+			return res
+		}
+	}
+	return nil
+}
+
+// rlimit returns the current limit of a resource. Unless the shell has
+// modified it, it is the limit of the current process.
+func (r *Runner) rlimit(flag byte) (rlimit, error) {
+	if lim, ok := r.rlimits[flag]; ok {
+		return lim, nil
+	}
+	return processRlimit(flag)
+}
+
+// setRlimit sets either or both of the soft and hard limits of a
+// resource. Like setrlimit, it refuses to raise the hard limit unless
+// running as root.
+func (r *Runner) setRlimit(flag byte, val uint64, soft, hard bool) error {
+	old, err := r.rlimit(flag)
+	if err != nil {
+		return err
+	}
+	lim := old
+	if soft {
+		lim.cur = val
+	}
+	if hard {
+		lim.max = val
+	}
+	if lim.cur > lim.max {
+		return syscall.EINVAL
+	}
+	if lim.max > old.max && syscall.Geteuid() != 0 {
+		return syscall.EPERM
+	}
+	// copy the map, as it may be shared with the parent shell
+	rlimits := make(map[byte]rlimit, len(r.rlimits)+1)
+	for f, l := range r.rlimits {
+		rlimits[f] = l
+	}
+	rlimits[flag] = lim
+	r.rlimits = rlimits
+	return nil
+}
+
+func (r *Runner) ulimit(args []string) int {
+	soft, hard := false, false
+	var flags []byte
+	all := false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, c := range []byte(args[0][1:]) {
+			switch c {
+			case 'S':
+				soft = true
+			case 'H':
+				hard = true
+			case 'a':
+				all = true
+			default:
+				if ulimitResourceByFlag(c) == nil {
+					r.errf("ulimit: invalid option %q\n", args[0])
+					return 2
+				}
+				flags = append(flags, c)
+			}
+		}
+		args = args[1:]
+	}
+	if all {
+		flags = flags[:0]
+		for _, res := range &ulimitResources {
+			flags = append(flags, res.flag)
+		}
+	} else if len(flags) == 0 {
+		flags = append(flags, 'f')
+	}
+	if len(args) == 0 {
+		exit := 0
+		for _, flag := range flags {
+			res := ulimitResourceByFlag(flag)
+			lim, err := r.rlimit(flag)
+			if err != nil {
+				r.errf("ulimit: %s: cannot get limit: %v\n", res.desc, err)
+				exit = 1
+				continue
+			}
+			val := lim.cur
+			if hard && !soft {
+				val = lim.max
+			}
+			str := "unlimited"
+			if val != rlimInfinity {
+				str = strconv.FormatUint(val/res.scale, 10)
+			}
+			if len(flags) == 1 {
+				r.outf("%s\n", str)
+				continue
+			}
+			unit := fmt.Sprintf("(-%c) ", flag)
+			if res.units != "" {
+				unit = fmt.Sprintf("(%s, -%c) ", res.units, flag)
+			}
+			r.outf("%-20s %20s%s\n", res.desc, unit, str)
+		}
+		return exit
+	}
+	if !soft && !hard {
+		soft, hard = true, true
+	}
+	for _, flag := range flags {
+		res := ulimitResourceByFlag(flag)
+		lim, err := r.rlimit(flag)
+		if err != nil {
+			r.errf("ulimit: %s: cannot modify limit: %v\n", res.desc, err)
+			return 1
+		}
+		var val uint64
+		switch arg := args[0]; arg {
+		case "unlimited":
+			val = rlimInfinity
+		case "soft":
+			val = lim.cur
+		case "hard":
+			val = lim.max
+		default:
+			n, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil || n > rlimInfinity/res.scale {
+				r.errf("ulimit: %s: invalid number\n", arg)
+				return 1
+			}
+			val = n * res.scale
+		}
+		if err := r.setRlimit(flag, val, soft, hard); err != nil {
+			r.errf("ulimit: %s: cannot modify limit: %v\n", res.desc, err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimitResource returns the resource number of a ulimit flag.
+func rlimitResource(flag byte) int {
+	switch flag {
+	case 'c':
+		return unix.RLIMIT_CORE
+	case 'f':
+		return unix.RLIMIT_FSIZE
+	case 'n':
+		return unix.RLIMIT_NOFILE
+	case 's':
+		return unix.RLIMIT_STACK
+	case 't':
+		return unix.RLIMIT_CPU
+	case 'u':
+		return unix.RLIMIT_NPROC
+	case 'v':
+		return unix.RLIMIT_AS
+	}
+	panic("unhandled ulimit resource: " + string(flag))
+}
+
+// processRlimit returns the limit of a resource for the current
+// process.
+func processRlimit(flag byte) (rlimit, error) {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(rlimitResource(flag), &lim); err != nil {
+		return rlimit{}, err
+	}
+	return rlimit{lim.Cur, lim.Max}, nil
+}
+
+// rlimitHelperEnv is set when the current executable is started as the
+// helper that applies resource limits. Its value holds the limits.
+const rlimitHelperEnv = "_MVDAN_SH_RLIMITS"
+
+func init() {
+	if enc, ok := os.LookupEnv(rlimitHelperEnv); ok {
+		rlimitHelper(enc)
+	}
+}
+
+// rlimitCmd makes cmd start its program via a copy of the current
+// executable, which sets the limits on itself and then replaces itself
+// with the program. This way the program is subject to the limits from
+// the start, while those of the current process are left alone, as they
+// are shared by all of its goroutines.
+func rlimitCmd(cmd *exec.Cmd, rlimits map[byte]rlimit) {
+	var encs []string
+	for flag, lim := range rlimits {
+		encs = append(encs, fmt.Sprintf("%c:%d:%d", flag, lim.cur, lim.max))
+	}
+	cmd.Args = append([]string{cmd.Path, cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.Env = append(cmd.Env, rlimitHelperEnv+"="+strings.Join(encs, ","))
+}
+
+// rlimitHelper is run by the helper started via rlimitCmd. The program
+// to run and its arguments follow the helper's own name in os.Args.
+func rlimitHelper(enc string) {
+	os.Unsetenv(rlimitHelperEnv)
+	env := os.Environ()
+	if err := setRlimits(enc); err != nil {
+		fmt.Fprintf(os.Stderr, "could not set resource limits: %v\n", err)
+		os.Exit(126)
+	}
+	err := syscall.Exec(os.Args[1], os.Args[2:], env)
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	os.Exit(126)
+}
+
+// setRlimits sets the limits encoded by rlimitCmd on the current
+// process.
+func setRlimits(enc string) error {
+	for _, field := range strings.Split(enc, ",") {
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 || len(parts[0]) != 1 ||
+			ulimitResourceByFlag(parts[0][0]) == nil {
+			return fmt.Errorf("invalid limit: %q", field)
+		}
+		var lim unix.Rlimit
+		var err error
+		if lim.Cur, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return err
+		}
+		if lim.Max, err = strconv.ParseUint(parts[2], 10, 64); err != nil {
+			return err
+		}
+		if err := unix.Setrlimit(rlimitResource(parts[0][0]), &lim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
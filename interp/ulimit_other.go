@@ -0,0 +1,23 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !linux
+
+package interp
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// errRlimitUnsupported is returned for all resources, as limits are
+// only supported on Linux.
+var errRlimitUnsupported = fmt.Errorf("not supported on %s", runtime.GOOS)
+
+func processRlimit(flag byte) (rlimit, error) {
+	return rlimit{}, errRlimitUnsupported
+}
+
+// rlimitCmd does nothing, as ulimit cannot set any limits here.
+func rlimitCmd(cmd *exec.Cmd, rlimits map[byte]rlimit) {}
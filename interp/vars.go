@@ -139,11 +139,15 @@ func (r *Runner) lookupVar(name string) (Variable, bool) {
 	if val, e := r.cmdVars[name]; e {
 		return Variable{Value: StringVal(val)}, true
 	}
-	if vr, e := r.funcVars[name]; e {
-		return vr, true
+	// functions see the local variables of their callers, as bash
+	// uses dynamic scoping
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if vr, e := r.scopes[i].vars.get(name); e {
+			return vr, vr.Value != nil
+		}
 	}
-	if vr, e := r.Vars[name]; e {
-		return vr, true
+	if vr, e := r.vars.get(name); e {
+		return vr, vr.Value != nil
 	}
 	if str, e := r.Env.Get(name); e {
 		return Variable{Value: StringVal(str)}, true
@@ -154,11 +158,6 @@ func (r *Runner) lookupVar(name string) (Variable, bool) {
 			return Variable{Value: StringVal(str)}, true
 		}
 	}
-	if r.opts[optNoUnset] {
-		r.errf("%s: unbound variable\n", name)
-		r.exit = 1
-		r.lastExit()
-	}
 	return Variable{}, false
 }
 
@@ -174,10 +173,113 @@ func (r *Runner) delVar(name string) {
 		r.exit = 1
 		return
 	}
-	delete(r.Vars, name)
-	delete(r.funcVars, name)
 	delete(r.cmdVars, name)
-	r.Env.Delete(name)
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		vars := &r.scopes[i].vars
+		vr, ok := vars.get(name)
+		if !ok {
+			continue
+		}
+		if i == len(r.scopes)-1 {
+			// a function unsetting its own local variable
+			// keeps it local, shadowing any outer ones
+			vr.Value = nil
+			vars.set(name, vr)
+		} else {
+			// otherwise, the outer variable is revealed
+			vars.delete(name)
+		}
+		return
+	}
+	r.vars.delete(name)
+	if _, ok := r.Env.Get(name); ok {
+		if r.envShared {
+			r.Env = r.Env.Copy()
+			r.envShared = false
+		}
+		r.Env.Delete(name)
+	}
+}
+
+// varScope is the scope in which a variable is set.
+type varScope uint8
+
+const (
+	// scopeVisible is the scope where the variable is visible from,
+	// or the global scope if it isn't set.
+	scopeVisible varScope = iota
+	// scopeLocal is the scope of the function being run.
+	scopeLocal
+	// scopeGlobal is the global scope, even within a function.
+	scopeGlobal
+)
+
+// funcScope holds the local variables of a function call.
+type funcScope struct {
+	vars varStore
+
+	// opts holds the shell options to restore when the function
+	// returns, if "local -" was used.
+	opts []bool
+}
+
+func (r *Runner) pushScope() {
+	r.scopes = append(r.scopes, funcScope{})
+}
+
+func (r *Runner) popScope() {
+	sc := r.scopes[len(r.scopes)-1]
+	r.scopes = r.scopes[:len(r.scopes)-1]
+	if sc.opts != nil {
+		copy(r.opts[:], sc.opts)
+	}
+	if _, ok := sc.vars.get("IFS"); ok {
+		r.ifsUpdated()
+	}
+}
+
+// saveLocalOpts makes the current function restore the shell options
+// when it returns, as done by "local -".
+func (r *Runner) saveLocalOpts() {
+	sc := &r.scopes[len(r.scopes)-1]
+	if sc.opts == nil {
+		sc.opts = append([]bool(nil), r.opts[:len(shellOptsTable)]...)
+	}
+}
+
+// scopeVars returns the variables of the given scope, to which a
+// variable is to be written. local reports whether they belong to a
+// function.
+func (r *Runner) scopeVars(name string, scope varScope) (vars *varStore, local bool) {
+	if len(r.scopes) == 0 || scope == scopeGlobal {
+		return &r.vars, false
+	}
+	if scope == scopeVisible {
+		for i := len(r.scopes) - 1; i >= 0; i-- {
+			if _, ok := r.scopes[i].vars.get(name); ok {
+				return &r.scopes[i].vars, true
+			}
+		}
+		return &r.vars, false
+	}
+	return &r.scopes[len(r.scopes)-1].vars, true
+}
+
+// lookupVarScope is like lookupVar, but only looking at a single scope.
+func (r *Runner) lookupVarScope(name string, scope varScope) (Variable, bool) {
+	if scope == scopeVisible {
+		return r.lookupVar(name)
+	}
+	vars, _ := r.scopeVars(name, scope)
+	if vr, ok := vars.get(name); ok {
+		return vr, vr.Value != nil
+	}
+	if scope == scopeGlobal {
+		if str, ok := r.Env.Get(name); ok {
+			return Variable{Value: StringVal(str)}, true
+		}
+	}
+	return Variable{}, false
 }
 
 // maxNameRefDepth defines the maximum number of times to follow
@@ -216,7 +318,7 @@ func (r *Runner) varInd(vr Variable, e syntax.ArithmExpr, depth int) string {
 			vr, _ = r.lookupVar(string(x))
 			return r.varInd(vr, e, depth+1)
 		}
-		if r.arithm(e) == 0 {
+		if anyOfLit(e, "@", "*") != "" || r.arithm(e) == 0 {
 			return string(x)
 		}
 	case IndexArray:
@@ -226,8 +328,7 @@ func (r *Runner) varInd(vr Variable, e syntax.ArithmExpr, depth int) string {
 		case "*":
 			return strings.Join(x, r.ifsJoin)
 		}
-		i := r.arithm(e)
-		if len(x) > 0 {
+		if i, ok := arrayIndex(r.arithm(e), len(x)); ok {
 			return x[i]
 		}
 	case AssocArray:
@@ -251,39 +352,54 @@ func (r *Runner) varInd(vr Variable, e syntax.ArithmExpr, depth int) string {
 	return ""
 }
 
+// arrayIndex converts an index into a position in an indexed array of
+// the given length. Negative indexes count back from the end of the
+// array. The boolean result reports whether the position is valid.
+func arrayIndex(i int64, length int) (int, bool) {
+	if i < 0 {
+		i += int64(length)
+	}
+	if i < 0 || i >= int64(length) {
+		return 0, false
+	}
+	return int(i), true
+}
+
 func (r *Runner) setVarString(name, val string) {
 	r.setVar(name, nil, Variable{Value: StringVal(val)})
 }
 
-func (r *Runner) setVarInternal(name string, vr Variable) {
-	if _, ok := vr.Value.(StringVal); ok {
+func (r *Runner) setVarInternal(name string, vr Variable, scope varScope) {
+	switch vr.Value.(type) {
+	case StringVal:
 		if r.opts[optAllExport] {
 			vr.Exported = true
 		}
-	} else {
+	case IndexArray, AssocArray:
+		// arrays can't be exported; unset vars keep the attribute
+		// until they're given a value, like in "local x"
 		vr.Exported = false
 	}
-	if vr.Local {
-		if r.funcVars == nil {
-			r.funcVars = make(map[string]Variable)
-		}
-		r.funcVars[name] = vr
-	} else {
-		r.Vars[name] = vr
-	}
+	vars, local := r.scopeVars(name, scope)
+	vr.Local = local
+	vars.set(name, vr)
 	if name == "IFS" {
 		r.ifsUpdated()
 	}
 }
 
 func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr Variable) {
-	cur, _ := r.lookupVar(name)
-	if cur.ReadOnly {
+	r.setVarScope(name, index, vr, scopeVisible)
+}
+
+func (r *Runner) setVarScope(name string, index syntax.ArithmExpr, vr Variable, scope varScope) {
+	if visible, _ := r.lookupVar(name); visible.ReadOnly {
 		r.errf("%s: readonly variable\n", name)
 		r.exit = 1
 		r.lastExit()
 		return
 	}
+	cur, _ := r.lookupVarScope(name, scope)
 	_, isIndexArray := cur.Value.(IndexArray)
 	_, isAssocArray := cur.Value.(AssocArray)
 
@@ -301,7 +417,7 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr Variable) {
 		}
 	}
 	if index == nil {
-		r.setVarInternal(name, vr)
+		r.setVarInternal(name, vr, scope)
 		return
 	}
 
@@ -320,7 +436,7 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr Variable) {
 		k := r.loneWord(w)
 		amap[k] = valStr
 		cur.Value = amap
-		r.setVarInternal(name, cur)
+		r.setVarInternal(name, cur, scope)
 		return
 	}
 	var list IndexArray
@@ -332,12 +448,21 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr Variable) {
 	case AssocArray: // done above
 	}
 	k := r.arithm(index)
-	for len(list) < k+1 {
+	if k < 0 {
+		i, ok := arrayIndex(k, len(list))
+		if !ok {
+			r.errf("%s: bad array subscript\n", name)
+			r.exit = 1
+			return
+		}
+		k = int64(i)
+	}
+	for int64(len(list)) < k+1 {
 		list = append(list, "")
 	}
 	list[k] = valStr
 	cur.Value = list
-	r.setVarInternal(name, cur)
+	r.setVarInternal(name, cur, scope)
 }
 
 func (r *Runner) setFunc(name string, body *syntax.Stmt) {
@@ -384,7 +509,8 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) VarValue {
 		return StringVal(s)
 	}
 	if as.Array == nil {
-		return nil
+		// don't return nil, as that means an unset variable
+		return StringVal("")
 	}
 	elems := as.Array.Elems
 	if valType == "" {
@@ -415,7 +541,7 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) VarValue {
 			indexes[i] = i
 			continue
 		}
-		k := r.arithm(elem.Index)
+		k := int(r.arithm(elem.Index))
 		indexes[i] = k
 		if k > maxIndex {
 			maxIndex = k
@@ -457,16 +583,143 @@ func (r *Runner) ifsUpdated() {
 }
 
 func (r *Runner) namesByPrefix(prefix string) []string {
+	// the same name may be set in many scopes
+	seen := make(map[string]bool)
 	var names []string
-	for _, name := range r.Env.Names() {
-		if strings.HasPrefix(name, prefix) {
+	add := func(name string, _ Variable) {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			seen[name] = true
 			names = append(names, name)
 		}
 	}
-	for name := range r.Vars {
-		if strings.HasPrefix(name, prefix) {
-			names = append(names, name)
-		}
+	for _, name := range r.Env.Names() {
+		add(name, Variable{})
+	}
+	r.vars.each(add)
+	for _, sc := range r.scopes {
+		sc.vars.each(add)
 	}
+	sort.Strings(names)
 	return names
 }
+
+// varStore holds a set of variables, such as the global ones. Copying
+// it for a subshell is cheap, as the variables are kept in layers which
+// are shared between the copies and never modified. Only the top layer,
+// which belongs to a single store, is written to.
+type varStore struct {
+	layers []map[string]Variable // oldest first
+	top    map[string]Variable
+}
+
+// unsetVal is the value of a variable deleted from a store while its
+// layers still hold it.
+type unsetVal struct{}
+
+// maxVarLayers is the number of layers a store may have before they
+// are merged, so that lookups in deeply nested subshells stay fast.
+const maxVarLayers = 8
+
+func (s *varStore) get(name string) (Variable, bool) {
+	if vr, ok := s.top[name]; ok {
+		_, unset := vr.Value.(unsetVal)
+		return vr, !unset
+	}
+	for i := len(s.layers) - 1; i >= 0; i-- {
+		if vr, ok := s.layers[i][name]; ok {
+			_, unset := vr.Value.(unsetVal)
+			return vr, !unset
+		}
+	}
+	return Variable{}, false
+}
+
+func (s *varStore) set(name string, vr Variable) {
+	if s.top == nil {
+		s.top = make(map[string]Variable)
+	}
+	s.top[name] = vr
+}
+
+func (s *varStore) delete(name string) {
+	if len(s.layers) == 0 {
+		delete(s.top, name)
+		return
+	}
+	s.set(name, Variable{Value: unsetVal{}})
+}
+
+// each calls fn for every variable in the store, newest layers first.
+func (s *varStore) each(fn func(name string, vr Variable)) {
+	if len(s.layers) == 0 {
+		for name, vr := range s.top {
+			fn(name, vr)
+		}
+		return
+	}
+	seen := make(map[string]bool)
+	visit := func(vars map[string]Variable) {
+		for name, vr := range vars {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if _, unset := vr.Value.(unsetVal); !unset {
+				fn(name, vr)
+			}
+		}
+	}
+	visit(s.top)
+	for i := len(s.layers) - 1; i >= 0; i-- {
+		visit(s.layers[i])
+	}
+}
+
+// fork returns a copy of the store. The variables set so far become a
+// new shared layer, so neither store needs to copy them.
+func (s *varStore) fork() varStore {
+	if len(s.top) > 0 {
+		// never append in place, as the layers may be shared
+		n := len(s.layers)
+		s.layers = append(s.layers[:n:n], s.top)
+		s.top = nil
+		s.compact()
+	}
+	return varStore{layers: s.layers}
+}
+
+func (s *varStore) compact() {
+	if len(s.layers) <= maxVarLayers {
+		return
+	}
+	// the bottom layer tends to hold most variables, so try to
+	// only merge the ones above it
+	base := s.layers[0]
+	upper := make(map[string]Variable)
+	for _, vars := range s.layers[1:] {
+		for name, vr := range vars {
+			upper[name] = vr
+		}
+	}
+	if len(upper) < len(base)/2 {
+		s.layers = []map[string]Variable{base, upper}
+		return
+	}
+	s.layers = []map[string]Variable{s.flatten()}
+}
+
+// flatten returns all the variables in the store as a single map. If
+// the store has no shared layers, the map is its top layer.
+func (s *varStore) flatten() map[string]Variable {
+	if len(s.layers) == 0 {
+		if s.top == nil {
+			s.top = make(map[string]Variable)
+		}
+		return s.top
+	}
+	vars := make(map[string]Variable)
+	s.each(func(name string, vr Variable) {
+		vars[name] = vr
+	})
+	return vars
+}
@@ -0,0 +1,497 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ApplyFunc is called by Apply for each node, with a Cursor describing the
+// node and where it is in the syntax tree.
+type ApplyFunc func(*Cursor) bool
+
+// Apply traverses a syntax tree recursively, starting with root, and calling
+// pre and post for each non-nil node. Either function can be nil.
+//
+// pre is called for each node before its children are traversed. If it
+// returns false, the children are skipped, and post is not called for the
+// node. post is called for each node after its children are traversed. If it
+// returns false, Apply stops the traversal altogether.
+//
+// The Cursor passed to both functions can be used to modify the tree while it
+// is being traversed. The new nodes are not traversed by Apply. If a node is
+// replaced or deleted by pre, its old children are not traversed either.
+//
+// The children of a node are traversed in the order of its fields. Apply
+// returns the root node, which might have been replaced.
+func Apply(root Node, pre, post ApplyFunc) Node {
+	return applyTree(root, pre, post, nil)
+}
+
+// DeletedLines records the lines of the statements and comments deleted via
+// Cursor.Delete. A Printer given the record via SkipDeleted does not leave
+// empty lines in their place, unless there were empty lines around them.
+//
+// The zero value is an empty record, ready to use.
+type DeletedLines struct {
+	// stmts holds the lines deleted next to each remaining statement.
+	stmts map[*Stmt]lineRange
+}
+
+// lineRange is a range of lines, including both ends. It is empty if from
+// is zero.
+type lineRange struct{ from, to uint }
+
+// Apply is like the Apply function, but it also records in d the lines of
+// the nodes deleted via Cursor.Delete.
+func (d *DeletedLines) Apply(root Node, pre, post ApplyFunc) Node {
+	return applyTree(root, pre, post, d)
+}
+
+// lines returns the range of lines deleted next to s, if any.
+func (d *DeletedLines) lines(s *Stmt) lineRange {
+	if d == nil {
+		return lineRange{}
+	}
+	return d.stmts[s]
+}
+
+// add adds a range of deleted lines next to s. If the ranges are not
+// contiguous, only the first one is kept, as any empty line between them
+// must stay anyway.
+func (d *DeletedLines) add(s *Stmt, from, to uint) {
+	if d.stmts == nil {
+		d.stmts = make(map[*Stmt]lineRange)
+	}
+	r := d.stmts[s]
+	switch {
+	case r.from == 0, to+1 < r.from:
+		r = lineRange{from, to}
+	case from <= r.to+1:
+		if from < r.from {
+			r.from = from
+		}
+		if to > r.to {
+			r.to = to
+		}
+	}
+	d.stmts[s] = r
+}
+
+func applyTree(root Node, pre, post ApplyFunc, deleted *DeletedLines) (result Node) {
+	parent := &applyRoot{root}
+	defer func() {
+		if r := recover(); r != nil && r != abortApply {
+			panic(r)
+		}
+		result = parent.Node
+	}()
+	a := &application{pre: pre, post: post, deleted: deleted}
+	a.apply(parent, "Node", nil, root)
+	return parent.Node
+}
+
+var abortApply = new(int)
+
+// applyRoot holds the root node of Apply, so that it can be replaced like any
+// other node.
+type applyRoot struct{ Node }
+
+// A Cursor describes a node found by Apply. It can be used to get
+// information about the node, and to modify the syntax tree around it.
+type Cursor struct {
+	parent  Node
+	name    string
+	iter    *applyIter
+	node    Node
+	deleted *DeletedLines
+}
+
+type applyIter struct {
+	list        reflect.Value
+	index, step int
+}
+
+// Node returns the current node.
+func (c *Cursor) Node() Node { return c.node }
+
+// Parent returns the parent of the current node, or nil if the current node
+// is the root.
+func (c *Cursor) Parent() Node {
+	if _, ok := c.parent.(*applyRoot); ok {
+		return nil
+	}
+	return c.parent
+}
+
+// Name returns the name of the parent's field that holds the current node,
+// such as "Cmd" or "Args". Statements and comments in a StmtList use the name
+// of the list's field, if it is not embedded, such as "Then.Stmts".
+//
+// If the current node is the root, the name is "Node".
+func (c *Cursor) Name() string { return c.name }
+
+// Index returns the index of the current node in the parent's field, if the
+// field is a slice. Otherwise, it returns -1.
+func (c *Cursor) Index() int {
+	if c.iter == nil {
+		return -1
+	}
+	return c.iter.index
+}
+
+// field returns the parent's field holding the current node.
+func (c *Cursor) field() reflect.Value {
+	if c.iter != nil {
+		return c.iter.list
+	}
+	return fieldByName(c.parent, c.name)
+}
+
+func fieldByName(node Node, name string) reflect.Value {
+	v := reflect.ValueOf(node)
+	for _, name := range strings.Split(name, ".") {
+		if v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		v = v.FieldByName(name)
+	}
+	return v
+}
+
+// nodeValue returns the value of n to be stored in a field of type t. Nodes
+// such as comments are not stored as pointers.
+func nodeValue(fn string, n Node, t reflect.Type) reflect.Value {
+	v := reflect.ValueOf(n)
+	if t.Kind() == reflect.Struct && v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if !v.Type().AssignableTo(t) {
+		panic(fmt.Sprintf("syntax.Cursor.%s: cannot use %T as %s", fn, n, t))
+	}
+	return v
+}
+
+// Replace replaces the current node with n.
+//
+// If both nodes are statements and n has no comments, the comments of the
+// current statement are moved to n. If n is a new statement without a
+// position, Printer prints all of its comments in the lines before it.
+func (c *Cursor) Replace(n Node) {
+	if c.node == nil {
+		panic("syntax.Cursor.Replace: node was deleted")
+	}
+	if old, ok := c.node.(*Stmt); ok {
+		if s, ok := n.(*Stmt); ok && len(s.Comments) == 0 {
+			s.Comments, old.Comments = old.Comments, nil
+		}
+	}
+	v := c.field()
+	if i := c.Index(); i >= 0 {
+		v = v.Index(i)
+	}
+	v.Set(nodeValue("Replace", n, v.Type()))
+	c.node = n
+}
+
+// Delete deletes the current node from the slice that contains it, such as a
+// statement from a StmtList. It panics if the node is not part of a slice.
+//
+// The comments attached to a deleted statement are deleted too. If the tree is
+// traversed via DeletedLines.Apply, the lines of the deleted statements and
+// leading comments are recorded, so that Printer can skip them.
+func (c *Cursor) Delete() {
+	if c.node == nil {
+		panic("syntax.Cursor.Delete: node was deleted")
+	}
+	i := c.Index()
+	if i < 0 {
+		panic("syntax.Cursor.Delete: node is not part of a slice")
+	}
+	v := c.field()
+	l := v.Len()
+	c.markDeleted(v, i)
+	reflect.Copy(v.Slice(i, l), v.Slice(i+1, l))
+	v.Index(l - 1).Set(reflect.Zero(v.Type().Elem()))
+	v.SetLen(l - 1)
+	c.iter.step--
+	c.node = nil
+}
+
+// markDeleted records the lines of the current node, which is about to be
+// deleted from list at index i, next to the statement that follows it. If
+// there is none, they are recorded next to the statement before it.
+func (c *Cursor) markDeleted(list reflect.Value, i int) {
+	d := c.deleted
+	if d == nil {
+		return
+	}
+	switch x := c.node.(type) {
+	case *Stmt:
+		j := i + 1
+		if j >= list.Len() {
+			j = i - 1
+		}
+		if j < 0 {
+			return
+		}
+		other, ok := list.Index(j).Interface().(*Stmt)
+		if !ok {
+			return
+		}
+		own := d.lines(x)
+		delete(d.stmts, x)
+		if !x.Pos().IsValid() {
+			if own.from > 0 {
+				d.add(other, own.from, own.to)
+			}
+			return
+		}
+		from, to := x.Pos().Line(), x.End().Line()
+		for _, com := range x.Comments {
+			if l := com.Pos().Line(); l < from {
+				from = l
+			}
+			if l := com.End().Line(); l > to {
+				to = l
+			}
+		}
+		for _, r := range x.Redirs {
+			if r.Hdoc != nil && r.Hdoc.End().Line() > to {
+				to = r.Hdoc.End().Line()
+			}
+		}
+		switch {
+		case own.from == 0:
+		case j < i:
+			// nothing follows, so any empty lines between
+			// the deleted lines can go too
+			from = own.from
+		default:
+			d.add(other, own.from, own.to)
+		}
+		d.add(other, from, to)
+	case *Comment:
+		// only leading comments, as the others share a line with
+		// their statement
+		if s, ok := c.parent.(*Stmt); ok && x.Pos().IsValid() &&
+			s.Pos().After(x.Pos()) {
+			d.add(s, x.Pos().Line(), x.End().Line())
+		}
+	}
+}
+
+// InsertAfter inserts n after the current node, in the slice that contains
+// it. If the node was deleted, n is inserted where it was. It panics if the
+// node is not part of a slice.
+func (c *Cursor) InsertAfter(n Node) {
+	i := c.Index()
+	if i < 0 {
+		panic("syntax.Cursor.InsertAfter: node is not part of a slice")
+	}
+	if c.node != nil {
+		i++
+	}
+	c.insert("InsertAfter", i, n)
+	c.iter.step++
+}
+
+// InsertBefore inserts n before the current node, in the slice that contains
+// it. It panics if the node is not part of a slice.
+func (c *Cursor) InsertBefore(n Node) {
+	i := c.Index()
+	if i < 0 {
+		panic("syntax.Cursor.InsertBefore: node is not part of a slice")
+	}
+	c.insert("InsertBefore", i, n)
+	c.iter.index++
+}
+
+func (c *Cursor) insert(fn string, i int, n Node) {
+	v := c.field()
+	elem := nodeValue(fn, n, v.Type().Elem())
+	v.Set(reflect.Append(v, reflect.Zero(elem.Type())))
+	reflect.Copy(v.Slice(i+1, v.Len()), v.Slice(i, v.Len()))
+	v.Index(i).Set(elem)
+}
+
+type application struct {
+	pre, post ApplyFunc
+	cursor    Cursor
+	deleted   *DeletedLines
+}
+
+func (a *application) apply(parent Node, name string, iter *applyIter, n Node) {
+	saved := a.cursor
+	a.cursor = Cursor{parent: parent, name: name, iter: iter, node: n,
+		deleted: a.deleted}
+	defer func() { a.cursor = saved }()
+	if a.pre != nil && (!a.pre(&a.cursor) || a.cursor.node != n) {
+		if a.cursor.node == nil || a.cursor.node == n || a.post == nil {
+			return
+		}
+		// replaced by pre; don't traverse the new node
+	} else {
+		a.children(n)
+	}
+	if a.post != nil && a.cursor.node != nil && !a.post(&a.cursor) {
+		panic(abortApply)
+	}
+}
+
+// applyNode applies to the node held in a field, if it is not nil.
+func (a *application) applyNode(parent Node, name string, n Node) {
+	if n == nil || reflect.ValueOf(n).IsNil() {
+		return
+	}
+	a.apply(parent, name, nil, n)
+}
+
+// applyList applies to each of the nodes in a slice field. The slice is
+// obtained via reflection, so that the cursor can modify it.
+func (a *application) applyList(parent Node, name string) {
+	iter := &applyIter{list: fieldByName(parent, name)}
+	for iter.index < iter.list.Len() {
+		v := iter.list.Index(iter.index)
+		if v.Kind() == reflect.Struct {
+			v = v.Addr()
+		}
+		iter.step = 1
+		a.apply(parent, name, iter, v.Interface().(Node))
+		iter.index += iter.step
+	}
+}
+
+func (a *application) applyStmts(parent Node, prefix string) {
+	a.applyList(parent, prefix+"Stmts")
+	a.applyList(parent, prefix+"Last")
+}
+
+func (a *application) children(node Node) {
+	switch x := node.(type) {
+	case *File:
+		a.applyStmts(x, "")
+	case *Comment:
+	case *Stmt:
+		a.applyList(x, "Comments")
+		a.applyNode(x, "Cmd", x.Cmd)
+		a.applyList(x, "Redirs")
+	case *Assign:
+		a.applyNode(x, "Name", x.Name)
+		a.applyNode(x, "Value", x.Value)
+		a.applyNode(x, "Index", x.Index)
+		a.applyNode(x, "Array", x.Array)
+	case *Redirect:
+		a.applyNode(x, "N", x.N)
+		a.applyNode(x, "Word", x.Word)
+		a.applyNode(x, "Hdoc", x.Hdoc)
+	case *CallExpr:
+		a.applyList(x, "Assigns")
+		a.applyList(x, "Args")
+	case *Subshell:
+		a.applyStmts(x, "")
+	case *Block:
+		a.applyStmts(x, "")
+	case *IfClause:
+		a.applyStmts(x, "Cond.")
+		a.applyStmts(x, "Then.")
+		a.applyStmts(x, "Else.")
+	case *WhileClause:
+		a.applyStmts(x, "Cond.")
+		a.applyStmts(x, "Do.")
+	case *ForClause:
+		a.applyNode(x, "Loop", x.Loop)
+		a.applyStmts(x, "Do.")
+	case *WordIter:
+		a.applyNode(x, "Name", x.Name)
+		a.applyList(x, "Items")
+	case *CStyleLoop:
+		a.applyNode(x, "Init", x.Init)
+		a.applyNode(x, "Cond", x.Cond)
+		a.applyNode(x, "Post", x.Post)
+	case *BinaryCmd:
+		a.applyNode(x, "X", x.X)
+		a.applyNode(x, "Y", x.Y)
+	case *FuncDecl:
+		a.applyNode(x, "Name", x.Name)
+		a.applyNode(x, "Body", x.Body)
+	case *Word:
+		a.applyList(x, "Parts")
+	case *Lit:
+	case *SglQuoted:
+	case *DblQuoted:
+		a.applyList(x, "Parts")
+	case *CmdSubst:
+		a.applyStmts(x, "")
+	case *ParamExp:
+		a.applyNode(x, "Param", x.Param)
+		a.applyNode(x, "Index", x.Index)
+		if x.Slice != nil {
+			a.applyNode(x, "Slice.Offset", x.Slice.Offset)
+			a.applyNode(x, "Slice.Length", x.Slice.Length)
+		}
+		if x.Repl != nil {
+			a.applyNode(x, "Repl.Orig", x.Repl.Orig)
+			a.applyNode(x, "Repl.With", x.Repl.With)
+		}
+		if x.Exp != nil {
+			a.applyNode(x, "Exp.Word", x.Exp.Word)
+		}
+	case *ArithmExp:
+		a.applyNode(x, "X", x.X)
+	case *ArithmCmd:
+		a.applyNode(x, "X", x.X)
+	case *BinaryArithm:
+		a.applyNode(x, "X", x.X)
+		a.applyNode(x, "Y", x.Y)
+	case *BinaryTest:
+		a.applyNode(x, "X", x.X)
+		a.applyNode(x, "Y", x.Y)
+	case *UnaryArithm:
+		a.applyNode(x, "X", x.X)
+	case *UnaryTest:
+		a.applyNode(x, "X", x.X)
+	case *ParenArithm:
+		a.applyNode(x, "X", x.X)
+	case *ParenTest:
+		a.applyNode(x, "X", x.X)
+	case *CaseClause:
+		a.applyNode(x, "Word", x.Word)
+		a.applyList(x, "Items")
+		a.applyList(x, "Last")
+	case *CaseItem:
+		a.applyList(x, "Comments")
+		a.applyList(x, "Patterns")
+		a.applyStmts(x, "")
+	case *TestClause:
+		a.applyNode(x, "X", x.X)
+	case *DeclClause:
+		a.applyNode(x, "Variant", x.Variant)
+		a.applyList(x, "Opts")
+		a.applyList(x, "Assigns")
+	case *ArrayExpr:
+		a.applyList(x, "Elems")
+		a.applyList(x, "Last")
+	case *ArrayElem:
+		a.applyList(x, "Comments")
+		a.applyNode(x, "Index", x.Index)
+		a.applyNode(x, "Value", x.Value)
+	case *ExtGlob:
+		a.applyNode(x, "Pattern", x.Pattern)
+	case *ProcSubst:
+		a.applyStmts(x, "")
+	case *TimeClause:
+		a.applyNode(x, "Stmt", x.Stmt)
+	case *CoprocClause:
+		a.applyNode(x, "Name", x.Name)
+		a.applyNode(x, "Stmt", x.Stmt)
+	case *LetClause:
+		a.applyList(x, "Exprs")
+	case *BadCmd:
+	default:
+		panic(fmt.Sprintf("syntax.Apply: unexpected node type %T", x))
+	}
+}
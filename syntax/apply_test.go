@@ -0,0 +1,483 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestApplyWalk(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	var allStrs []string
+	for _, c := range fileTests {
+		allStrs = append(allStrs, c.Strs[0])
+	}
+	for _, c := range printTests {
+		allStrs = append(allStrs, c.in)
+	}
+	nodeStr := func(node Node) string {
+		return fmt.Sprintf("%T %s %s", node, node.Pos(), node.End())
+	}
+	for i, in := range allStrs {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := parser.Parse(strings.NewReader(in), "")
+			if err != nil {
+				return
+			}
+			var walked, pre, post []string
+			// Walk skips some comments, and visits others after
+			// their statement
+			Walk(prog, func(node Node) bool {
+				if _, ok := node.(*Comment); !ok && node != nil {
+					walked = append(walked, nodeStr(node))
+				}
+				return true
+			})
+			Apply(prog, func(c *Cursor) bool {
+				if _, ok := c.Node().(*Comment); !ok {
+					pre = append(pre, nodeStr(c.Node()))
+				}
+				return true
+			}, func(c *Cursor) bool {
+				if _, ok := c.Node().(*Comment); !ok {
+					post = append(post, nodeStr(c.Node()))
+				}
+				return true
+			})
+			sort.Strings(walked)
+			sort.Strings(pre)
+			sort.Strings(post)
+			if !reflect.DeepEqual(pre, walked) {
+				t.Fatalf("Apply pre mismatch in %q\nwant: %q\ngot:  %q",
+					in, walked, pre)
+			}
+			if !reflect.DeepEqual(post, walked) {
+				t.Fatalf("Apply post mismatch in %q\nwant: %q\ngot:  %q",
+					in, walked, post)
+			}
+		})
+	}
+}
+
+// callName returns the first word of a simple command, if it is a
+// literal.
+func callName(node Node) string {
+	s, ok := node.(*Stmt)
+	if !ok {
+		return ""
+	}
+	call, ok := s.Cmd.(*CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return ""
+	}
+	lit, ok := call.Args[0].Parts[0].(*Lit)
+	if !ok {
+		return ""
+	}
+	return lit.Value
+}
+
+var applyTests = []struct {
+	in, want string
+	pre      ApplyFunc
+}{
+	{
+		"foo\nrm a\nbar\nrm b",
+		"foo\nbar",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "rm" {
+				c.Delete()
+			}
+			return true
+		},
+	},
+	{
+		"if foo; then\n\trm a\n\tbar\nfi\n{ rm b; baz; }",
+		"if foo; then\n\tbar\nfi\n{ baz; }",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "rm" {
+				c.Delete()
+			}
+			return true
+		},
+	},
+	{
+		"foo a b a",
+		"foo c b c",
+		func(c *Cursor) bool {
+			if lit, ok := c.Node().(*Lit); ok && lit.Value == "a" {
+				c.Replace(&Lit{Value: "c"})
+			}
+			return true
+		},
+	},
+	{
+		"foo\nbar\n\nbaz",
+		"foo\nnew1\nbar\nnew2\n\nbaz",
+		func(c *Cursor) bool {
+			switch callName(c.Node()) {
+			case "bar":
+				c.InsertBefore(litStmt("new1"))
+				c.InsertAfter(litStmt("new2"))
+			}
+			return true
+		},
+	},
+	{
+		"foo\nbar",
+		"x_foo\nx_bar",
+		func(c *Cursor) bool {
+			// inserted statements are not traversed
+			if name := callName(c.Node()); name != "" {
+				c.InsertBefore(litStmt("x_" + name))
+				c.Delete()
+			}
+			return true
+		},
+	},
+	{
+		"{ foo; }",
+		"{ bar; }",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "foo" {
+				c.Replace(litStmt("bar"))
+			}
+			return true
+		},
+	},
+	{
+		"# lead\nfoo # end\nbar",
+		"# lead\n# end\nnew\nbar",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "foo" {
+				c.Replace(litStmt("new"))
+			}
+			return true
+		},
+	},
+	{
+		"foo # foo\n# bar\nbar\nbaz",
+		"foo # foo\nbaz",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "bar" {
+				c.Delete()
+			}
+			return true
+		},
+	},
+	{
+		"foo # foo\n# bar\nbar",
+		"foo # foo\nnew\n# bar\nbar",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "bar" {
+				c.InsertBefore(litStmt("new"))
+			}
+			return true
+		},
+	},
+	{
+		"foo\nrm a\n\nrm b\nbar\n\nbaz\nrm c",
+		"foo\n\nbar\n\nbaz",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "rm" {
+				c.Delete()
+			}
+			return true
+		},
+	},
+	{
+		"f() {\n\tfoo\n\trm a\n\n\trm b <<EOF\nx\nEOF\n}",
+		"f() {\n\tfoo\n}",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "rm" {
+				c.Delete()
+			}
+			return true
+		},
+	},
+	{
+		"foo\n# doc bar\nbar",
+		"foo\n# new\nnew\n# doc bar\nbar",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "foo" {
+				s := litStmt("new")
+				s.Comments = []Comment{{Text: " new"}}
+				c.InsertAfter(s)
+			}
+			return true
+		},
+	},
+	{
+		"# lead\nfoo",
+		"new0\n# lead\nfoo",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "foo" {
+				c.InsertBefore(litStmt("new0"))
+			}
+			return true
+		},
+	},
+	{
+		"foo; bar # bar\nbaz",
+		"foo\nnew\nbar # bar\nbaz",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "bar" {
+				c.InsertBefore(litStmt("new"))
+			}
+			return true
+		},
+	},
+	{
+		"foo && bar",
+		"foo && new",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "bar" {
+				c.Replace(litStmt("new"))
+			}
+			return true
+		},
+	},
+	{
+		"foo $(bar) \"$(bar)\"",
+		"foo $(new) \"$(new)\"",
+		func(c *Cursor) bool {
+			if callName(c.Node()) == "bar" {
+				c.Replace(litStmt("new"))
+			}
+			return true
+		},
+	},
+	{
+		"# foo\nfoo\n# bar\nbar",
+		"# foo\nfoo\nbar",
+		func(c *Cursor) bool {
+			if com, ok := c.Node().(*Comment); ok && com.Text == " bar" {
+				c.Delete()
+			}
+			return true
+		},
+	},
+	{
+		"foo\nif bar; then baz; fi",
+		"foo\nif bar; then baz; fi",
+		func(c *Cursor) bool {
+			// children are skipped
+			if _, ok := c.Node().(*IfClause); ok {
+				return false
+			}
+			if callName(c.Node()) == "baz" {
+				c.Delete()
+			}
+			return true
+		},
+	},
+}
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	for i, tc := range applyTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var deleted DeletedLines
+			if got := deleted.Apply(prog, tc.pre, nil); got != prog {
+				t.Fatalf("Apply returned a different root: %#v", got)
+			}
+			var buf bytes.Buffer
+			NewPrinter(SkipDeleted(&deleted)).Print(&buf, prog)
+			want := tc.want + "\n"
+			if got := buf.String(); got != want {
+				t.Fatalf("Apply mismatch of %q\nwant: %q\ngot:  %q",
+					tc.in, want, got)
+			}
+		})
+	}
+}
+
+func TestApplyDeleteInsert(t *testing.T) {
+	t.Parallel()
+	prog, err := NewParser().Parse(strings.NewReader("a\nb\nc"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var visited []string
+	var deleted DeletedLines
+	deleted.Apply(prog, func(c *Cursor) bool {
+		switch name := callName(c.Node()); name {
+		case "":
+		case "a":
+			visited = append(visited, name)
+			c.Delete()
+			c.InsertAfter(litStmt("x"))
+		case "b":
+			visited = append(visited, name)
+			c.Delete()
+			c.InsertBefore(litStmt("y"))
+			c.InsertAfter(litStmt("z"))
+		default:
+			visited = append(visited, name)
+		}
+		return true
+	}, nil)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(visited, want) {
+		t.Fatalf("visited %q, want %q", visited, want)
+	}
+	var buf bytes.Buffer
+	NewPrinter(SkipDeleted(&deleted)).Print(&buf, prog)
+	if got, want := buf.String(), "x\ny\nz\nc\n"; got != want {
+		t.Fatalf("Apply mismatch\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestApplyCursor(t *testing.T) {
+	t.Parallel()
+	in := "foo a\nif bar; then baz; fi"
+	prog, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	Apply(prog, func(c *Cursor) bool {
+		switch c.Node().(type) {
+		case *Stmt, *Word:
+			got = append(got, fmt.Sprintf("%T %s %d",
+				c.Parent(), c.Name(), c.Index()))
+		case *File:
+			if c.Parent() != nil {
+				t.Errorf("root has a parent: %#v", c.Parent())
+			}
+			got = append(got, fmt.Sprintf("root %s %d",
+				c.Name(), c.Index()))
+		}
+		return true
+	}, nil)
+	want := []string{
+		"root Node -1",
+		"*syntax.File Stmts 0",
+		"*syntax.CallExpr Args 0",
+		"*syntax.CallExpr Args 1",
+		"*syntax.File Stmts 1",
+		"*syntax.IfClause Cond.Stmts 0",
+		"*syntax.CallExpr Args 0",
+		"*syntax.IfClause Then.Stmts 0",
+		"*syntax.CallExpr Args 0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Cursor mismatch\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestApplyReplaceRoot(t *testing.T) {
+	t.Parallel()
+	word := litWord("foo")
+	want := litWord("bar")
+	got := Apply(word, nil, func(c *Cursor) bool {
+		if c.Node() == word {
+			c.Replace(want)
+		}
+		return true
+	})
+	if got != want {
+		t.Fatalf("Apply did not replace the root: %#v", got)
+	}
+}
+
+func TestApplyStop(t *testing.T) {
+	t.Parallel()
+	prog, err := NewParser().Parse(strings.NewReader("foo; bar; baz"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	Apply(prog, nil, func(c *Cursor) bool {
+		if name := callName(c.Node()); name != "" {
+			names = append(names, name)
+			return name != "bar"
+		}
+		return true
+	})
+	if want := []string{"foo", "bar"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("post was called for %q, want %q", names, want)
+	}
+}
+
+func TestApplyPanic(t *testing.T) {
+	t.Parallel()
+	tests := []ApplyFunc{
+		func(c *Cursor) bool {
+			if _, ok := c.Node().(*CallExpr); ok {
+				c.Delete()
+			}
+			return true
+		},
+		func(c *Cursor) bool {
+			if _, ok := c.Node().(*CallExpr); ok {
+				c.InsertAfter(litStmt("bar"))
+			}
+			return true
+		},
+		func(c *Cursor) bool {
+			if _, ok := c.Node().(*Word); ok {
+				c.Replace(litStmt("bar"))
+			}
+			return true
+		},
+		func(c *Cursor) bool {
+			if _, ok := c.Node().(*Stmt); ok {
+				c.InsertBefore(litWord("bar"))
+			}
+			return true
+		},
+		func(c *Cursor) bool {
+			if _, ok := c.Node().(*Stmt); ok {
+				c.Delete()
+				c.Replace(litStmt("bar"))
+			}
+			return true
+		},
+		func(c *Cursor) bool {
+			if _, ok := c.Node().(*Stmt); ok {
+				c.Delete()
+				c.Delete()
+			}
+			return true
+		},
+	}
+	for i, pre := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := NewParser().Parse(strings.NewReader("foo"), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				r := recover()
+				if r == nil {
+					t.Errorf("did not panic")
+				} else if s, _ := r.(string); !strings.HasPrefix(s, "syntax.") {
+					t.Errorf("unexpected panic: %v", r)
+				}
+			}()
+			Apply(prog, pre, nil)
+		})
+	}
+}
+
+func TestApplyUnexpectedType(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("did not panic")
+		}
+	}()
+	Apply(newNode{}, nil, nil)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import "reflect"
+
+// Clone returns a deep copy of a syntax tree. The copy shares no nodes with
+// the original, so either can be modified without affecting the other.
+// Positions, comments and heredoc bodies are copied too.
+func Clone(node Node) Node {
+	if node == nil {
+		return nil
+	}
+	return cloneValue(reflect.ValueOf(node)).Interface().(Node)
+}
+
+func cloneValue(x reflect.Value) reflect.Value {
+	switch x.Kind() {
+	case reflect.Interface:
+		if x.IsNil() {
+			return x
+		}
+		y := reflect.New(x.Type()).Elem()
+		y.Set(cloneValue(x.Elem()))
+		return y
+	case reflect.Ptr:
+		if x.IsNil() {
+			return x
+		}
+		y := reflect.New(x.Type().Elem())
+		y.Elem().Set(cloneValue(x.Elem()))
+		return y
+	case reflect.Slice:
+		if x.IsNil() {
+			return x
+		}
+		y := reflect.MakeSlice(x.Type(), x.Len(), x.Len())
+		for i := 0; i < x.Len(); i++ {
+			y.Index(i).Set(cloneValue(x.Index(i)))
+		}
+		return y
+	case reflect.Struct:
+		// copies unexported fields like the ones in Pos
+		y := reflect.New(x.Type()).Elem()
+		y.Set(x)
+		for i := 0; i < x.NumField(); i++ {
+			if f := y.Field(i); f.CanSet() {
+				f.Set(cloneValue(x.Field(i)))
+			}
+		}
+		return y
+	}
+	return x
+}
+
+// An EqualOption changes the way Equal compares syntax trees.
+type EqualOption func(*equaler)
+
+// IgnorePositions makes Equal ignore the positions of the nodes, such that
+// the same program formatted in different ways is considered equal.
+func IgnorePositions(e *equaler) { e.ignorePos = true }
+
+// IgnoreComments makes Equal ignore the comments attached to the nodes.
+// Comment nodes are still compared if they are given directly to Equal.
+func IgnoreComments(e *equaler) { e.ignoreComments = true }
+
+type equaler struct {
+	ignorePos      bool
+	ignoreComments bool
+}
+
+var (
+	posType      = reflect.TypeOf(Pos{})
+	commentsType = reflect.TypeOf([]Comment(nil))
+)
+
+// Equal reports whether two syntax trees are structurally equal. That is,
+// whether they have the same node types, with the same field values. Nil and
+// empty lists are considered equal.
+//
+// By default, positions and comments are compared too. Use the options to
+// ignore them.
+func Equal(x, y Node, opts ...EqualOption) bool {
+	var e equaler
+	for _, opt := range opts {
+		opt(&e)
+	}
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	return e.equal(reflect.ValueOf(x), reflect.ValueOf(y))
+}
+
+func (e *equaler) equal(x, y reflect.Value) bool {
+	if x.Type() != y.Type() {
+		return false
+	}
+	switch x.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if x.IsNil() || y.IsNil() {
+			return x.IsNil() == y.IsNil()
+		}
+		return e.equal(x.Elem(), y.Elem())
+	case reflect.Slice:
+		if e.ignoreComments && x.Type() == commentsType {
+			return true
+		}
+		if x.Len() != y.Len() {
+			return false
+		}
+		for i := 0; i < x.Len(); i++ {
+			if !e.equal(x.Index(i), y.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		if x.Type() == posType {
+			return e.ignorePos || x.Interface() == y.Interface()
+		}
+		for i := 0; i < x.NumField(); i++ {
+			if !e.equal(x.Field(i), y.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.String:
+		return x.String() == y.String()
+	case reflect.Bool:
+		return x.Bool() == y.Bool()
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint, reflect.Uint64:
+		return x.Uint() == y.Uint()
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int, reflect.Int64:
+		return x.Int() == y.Int()
+	}
+	panic("syntax.Equal: unexpected kind " + x.Kind().String())
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nodePointers adds all the pointers found in a syntax tree to ptrs.
+func nodePointers(x reflect.Value, ptrs map[uintptr]bool) {
+	switch x.Kind() {
+	case reflect.Interface:
+		if !x.IsNil() {
+			nodePointers(x.Elem(), ptrs)
+		}
+	case reflect.Ptr:
+		if !x.IsNil() {
+			ptrs[x.Pointer()] = true
+			nodePointers(x.Elem(), ptrs)
+		}
+	case reflect.Slice:
+		if x.Len() > 0 {
+			ptrs[x.Pointer()] = true
+		}
+		for i := 0; i < x.Len(); i++ {
+			nodePointers(x.Index(i), ptrs)
+		}
+	case reflect.Struct:
+		for i := 0; i < x.NumField(); i++ {
+			nodePointers(x.Field(i), ptrs)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	var allStrs []string
+	for _, c := range fileTests {
+		allStrs = append(allStrs, c.Strs[0])
+	}
+	for _, c := range printTests {
+		allStrs = append(allStrs, c.in)
+	}
+	for i, in := range allStrs {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := parser.Parse(strings.NewReader(in), "")
+			if err != nil {
+				return
+			}
+			clone := Clone(prog)
+			if !reflect.DeepEqual(prog, clone) {
+				t.Fatalf("Clone mismatch in %q", in)
+			}
+			if !Equal(prog, clone) {
+				t.Fatalf("Clone is not Equal in %q", in)
+			}
+			ptrs := make(map[uintptr]bool)
+			nodePointers(reflect.ValueOf(prog), ptrs)
+			clonePtrs := make(map[uintptr]bool)
+			nodePointers(reflect.ValueOf(clone), clonePtrs)
+			for ptr := range clonePtrs {
+				if ptrs[ptr] {
+					t.Fatalf("Clone shares memory in %q", in)
+				}
+			}
+		})
+	}
+}
+
+func TestCloneNil(t *testing.T) {
+	t.Parallel()
+	if got := Clone(nil); got != nil {
+		t.Fatalf("Clone(nil) returned %#v", got)
+	}
+	var word *Word
+	if got := Clone(word); got != Node(word) {
+		t.Fatalf("Clone of a nil *Word returned %#v", got)
+	}
+}
+
+func TestEqualIgnorePositions(t *testing.T) {
+	t.Parallel()
+	parser := NewParser()
+	for i, c := range fileTests {
+		want := c.Bash
+		if want == nil {
+			continue
+		}
+		for j, in := range c.Strs {
+			t.Run(fmt.Sprintf("%03d-%d", i, j), func(t *testing.T) {
+				got, err := parser.Parse(strings.NewReader(in), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !Equal(got, want, IgnorePositions) {
+					t.Fatalf("Equal(IgnorePositions) false in %q", in)
+				}
+				if len(got.Stmts) > 0 && Equal(got, want) {
+					t.Fatalf("Equal true in %q", in)
+				}
+				// compare with the previous test case
+				if i == 0 {
+					return
+				}
+				prev := fileTests[i-1].Bash
+				if prev != nil && !reflect.DeepEqual(prev, want) &&
+					Equal(got, prev, IgnorePositions) {
+					t.Fatalf("Equal(IgnorePositions) true in %q and %q",
+						in, fileTests[i-1].Strs[0])
+				}
+			})
+		}
+	}
+}
+
+var equalTests = []struct {
+	x, y string
+	opts []EqualOption
+	want bool
+}{
+	{"foo", "foo", nil, true},
+	{"foo", "bar", nil, false},
+	{"foo", " foo", nil, false},
+	{"foo", " foo", []EqualOption{IgnorePositions}, true},
+	{"foo", "foo # bar", nil, false},
+	{"foo", "foo # bar", []EqualOption{IgnoreComments}, true},
+	{"foo # bar", "foo # baz", []EqualOption{IgnoreComments}, true},
+	{"# foo\nfoo", "foo", []EqualOption{IgnoreComments}, false},
+	{
+		"# foo\nfoo",
+		"foo",
+		[]EqualOption{IgnoreComments, IgnorePositions},
+		true,
+	},
+	{
+		"foo <<EOF\nbar\nEOF",
+		"foo <<EOF\nbaz\nEOF",
+		[]EqualOption{IgnorePositions},
+		false,
+	},
+	{
+		"if a; then b; fi",
+		"if a\nthen\n\tb\nfi",
+		[]EqualOption{IgnorePositions},
+		true,
+	},
+	{"foo &", "foo", []EqualOption{IgnorePositions}, false},
+	{"a=(b # c\n)", "a=(b)", []EqualOption{IgnorePositions}, false},
+	{
+		"a=(b # c\n)",
+		"a=(b)",
+		[]EqualOption{IgnorePositions, IgnoreComments},
+		true,
+	},
+}
+
+func TestEqual(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	for i, tc := range equalTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			x, err := parser.Parse(strings.NewReader(tc.x), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			y, err := parser.Parse(strings.NewReader(tc.y), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Equal(x, y, tc.opts...); got != tc.want {
+				t.Fatalf("Equal(%q, %q) got %v, want %v",
+					tc.x, tc.y, got, tc.want)
+			}
+			if got := Equal(y, x, tc.opts...); got != tc.want {
+				t.Fatalf("Equal(%q, %q) got %v, want %v",
+					tc.y, tc.x, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEqualNil(t *testing.T) {
+	t.Parallel()
+	if !Equal(nil, nil) {
+		t.Fatalf("Equal(nil, nil) is false")
+	}
+	if Equal(litWord("foo"), nil) || Equal(nil, litWord("foo")) {
+		t.Fatalf("Equal is true with a single nil")
+	}
+	if Equal(litWord("foo"), lit("foo")) {
+		t.Fatalf("Equal is true with different node types")
+	}
+	if !Equal(&CallExpr{}, &CallExpr{Args: []*Word{}}) {
+		t.Fatalf("Equal is false with nil and empty lists")
+	}
+}
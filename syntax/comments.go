@@ -0,0 +1,194 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import "sort"
+
+// CommentKind describes how a comment relates to the node it is associated
+// with.
+type CommentKind uint8
+
+const (
+	// LeadingComment is a comment before its node, such as one
+	// documenting a function.
+	LeadingComment CommentKind = iota + 1
+	// TrailingComment is a comment after its node, usually in the same
+	// line.
+	TrailingComment
+	// DanglingComment is a comment inside its node that is not next to
+	// any of its children, such as one after the last statement in a
+	// block.
+	DanglingComment
+)
+
+func (k CommentKind) String() string {
+	switch k {
+	case LeadingComment:
+		return "leading"
+	case TrailingComment:
+		return "trailing"
+	case DanglingComment:
+		return "dangling"
+	}
+	return "unknown"
+}
+
+// NodeComment is a comment associated with a node, along with its kind.
+type NodeComment struct {
+	Comment
+	Kind CommentKind
+}
+
+// CommentMap maps nodes to the comments associated with them, in the order
+// in which they appear. The keys are nodes which hold comments: *Stmt,
+// *CaseItem and *ArrayElem for leading and trailing comments, and nodes with
+// statement lists like *File and *Block for dangling comments.
+//
+// Rewrites of a syntax tree, such as those done via Apply, can use the map to
+// keep track of the comments of the nodes that are replaced.
+type CommentMap map[Node][]NodeComment
+
+// NewCommentMap creates a comment map from the comments found in the syntax
+// tree starting at node. The tree must have been parsed with KeepComments for
+// it to contain any comments.
+func NewCommentMap(node Node) CommentMap {
+	m := make(CommentMap)
+	Walk(node, func(node Node) bool {
+		switch x := node.(type) {
+		case *File:
+			m.addDangling(x, x.Last)
+		case *Stmt:
+			m.addAround(x, x.Comments)
+		case *Subshell:
+			m.addDangling(x, x.Last)
+		case *Block:
+			m.addDangling(x, x.Last)
+		case *IfClause:
+			m.addDangling(x, x.Cond.Last)
+			m.addDangling(x, x.Then.Last)
+			m.addDangling(x, x.Else.Last)
+		case *WhileClause:
+			m.addDangling(x, x.Cond.Last)
+			m.addDangling(x, x.Do.Last)
+		case *ForClause:
+			m.addDangling(x, x.Do.Last)
+		case *CmdSubst:
+			m.addDangling(x, x.Last)
+		case *ProcSubst:
+			m.addDangling(x, x.Last)
+		case *CaseClause:
+			m.addDangling(x, x.Last)
+		case *CaseItem:
+			m.addAround(x, x.Comments)
+			m.addDangling(x, x.Last)
+		case *ArrayExpr:
+			m.addDangling(x, x.Last)
+		case *ArrayElem:
+			m.addAround(x, x.Comments)
+		}
+		return true
+	})
+	return m
+}
+
+func (m CommentMap) addDangling(node Node, cs []Comment) {
+	for _, c := range cs {
+		m[node] = append(m[node], NodeComment{c, DanglingComment})
+	}
+}
+
+func (m CommentMap) addAround(node Node, cs []Comment) {
+	for _, c := range cs {
+		kind := DanglingComment
+		switch {
+		case !node.Pos().IsValid(), !c.End().After(node.Pos()):
+			// nodes without a position, such as the ones added
+			// via Apply, have their comments printed before them
+			kind = LeadingComment
+		case !node.End().After(c.Pos()):
+			kind = TrailingComment
+		}
+		m[node] = append(m[node], NodeComment{c, kind})
+	}
+}
+
+func (m CommentMap) kind(node Node, kind CommentKind) []Comment {
+	var cs []Comment
+	for _, c := range m[node] {
+		if c.Kind == kind {
+			cs = append(cs, c.Comment)
+		}
+	}
+	return cs
+}
+
+// Leading returns the comments before a node.
+func (m CommentMap) Leading(node Node) []Comment {
+	return m.kind(node, LeadingComment)
+}
+
+// Trailing returns the comments after a node.
+func (m CommentMap) Trailing(node Node) []Comment {
+	return m.kind(node, TrailingComment)
+}
+
+// Dangling returns the comments inside a node that are not associated with
+// any of its children.
+func (m CommentMap) Dangling(node Node) []Comment {
+	return m.kind(node, DanglingComment)
+}
+
+// Doc returns the documentation comments of a node. That is, the leading
+// comments in the lines right before it, without any empty lines between
+// them, such as:
+//
+//	# foo prints its arguments.
+//	foo() { echo "$@"; }
+func (m CommentMap) Doc(node Node) []Comment {
+	cs := m.Leading(node)
+	line := node.Pos().Line()
+	i := len(cs)
+	for i > 0 && cs[i-1].Hash.Line()+1 == line {
+		i--
+		line--
+	}
+	return cs[i:]
+}
+
+// Update replaces the old node with the new node in the map, moving the
+// comments of the old node over to the new one. It returns the new node.
+func (m CommentMap) Update(old, new Node) Node {
+	if cs := m[old]; len(cs) > 0 {
+		delete(m, old)
+		m[new] = append(m[new], cs...)
+	}
+	return new
+}
+
+// Filter returns a new comment map with the entries of the nodes found in
+// the syntax tree starting at node.
+func (m CommentMap) Filter(node Node) CommentMap {
+	m2 := make(CommentMap)
+	Walk(node, func(node Node) bool {
+		if cs := m[node]; len(cs) > 0 {
+			m2[node] = cs
+		}
+		return true
+	})
+	return m2
+}
+
+// Comments returns all the comments in the map, sorted by position.
+func (m CommentMap) Comments() []Comment {
+	var cs []Comment
+	for _, ncs := range m {
+		for _, c := range ncs {
+			cs = append(cs, c.Comment)
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[j].Pos().After(cs[i].Pos())
+	})
+	return cs
+}
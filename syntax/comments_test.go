@@ -0,0 +1,199 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var commentMapTests = []struct {
+	in   string
+	want []string
+}{
+	{"foo", nil},
+	{
+		"# foo\nfoo # bar",
+		[]string{
+			"*syntax.Stmt 1:1 leading \" foo\"",
+			"*syntax.Stmt 2:5 trailing \" bar\"",
+		},
+	},
+	{
+		"foo\n# bar",
+		[]string{"*syntax.File 2:1 dangling \" bar\""},
+	},
+	{
+		"# hdr\n\n# doc\nf() { # open\n\tfoo # t\n\t# last\n}\n# end",
+		[]string{
+			"*syntax.Block 6:2 dangling \" last\"",
+			"*syntax.File 8:1 dangling \" end\"",
+			"*syntax.Stmt 1:1 leading \" hdr\"",
+			"*syntax.Stmt 3:1 leading \" doc\"",
+			"*syntax.Stmt 4:7 leading \" open\"",
+			"*syntax.Stmt 5:6 trailing \" t\"",
+		},
+	},
+	{
+		"if a; then\n\tb\n\t# c\nelse\n\td\n\t# e\nfi # f",
+		[]string{
+			"*syntax.IfClause 3:2 dangling \" c\"",
+			"*syntax.IfClause 6:2 dangling \" e\"",
+			"*syntax.Stmt 7:4 trailing \" f\"",
+		},
+	},
+	{
+		"while a; do\n\t# b\ndone\nfor a; do\n\t# b\ndone",
+		[]string{
+			"*syntax.ForClause 5:2 dangling \" b\"",
+			"*syntax.WhileClause 2:2 dangling \" b\"",
+		},
+	},
+	{
+		"case x in\n# lead\na) foo ;; # tr\n# last\nesac",
+		[]string{
+			"*syntax.CaseClause 4:1 dangling \" last\"",
+			"*syntax.CaseItem 2:1 leading \" lead\"",
+			"*syntax.CaseItem 3:11 trailing \" tr\"",
+		},
+	},
+	{
+		"a=(\n\t# lead\n\tb # tr\n\t# last\n)",
+		[]string{
+			"*syntax.ArrayElem 2:2 leading \" lead\"",
+			"*syntax.ArrayElem 3:4 trailing \" tr\"",
+			"*syntax.ArrayExpr 4:2 dangling \" last\"",
+		},
+	},
+	{
+		"(\n\tfoo\n\t# a\n)\n{\n\tfoo\n\t# b\n}",
+		[]string{
+			"*syntax.Block 7:2 dangling \" b\"",
+			"*syntax.Subshell 3:2 dangling \" a\"",
+		},
+	},
+	{
+		"echo $(\n\tfoo\n\t# a\n) <(\n\tfoo\n\t# b\n)",
+		[]string{
+			"*syntax.CmdSubst 3:2 dangling \" a\"",
+			"*syntax.ProcSubst 6:2 dangling \" b\"",
+		},
+	},
+}
+
+func commentMapStrs(m CommentMap) []string {
+	var strs []string
+	for node, cs := range m {
+		for _, c := range cs {
+			strs = append(strs, fmt.Sprintf("%T %s %s %q",
+				node, c.Pos(), c.Kind, c.Text))
+		}
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func TestCommentMap(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	for i, tc := range commentMapTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := commentMapStrs(NewCommentMap(f))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("CommentMap mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCommentMapAllComments(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	for i, c := range fileTests {
+		in := c.Strs[0]
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(in), "")
+			if err != nil {
+				return
+			}
+			var want []string
+			Apply(f, func(c *Cursor) bool {
+				if c, ok := c.Node().(*Comment); ok {
+					want = append(want, c.Pos().String())
+				}
+				return true
+			}, nil)
+			sort.Strings(want)
+			var got []string
+			for _, c := range NewCommentMap(f).Comments() {
+				got = append(got, c.Pos().String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("CommentMap comments mismatch in %q\nwant: %q\ngot:  %q",
+					in, want, got)
+			}
+		})
+	}
+}
+
+func TestCommentMapDoc(t *testing.T) {
+	t.Parallel()
+	in := "# hdr\n\n# foo does\n# things.\nfoo() { bar; }\n\nbar() { :; }"
+	f, err := NewParser(KeepComments).Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewCommentMap(f)
+	var got []string
+	for _, c := range m.Doc(f.Stmts[0]) {
+		got = append(got, c.Text)
+	}
+	if want := []string{" foo does", " things."}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Doc mismatch\nwant: %q\ngot:  %q", want, got)
+	}
+	if got := len(m.Leading(f.Stmts[0])); got != 3 {
+		t.Fatalf("want 3 leading comments, got %d", got)
+	}
+	if got := m.Doc(f.Stmts[1]); len(got) != 0 {
+		t.Fatalf("want no doc comments, got %q", got)
+	}
+}
+
+func TestCommentMapUpdate(t *testing.T) {
+	t.Parallel()
+	in := "# foo\nfoo\n{\n\t# bar\n\tbar\n}"
+	f, err := NewParser(KeepComments).Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewCommentMap(f)
+	old := f.Stmts[0]
+	repl := litStmt("new")
+	if got := m.Update(old, repl); got != repl {
+		t.Fatalf("Update returned %#v", got)
+	}
+	if cs := m.Leading(old); len(cs) != 0 {
+		t.Fatalf("old node still has comments: %q", cs)
+	}
+	if cs := m.Leading(repl); len(cs) != 1 || cs[0].Text != " foo" {
+		t.Fatalf("new node has the wrong comments: %q", cs)
+	}
+	block := f.Stmts[1].Cmd.(*Block)
+	sub := m.Filter(block)
+	if len(sub) != 1 {
+		t.Fatalf("want one node in the filtered map, got %d", len(sub))
+	}
+	if cs := sub.Leading(block.Stmts[0]); len(cs) != 1 || cs[0].Text != " bar" {
+		t.Fatalf("filtered map has the wrong comments: %q", cs)
+	}
+}
@@ -61,7 +61,8 @@ func (p *Parser) rune() rune {
 		// character positions don't have col 0.
 		p.npos.line++
 		p.npos.col = 1
-	} else {
+	} else if p.bsp <= len(p.bs) {
+		// not past EOF, where the offset doesn't advance either
 		p.npos.col += p.w
 	}
 	bquotes := 0
@@ -98,10 +99,10 @@ retry:
 			p.litBs = append(p.litBs, p.bs[p.bsp:p.bsp+w]...)
 		}
 		p.bsp += w
+		p.w = uint16(w)
 		if p.r == utf8.RuneError && w == 1 {
 			p.posErr(p.npos, "invalid UTF-8 encoding")
 		}
-		p.w = uint16(w)
 	} else {
 		if p.r == utf8.RuneSelf {
 		} else if p.fill(); p.bs == nil {
@@ -185,6 +186,9 @@ func (p *Parser) nextKeepSpaces() {
 	if p.err != nil && p.tok != _EOF {
 		p.tok = _EOF
 	}
+	if p.recTokens {
+		p.recordTok()
+	}
 }
 
 func (p *Parser) next() {
@@ -250,15 +254,22 @@ skipSpace:
 			for r != utf8.RuneSelf && r != '\n' {
 				r = p.rune()
 			}
-			if p.keepComments {
-				*p.curComs = append(*p.curComs, Comment{
-					Hash: p.pos,
-					Text: p.endLit(),
-				})
+			if p.keepComments || p.recTokens {
+				text := p.endLit()
+				if p.recTokens {
+					p.addTok(TokComment, p.pos, "#"+text)
+				}
+				if p.keepComments {
+					*p.curComs = append(*p.curComs, Comment{
+						Hash: p.pos,
+						Text: text,
+					})
+				}
 			} else {
 				p.litBs = nil
 			}
 			p.next()
+			return
 		case '[', '=':
 			if p.quote == arrayElems {
 				p.tok = p.paramToken(r)
@@ -313,6 +324,67 @@ skipSpace:
 	if p.err != nil && p.tok != _EOF {
 		p.tok = _EOF
 	}
+	if p.recTokens {
+		p.recordTok()
+	}
+}
+
+// recordTok adds the current token to the ones returned by Tokens.
+func (p *Parser) recordTok() {
+	var kind TokenKind
+	val := ""
+	switch p.tok {
+	case illegalTok, _EOF, _Newl:
+		return
+	case _Lit, _LitWord, _LitRedir:
+		switch {
+		case p.quote == paramExpName:
+			kind = TokParam
+		case p.quote == dblQuotes:
+			kind = TokString
+		case p.quote&(hdocBody|hdocBodyTabs) != 0:
+			kind = TokHeredoc
+		default:
+			kind = TokLit
+		}
+		if val = p.val; val == "" {
+			return
+		}
+	case sglQuote, dblQuote, dollSglQuote, dollDblQuote:
+		kind = TokString
+	case dollar, dollBrace, dollBrack, dollParen, dollDblParen, bckQuote,
+		cmdIn, cmdOut:
+		kind = TokExpansion
+	case rightBrace:
+		kind = TokExpansion
+	default:
+		kind = TokOperator
+	}
+	if val == "" {
+		val = p.tok.String()
+	}
+	p.addTok(kind, p.pos, val)
+}
+
+// addTok adds a token that starts at pos and ends where the lexer is.
+func (p *Parser) addTok(kind TokenKind, pos Pos, val string) {
+	p.toks = append(p.toks, Token{
+		Kind:     kind,
+		ValuePos: pos,
+		ValueEnd: p.getPos(),
+		Value:    val,
+	})
+}
+
+// tokKind changes the kind of the current token, once the parser knows
+// what it is used for.
+func (p *Parser) tokKind(kind TokenKind) {
+	if !p.recTokens || len(p.toks) == 0 {
+		return
+	}
+	if t := &p.toks[len(p.toks)-1]; t.ValuePos == p.pos {
+		t.Kind = kind
+	}
 }
 
 func (p *Parser) peekByte(b byte) bool {
@@ -729,8 +801,7 @@ func (p *Parser) newLit(r rune) {
 		p.litBs = p.litBuf[:1]
 		p.litBs[0] = byte(r)
 	case r > utf8.RuneSelf:
-		w := utf8.RuneLen(r)
-		p.litBs = append(p.litBuf[:0], p.bs[p.bsp-w:p.bsp]...)
+		p.litBs = append(p.litBuf[:0], p.bs[p.bsp-int(p.w):p.bsp]...)
 	default:
 		// don't let r == utf8.RuneSelf go to the second case as RuneLen
 		// would return -1
@@ -164,7 +164,7 @@ func (s *Stmt) End() Pos {
 //
 // These are *CallExpr, *IfClause, *WhileClause, *ForClause, *CaseClause,
 // *Block, *Subshell, *BinaryCmd, *FuncDecl, *ArithmCmd, *TestClause,
-// *DeclClause, *LetClause, *TimeClause, and *CoprocClause.
+// *DeclClause, *LetClause, *TimeClause, *CoprocClause, and *BadCmd.
 type Command interface {
 	Node
 	commandNode()
@@ -185,6 +185,7 @@ func (*DeclClause) commandNode()   {}
 func (*LetClause) commandNode()    {}
 func (*TimeClause) commandNode()   {}
 func (*CoprocClause) commandNode() {}
+func (*BadCmd) commandNode()       {}
 
 // Assign represents an assignment to a variable.
 //
@@ -823,6 +824,17 @@ type LetClause struct {
 func (l *LetClause) Pos() Pos { return l.Let }
 func (l *LetClause) End() Pos { return l.Exprs[len(l.Exprs)-1].End() }
 
+// BadCmd represents a command that could not be parsed, spanning the
+// source that was skipped.
+//
+// This node will only appear when using RecoverErrors.
+type BadCmd struct {
+	From, To Pos
+}
+
+func (b *BadCmd) Pos() Pos { return b.From }
+func (b *BadCmd) End() Pos { return b.To }
+
 func wordLastEnd(ws []*Word) Pos {
 	if len(ws) == 0 {
 		return Pos{}
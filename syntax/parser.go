@@ -16,6 +16,15 @@ import (
 // nodes, as opposed to discarding them.
 func KeepComments(p *Parser) { p.keepComments = true }
 
+// RecoverErrors makes the parser keep going after finding syntax
+// errors, to report as many of them as possible. Statements which fail
+// to parse are skipped up to the next newline or semicolon, or the end
+// of their statement list, and are replaced by a *BadCmd.
+//
+// The returned error is then an ErrorList, and the returned program is
+// never nil.
+func RecoverErrors(p *Parser) { p.recoverErrors = true }
+
 type LangVariant int
 
 const (
@@ -92,7 +101,7 @@ func (p *Parser) Parse(r io.Reader, name string) (*File, error) {
 		// trigger it
 		p.doHeredocs()
 	}
-	return p.f, p.err
+	return p.f, p.finalErr()
 }
 
 // Stmts reads and parses statements one at a time, calling a function
@@ -110,9 +119,143 @@ func (p *Parser) Stmts(r io.Reader, fn func(*Stmt) bool) error {
 		// trigger it
 		p.doHeredocs()
 	}
-	return p.err
+	return p.finalErr()
+}
+
+// Tokens parses a shell program like Parse, and returns all of its
+// tokens in the order they appear in. Whitespace and newlines are not
+// included. The tokens are classified like the parser does, so that, for
+// example, "if" is only a keyword when it starts an if clause.
+//
+// If a syntax error is found, the tokens up to that point are returned
+// along with the error. Use RecoverErrors to tokenize the rest of the
+// program too, which is useful for syntax highlighting.
+func (p *Parser) Tokens(r io.Reader, name string) ([]Token, error) {
+	p.recTokens = true
+	_, err := p.Parse(r, name)
+	toks := p.toks
+	p.recTokens, p.toks = false, nil
+	return toks, err
+}
+
+type wrappedReader struct {
+	*Parser
+	io.Reader
+
+	lastOffs    int
+	accumulated []*Stmt
+	fn          func([]*Stmt) bool
+}
+
+func (w *wrappedReader) Read(b []byte) (int, error) {
+	// The lexer only asks for more input once it has used all of it.
+	// If the last rune was a newline, a line was just finished, and
+	// it didn't complete any statements. Note that fill has already
+	// added the used bytes to offs.
+	if w.r == '\n' && w.offs > w.lastOffs {
+		if w.Incomplete() {
+			// call back to show a continuation prompt
+			if !w.fn(nil) {
+				return 0, io.EOF
+			}
+		} else if len(w.accumulated) == 0 {
+			// nothing was parsed, e.g. an empty line
+			if !w.fn(nil) {
+				return 0, io.EOF
+			}
+		}
+		w.lastOffs = w.offs
+	}
+	return w.Reader.Read(b)
+}
+
+// Interactive parses statements from an interactive session, where the
+// input is typed one line at a time. Once a line is read, fn is called
+// with all the statements it completed. If the line did not complete
+// any statements, fn is called with none; Incomplete then reports
+// whether the parser is waiting for more lines to finish a statement,
+// which is useful to show a continuation prompt.
+//
+// If fn returns false, parsing is stopped and fn is not called again.
+// Syntax errors stop the parsing too, and are returned. Use
+// IsIncomplete to tell whether the input ended in the middle of a
+// statement.
+func (p *Parser) Interactive(r io.Reader, fn func([]*Stmt) bool) error {
+	w := &wrappedReader{Parser: p, Reader: r, fn: fn}
+	p.reset()
+	p.f = &File{}
+	p.src = w
+	p.rune()
+	p.next()
+	p.stmts(func(s *Stmt) bool {
+		w.accumulated = append(w.accumulated, s)
+		if p.tok != _Newl && p.tok != _EOF {
+			// more statements follow on the same line
+			return true
+		}
+		if !fn(w.accumulated) {
+			return false
+		}
+		w.accumulated = w.accumulated[:0]
+		// fn was already called for this line
+		w.lastOffs = p.offs + p.bsp
+		return true
+	})
+	if p.err == nil {
+		// EOF immediately after heredoc word so no newline to
+		// trigger it
+		p.doHeredocs()
+	}
+	return p.finalErr()
+}
+
+// Incomplete reports whether the parser is in the middle of a statement
+// that needs more input to be finished, such as an open quote, an "if"
+// missing its "fi", or a line ending with "|" or a backslash.
+//
+// It is only meaningful while Interactive is calling its function.
+func (p *Parser) Incomplete() bool {
+	return len(p.open) > 0 || p.pendingHdocs() || p.escNewl()
+}
+
+// OpenConstructs returns the constructs that are open while parsing an
+// incomplete statement, with the innermost one last. Each one is
+// represented by the token that opened it, such as "if", "{", "$(",
+// "\"" or "<<". A line continued with a backslash is represented by
+// "\\".
+//
+// Like Incomplete, it is only meaningful while Interactive is calling
+// its function. Shells can use it to show continuation prompts like
+// "if>" or "dquote>".
+func (p *Parser) OpenConstructs() []string {
+	open := append([]string(nil), p.open...)
+	if p.pendingHdocs() {
+		open = append(open, p.heredocs[p.buriedHdocs].Op.String())
+	}
+	if p.escNewl() {
+		open = append(open, "\\")
+	}
+	return open
 }
 
+// pendingHdocs reports whether there are heredoc bodies left to read
+// once the current line is finished.
+func (p *Parser) pendingHdocs() bool {
+	return len(p.heredocs) > p.buriedHdocs
+}
+
+// escNewl reports whether the lexer just consumed an escaped newline,
+// which means that the line continues on the next one.
+func (p *Parser) escNewl() bool {
+	return p.r == '\n' && p.bsp >= 2 && p.bsp <= len(p.bs) &&
+		p.bs[p.bsp-2] == '\\' && (p.litBs != nil || p.tok != _Newl)
+}
+
+// pushOpen and popOpen keep track of the constructs being parsed, for
+// OpenConstructs.
+func (p *Parser) pushOpen(tok string) { p.open = append(p.open, tok) }
+func (p *Parser) popOpen()            { p.open = p.open[:len(p.open)-1] }
+
 // Parser holds the internal state of the parsing mechanism of a
 // program.
 type Parser struct {
@@ -139,8 +282,16 @@ type Parser struct {
 	quote   quoteState // current lexer state
 	eqlOffs int        // position of '=' in val (a literal)
 
-	keepComments bool
-	lang         LangVariant
+	keepComments  bool
+	recoverErrors bool
+	lang          LangVariant
+
+	// errs holds the errors found so far when recovering from
+	// errors. canResume is set when the lexer can resume from
+	// resume, the state it had when p.err was found.
+	errs      []error
+	canResume bool
+	resume    lexState
 
 	stopAt []byte
 
@@ -163,6 +314,14 @@ type Parser struct {
 
 	reOpenParens int
 
+	// open holds the constructs being parsed, innermost last
+	open []string
+
+	// recTokens is set when the lexed tokens are being recorded into
+	// toks, for Tokens.
+	recTokens bool
+	toks      []Token
+
 	accComs []Comment
 	curComs *[]Comment
 
@@ -190,10 +349,12 @@ func (p *Parser) reset() {
 	p.npos = Pos{line: 1, col: 1}
 	p.r, p.w = 0, 0
 	p.err, p.readErr = nil, nil
+	p.errs, p.canResume = nil, false
 	p.quote, p.forbidNested = noState, false
 	p.heredocs, p.buriedHdocs = p.heredocs[:0], 0
 	p.openBquotes, p.buriedBquotes = 0, 0
 	p.reOpenParens = 0
+	p.open = p.open[:0]
 	p.accComs, p.curComs = nil, &p.accComs
 }
 
@@ -357,26 +518,42 @@ func (p *Parser) doHeredocs() {
 	p.rune() // consume '\n', since we know p.tok == _Newl
 	old := p.quote
 	hdocs := p.heredocs[p.buriedHdocs:]
-	p.heredocs = p.heredocs[:p.buriedHdocs]
+	// heredocs within the bodies must not overwrite hdocs
+	p.heredocs = p.heredocs[:p.buriedHdocs:p.buriedHdocs]
 	for i, r := range hdocs {
 		if p.err != nil {
 			break
 		}
+		if r.Word == nil {
+			// its redirect failed to parse
+			continue
+		}
 		p.quote = hdocBody
 		if r.Op == DashHdoc {
 			p.quote = hdocBodyTabs
 		}
 		var quoted bool
 		p.hdocStop, quoted = p.unquotedWordBytes(r.Word)
+		p.pushOpen(r.Op.String())
 		if i > 0 && p.r == '\n' {
 			p.rune()
 		}
 		if quoted {
 			r.Hdoc = p.hdocLitWord()
+			if p.recTokens && r.Hdoc != nil {
+				l := r.Hdoc.Parts[0].(*Lit)
+				p.addTok(TokHeredoc, l.ValuePos, l.Value)
+			}
 		} else {
 			p.next()
 			r.Hdoc = p.getWord()
+			if p.canResume {
+				// the statement has already been parsed, so
+				// the body can't be replaced by a BadCmd
+				r.Hdoc = nil
+			}
 		}
+		p.popOpen()
 		if p.hdocStop != nil {
 			p.posErr(r.Pos(), "unclosed here-document '%s'",
 				string(p.hdocStop))
@@ -396,6 +573,7 @@ func (p *Parser) got(tok token) bool {
 func (p *Parser) gotRsrv(val string) (Pos, bool) {
 	pos := p.pos
 	if p.tok == _LitWord && p.val == val {
+		p.tokKind(TokKeyword)
 		p.next()
 		return pos, true
 	}
@@ -490,6 +668,15 @@ func (p *Parser) matched(lpos Pos, left, right token) Pos {
 func (p *Parser) errPass(err error) {
 	if p.err == nil {
 		p.err = err
+		if p.recoverErrors {
+			p.errs = append(p.errs, err)
+			p.canResume = true
+			p.resume = lexState{
+				bsp: p.bsp, r: p.r, w: p.w, npos: p.npos,
+				tok: p.tok, val: p.val, pos: p.pos,
+				spaced: p.spaced,
+			}
+		}
 		p.bsp = len(p.bs) + 1
 		p.r = utf8.RuneSelf
 		p.w = 1
@@ -497,12 +684,137 @@ func (p *Parser) errPass(err error) {
 	}
 }
 
+// lexState is the state of the lexer at a token.
+type lexState struct {
+	bsp    int
+	r      rune
+	w      uint16
+	npos   Pos
+	tok    token
+	val    string
+	pos    Pos
+	spaced bool
+}
+
+// nestState is the state of the parser when entering a statement list,
+// to return to when recovering from an error within it.
+type nestState struct {
+	quote         quoteState
+	buriedHdocs   int
+	openBquotes   int
+	buriedBquotes int
+	reOpenParens  int
+	forbidNested  bool
+}
+
+func (p *Parser) nestState() nestState {
+	return nestState{
+		quote:         p.quote,
+		buriedHdocs:   p.buriedHdocs,
+		openBquotes:   p.openBquotes,
+		buriedBquotes: p.buriedBquotes,
+		reOpenParens:  p.reOpenParens,
+		forbidNested:  p.forbidNested,
+	}
+}
+
+// resumeAfterErr undoes the stopping of the lexer done by errPass, so
+// that parsing can continue from where the error was found.
+func (p *Parser) resumeAfterErr(nest nestState) {
+	s := p.resume
+	p.bsp, p.r, p.w, p.npos = s.bsp, s.r, s.w, s.npos
+	p.tok, p.val, p.pos, p.spaced = s.tok, s.val, s.pos, s.spaced
+	p.quote = nest.quote
+	p.buriedHdocs = nest.buriedHdocs
+	p.openBquotes = nest.openBquotes
+	p.buriedBquotes = nest.buriedBquotes
+	p.reOpenParens = nest.reOpenParens
+	p.forbidNested = nest.forbidNested
+	p.litBs, p.hdocStop = nil, nil
+	p.err, p.canResume = nil, false
+	// drop any heredocs whose redirect was left incomplete
+	hdocs := p.heredocs[:0]
+	for _, r := range p.heredocs {
+		if r.Word != nil {
+			hdocs = append(hdocs, r)
+		}
+	}
+	p.heredocs = hdocs
+	if p.buriedHdocs > len(hdocs) {
+		p.buriedHdocs = len(hdocs)
+	}
+}
+
+// badStmt recovers from an error in the statement starting at pos. The
+// rest of the statement is skipped, up to the next newline or
+// semicolon, or the end of the statement list.
+func (p *Parser) badStmt(pos Pos, nest nestState, stops []string) *Stmt {
+	p.resumeAfterErr(nest)
+	nerrs := len(p.errs)
+	end := p.getPos()
+	for !p.stmtsEnd(stops) && p.tok != _Newl {
+		if p.got(semicolon) || p.got(and) {
+			break
+		}
+		end = p.getPos() // the end of the token being skipped
+		p.next()
+		if p.canResume {
+			// the rest of the line can't be tokenized, so
+			// skip it altogether
+			p.resumeAfterErr(nest)
+			for p.r != '\n' && p.r != utf8.RuneSelf {
+				p.rune()
+			}
+			p.next()
+		}
+	}
+	// errors found while skipping are not useful
+	p.errs = p.errs[:nerrs]
+	s := p.stmt(pos)
+	s.Cmd = &BadCmd{From: pos, To: end}
+	return s
+}
+
+// finalErr returns the error to return once parsing is done.
+func (p *Parser) finalErr() error {
+	if !p.recoverErrors {
+		return p.err
+	}
+	if p.err != nil && !p.canResume {
+		// an error from reading the input
+		p.errs = append(p.errs, p.err)
+	}
+	if len(p.errs) == 0 {
+		return nil
+	}
+	return ErrorList(p.errs)
+}
+
+// ErrorList is returned when parsing with RecoverErrors, holding all
+// the errors found in the order they were found. The errors are of
+// type ParseError or LangError, unless reading the input failed.
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
 // ParseError represents an error found when parsing a source file, from which
 // the parser cannot recover.
 type ParseError struct {
 	Filename string
 	Pos
 	Text string
+
+	// Incomplete is true if the error was found at the end of the
+	// input, meaning that more input could make the program valid.
+	Incomplete bool
 }
 
 func (e ParseError) Error() string {
@@ -544,11 +856,23 @@ func (e LangError) Error() string {
 	return buf.String()
 }
 
+// IsIncomplete reports whether err is a ParseError found at the end of
+// the input, such as an unclosed quote or an "if" missing its "fi".
+// These can be fixed by adding more input, unlike other syntax errors.
+func IsIncomplete(err error) bool {
+	if l, ok := err.(ErrorList); ok && len(l) > 0 {
+		err = l[len(l)-1]
+	}
+	perr, ok := err.(ParseError)
+	return ok && perr.Incomplete
+}
+
 func (p *Parser) posErr(pos Pos, format string, a ...interface{}) {
 	p.errPass(ParseError{
-		Filename: p.f.Name,
-		Pos:      pos,
-		Text:     fmt.Sprintf(format, a...),
+		Filename:   p.f.Name,
+		Pos:        pos,
+		Text:       fmt.Sprintf(format, a...),
+		Incomplete: p.tok == _EOF && p.r == utf8.RuneSelf,
 	})
 }
 
@@ -566,33 +890,40 @@ func (p *Parser) langErr(pos Pos, feature string, langs ...LangVariant) {
 }
 
 func (p *Parser) stmts(fn func(*Stmt) bool, stops ...string) {
+	if p.canResume {
+		// unwinding from an error found before this list, which
+		// an outer list will recover from
+		return
+	}
 	gotEnd := true
-loop:
-	for p.tok != _EOF {
+	nest := p.nestState()
+	var pos Pos
+	for {
+		if p.canResume {
+			gotEnd = true
+			if !fn(p.badStmt(pos, nest, stops)) {
+				break
+			}
+		}
+		if p.tok == _EOF {
+			break
+		}
 		newLine := p.got(_Newl)
+		pos = p.pos
+		if p.canResume {
+			continue
+		}
+		if p.stmtsEnd(stops) {
+			break
+		}
 		switch p.tok {
-		case _LitWord:
-			for _, stop := range stops {
-				if p.val == stop {
-					break loop
-				}
-			}
-		case rightParen:
-			if p.quote == subCmd {
-				break loop
-			}
-		case bckQuote:
-			if p.backquoteEnd() {
-				break loop
-			}
 		case dblSemicolon, semiAnd, dblSemiAnd, semiOr:
-			if p.quote == switchCase {
-				break loop
-			}
 			p.curErr("%s can only be used in a case clause", p.tok)
+			continue
 		}
 		if !newLine && !gotEnd {
 			p.curErr("statements must be separated by &, ; or a newline")
+			continue
 		}
 		if p.tok == _EOF {
 			break
@@ -600,7 +931,10 @@ loop:
 		s := p.getStmt(true, false, false)
 		if s == nil {
 			p.invalidStmtStart()
-			break
+			continue
+		}
+		if p.canResume {
+			continue
 		}
 		gotEnd = s.Semicolon.IsValid()
 		if !fn(s) {
@@ -609,6 +943,28 @@ loop:
 	}
 }
 
+// stmtsEnd reports whether the current token ends a statement list with
+// the given stop words.
+func (p *Parser) stmtsEnd(stops []string) bool {
+	switch p.tok {
+	case _EOF:
+		return true
+	case _LitWord:
+		for _, stop := range stops {
+			if p.val == stop {
+				return true
+			}
+		}
+	case rightParen:
+		return p.quote == subCmd
+	case bckQuote:
+		return p.backquoteEnd()
+	case dblSemicolon, semiAnd, dblSemiAnd, semiOr:
+		return p.quote == switchCase
+	}
+	return false
+}
+
 func (p *Parser) stmtList(stops ...string) (sl StmtList) {
 	fn := func(s *Stmt) bool {
 		if sl.Stmts == nil {
@@ -697,9 +1053,11 @@ func (p *Parser) wordPart() WordPart {
 				ReplyVar: p.r == '|',
 			}
 			old := p.preNested(subCmd)
+			p.pushOpen(dollBrace.String())
 			p.rune() // don't tokenize '|'
 			p.next()
 			cs.StmtList = p.stmtList("}")
+			p.popOpen()
 			p.postNested(old)
 			pos, ok := p.gotRsrv("}")
 			if !ok {
@@ -720,6 +1078,7 @@ func (p *Parser) wordPart() WordPart {
 		} else {
 			old = p.preNested(arithmExpr)
 		}
+		p.pushOpen(left.String())
 		p.next()
 		if p.got(hash) {
 			if p.lang != LangMirBSDKorn {
@@ -728,10 +1087,12 @@ func (p *Parser) wordPart() WordPart {
 			ar.Unsigned = true
 		}
 		ar.X = p.followArithm(left, ar.Left)
+		p.popOpen()
 		if ar.Bracket {
 			if p.tok != rightBrack {
 				p.matchingErr(ar.Left, dollBrack, rightBrack)
 			}
+			p.tokKind(TokExpansion)
 			p.postNested(old)
 			ar.Right = p.pos
 			p.next()
@@ -743,9 +1104,12 @@ func (p *Parser) wordPart() WordPart {
 		p.ensureNoNested()
 		cs := &CmdSubst{Left: p.pos}
 		old := p.preNested(subCmd)
+		p.pushOpen(dollParen.String())
 		p.next()
 		cs.StmtList = p.stmtList()
+		p.popOpen()
 		p.postNested(old)
+		p.tokKind(TokExpansion)
 		cs.Right = p.matched(cs.Left, leftParen, rightParen)
 		return cs
 	case dollar:
@@ -758,10 +1122,14 @@ func (p *Parser) wordPart() WordPart {
 			'0' <= r && r <= '9', r == '_', r == '\\':
 			p.advanceNameCont(r)
 		default:
+			p.tokKind(TokLit)
 			l := p.lit(p.pos, "$")
 			p.next()
 			return l
 		}
+		if p.recTokens && p.val != "" {
+			p.addTok(TokParam, posAddCol(p.pos, 1), p.val)
+		}
 		p.ensureNoNested()
 		pe := &ParamExp{Dollar: p.pos, Short: true}
 		p.pos = posAddCol(p.pos, 1)
@@ -784,13 +1152,17 @@ func (p *Parser) wordPart() WordPart {
 		p.ensureNoNested()
 		ps := &ProcSubst{Op: ProcOperator(p.tok), OpPos: p.pos}
 		old := p.preNested(subCmd)
+		p.pushOpen(ps.Op.String())
 		p.next()
 		ps.StmtList = p.stmtList()
+		p.popOpen()
 		p.postNested(old)
+		p.tokKind(TokExpansion)
 		ps.Rparen = p.matched(ps.OpPos, token(ps.Op), rightParen)
 		return ps
 	case sglQuote, dollSglQuote:
 		sq := &SglQuoted{Left: p.pos, Dollar: p.tok == dollSglQuote}
+		p.pushOpen(p.tok.String())
 		r := p.r
 		for p.newLit(r); ; r = p.rune() {
 			switch r {
@@ -801,15 +1173,28 @@ func (p *Parser) wordPart() WordPart {
 			case '\'':
 				sq.Right = p.getPos()
 				sq.Value = p.endLit()
+				if p.recTokens && sq.Value != "" {
+					start := posAddCol(sq.Left, 1)
+					if sq.Dollar {
+						start = posAddCol(start, 1)
+					}
+					p.addTok(TokString, start, sq.Value)
+				}
 
 				// restore openBquotes
 				p.openBquotes = p.buriedBquotes
 				p.buriedBquotes = 0
 
+				p.popOpen()
 				p.rune()
+				if p.recTokens {
+					p.addTok(TokString, sq.Right, sglQuote.String())
+				}
 				p.next()
 				return sq
 			case utf8.RuneSelf:
+				p.popOpen()
+				p.tok = _EOF
 				p.posErr(sq.Pos(), "reached EOF without closing quote %s", sglQuote)
 				return nil
 			}
@@ -828,8 +1213,10 @@ func (p *Parser) wordPart() WordPart {
 		cs := &CmdSubst{Left: p.pos}
 		old := p.preNested(subCmdBckquo)
 		p.openBquotes++
+		p.pushOpen(bckQuote.String())
 		p.next()
 		cs.StmtList = p.stmtList()
+		p.popOpen()
 		p.postNested(old)
 		p.openBquotes--
 		cs.Right = p.pos
@@ -842,6 +1229,7 @@ func (p *Parser) wordPart() WordPart {
 			p.langErr(p.pos, "extended globs", LangBash, LangMirBSDKorn)
 		}
 		eg := &ExtGlob{Op: GlobOperator(p.tok), OpPos: p.pos}
+		p.pushOpen(eg.Op.String())
 		lparens := 1
 		r := p.r
 	globLoop:
@@ -857,8 +1245,16 @@ func (p *Parser) wordPart() WordPart {
 				}
 			}
 		}
+		p.popOpen()
 		eg.Pattern = p.lit(posAddCol(eg.OpPos, 2), p.endLit())
+		if p.recTokens {
+			p.addTok(TokLit, eg.Pattern.ValuePos, eg.Pattern.Value)
+		}
+		rpos := p.getPos()
 		p.rune()
+		if p.recTokens && lparens == 0 {
+			p.addTok(TokOperator, rpos, rightParen.String())
+		}
 		p.next()
 		if lparens != 0 {
 			p.matchingErr(eg.OpPos, eg.Op, rightParen)
@@ -873,8 +1269,10 @@ func (p *Parser) dblQuoted() *DblQuoted {
 	q := &DblQuoted{Position: p.pos, Dollar: p.tok == dollDblQuote}
 	old := p.quote
 	p.quote = dblQuotes
+	p.pushOpen(p.tok.String())
 	p.next()
 	q.Parts = p.wordParts()
+	p.popOpen()
 	p.quote = old
 	if !p.got(dblQuote) {
 		p.quoteErr(q.Pos(), dblQuote)
@@ -1096,10 +1494,14 @@ func (p *Parser) paramExp() *ParamExp {
 	pe := &ParamExp{Dollar: p.pos}
 	old := p.quote
 	p.quote = paramExpName
+	p.pushOpen(dollBrace.String())
 	if p.r == '#' {
 		p.tok = hash
 		p.pos = p.getPos()
 		p.rune()
+		if p.recTokens {
+			p.addTok(TokOperator, p.pos, hash.String())
+		}
 	} else {
 		p.next()
 	}
@@ -1154,6 +1556,7 @@ func (p *Parser) paramExp() *ParamExp {
 	case rightBrace:
 		pe.Rbrace = p.pos
 		p.quote = old
+		p.popOpen()
 		p.next()
 		return pe
 	case leftBrack:
@@ -1168,6 +1571,7 @@ func (p *Parser) paramExp() *ParamExp {
 	if p.tok == rightBrace {
 		pe.Rbrace = p.pos
 		p.quote = old
+		p.popOpen()
 		p.next()
 		return pe
 	}
@@ -1236,6 +1640,7 @@ func (p *Parser) paramExp() *ParamExp {
 		p.curErr("not a valid parameter expansion operator: %v", p.tok)
 	}
 	p.quote = old
+	p.popOpen()
 	pe.Rbrace = p.pos
 	p.matched(pe.Dollar, dollBrace, rightBrace)
 	return pe
@@ -1266,6 +1671,7 @@ func (p *Parser) eitherIndex() ArithmExpr {
 	p.quote = arithmExprBrack
 	p.next()
 	if p.tok == star || p.tok == at {
+		p.tokKind(TokLit)
 		p.tok, p.val = _LitWord, p.tok.String()
 	}
 	expr := p.followArithm(leftBrack, lpos)
@@ -1283,6 +1689,15 @@ func (p *Parser) arithmEnd(ltok token, lpos Pos, old saveState) Pos {
 		p.matchingErr(lpos, ltok, dblRightParen)
 	}
 	p.rune()
+	if p.recTokens && len(p.toks) > 0 {
+		// both closing parentheses form a single token
+		if t := &p.toks[len(p.toks)-1]; t.ValuePos == p.pos {
+			t.Value, t.ValueEnd = dblRightParen.String(), p.getPos()
+			if ltok == dollDblParen {
+				t.Kind = TokExpansion
+			}
+		}
+	}
 	p.postNested(old)
 	pos := p.pos
 	p.next()
@@ -1363,6 +1778,9 @@ func (p *Parser) getAssign(needEqual bool) *Assign {
 		as.Name = p.lit(p.pos, p.val)
 		// hasValidIdent already checks p.r is '['
 		p.rune()
+		if p.recTokens {
+			p.addTok(TokOperator, as.Name.End(), leftBrack.String())
+		}
 		p.pos = posAddCol(p.pos, 1)
 		as.Index = p.eitherIndex()
 		if !needEqual && (p.spaced || stopToken(p.tok)) {
@@ -1404,6 +1822,7 @@ func (p *Parser) getAssign(needEqual bool) *Assign {
 			newQuote = arrayElems
 		}
 		old := p.preNested(newQuote)
+		p.pushOpen(leftParen.String())
 		p.next()
 		p.got(_Newl)
 		for p.tok != _EOF && p.tok != rightParen {
@@ -1432,6 +1851,7 @@ func (p *Parser) getAssign(needEqual bool) *Assign {
 			p.got(_Newl)
 		}
 		as.Array.Last, p.accComs = p.accComs, nil
+		p.popOpen()
 		p.postNested(old)
 		as.Array.Rparen = p.matched(as.Array.Lparen, leftParen, rightParen)
 	} else if w := p.getWord(); w != nil {
@@ -1522,9 +1942,11 @@ func (p *Parser) getStmt(readEnd, binCmd, fnBody bool) *Stmt {
 			Op:    BinCmdOperator(p.tok),
 			X:     s,
 		}
+		p.pushOpen(b.Op.String())
 		p.next()
 		p.got(_Newl)
 		b.Y = p.getStmt(false, true, false)
+		p.popOpen()
 		if b.Y == nil || p.err != nil {
 			p.followErr(b.OpPos, b.Op.String(), "a statement")
 			return nil
@@ -1688,9 +2110,12 @@ func (p *Parser) gotStmtPipe(s *Stmt) *Stmt {
 		fallthrough
 	case or:
 		b := &BinaryCmd{OpPos: p.pos, Op: BinCmdOperator(p.tok), X: s}
+		p.pushOpen(b.Op.String())
 		p.next()
 		p.got(_Newl)
-		if b.Y = p.gotStmtPipe(p.stmt(p.pos)); b.Y == nil || p.err != nil {
+		b.Y = p.gotStmtPipe(p.stmt(p.pos))
+		p.popOpen()
+		if b.Y == nil || p.err != nil {
 			p.followErr(b.OpPos, b.Op.String(), "a statement")
 			break
 		}
@@ -1707,8 +2132,10 @@ func (p *Parser) gotStmtPipe(s *Stmt) *Stmt {
 func (p *Parser) subshell(s *Stmt) {
 	sub := &Subshell{Lparen: p.pos}
 	old := p.preNested(subCmd)
+	p.pushOpen(leftParen.String())
 	p.next()
 	sub.StmtList = p.stmtList()
+	p.popOpen()
 	p.postNested(old)
 	sub.Rparen = p.matched(sub.Lparen, leftParen, rightParen)
 	s.Cmd = sub
@@ -1717,6 +2144,7 @@ func (p *Parser) subshell(s *Stmt) {
 func (p *Parser) arithmExpCmd(s *Stmt) {
 	ar := &ArithmCmd{Left: p.pos}
 	old := p.preNested(arithmExprCmd)
+	p.pushOpen(dblLeftParen.String())
 	p.next()
 	if p.got(hash) {
 		if p.lang != LangMirBSDKorn {
@@ -1725,14 +2153,18 @@ func (p *Parser) arithmExpCmd(s *Stmt) {
 		ar.Unsigned = true
 	}
 	ar.X = p.followArithm(dblLeftParen, ar.Left)
+	p.popOpen()
 	ar.Right = p.arithmEnd(dblLeftParen, ar.Left, old)
 	s.Cmd = ar
 }
 
 func (p *Parser) block(s *Stmt) {
 	b := &Block{Lbrace: p.pos}
+	p.tokKind(TokKeyword)
+	p.pushOpen("{")
 	p.next()
 	b.StmtList = p.stmtList("}")
+	p.popOpen()
 	pos, ok := p.gotRsrv("}")
 	b.Rbrace = pos
 	if !ok {
@@ -1743,6 +2175,8 @@ func (p *Parser) block(s *Stmt) {
 
 func (p *Parser) ifClause(s *Stmt) {
 	rif := &IfClause{IfPos: p.pos}
+	p.tokKind(TokKeyword)
+	p.pushOpen("if")
 	p.next()
 	rif.Cond = p.followStmts("if", rif.IfPos, "then")
 	rif.ThenPos = p.followRsrv(rif.IfPos, "if <cond>", "then")
@@ -1750,6 +2184,7 @@ func (p *Parser) ifClause(s *Stmt) {
 	curIf := rif
 	for p.tok == _LitWord && p.val == "elif" {
 		elf := &IfClause{IfPos: p.pos, Elif: true}
+		p.tokKind(TokKeyword)
 		p.next()
 		elf.Cond = p.followStmts("elif", elf.IfPos, "then")
 		elf.ThenPos = p.followRsrv(elf.IfPos, "elif <cond>", "then")
@@ -1764,6 +2199,7 @@ func (p *Parser) ifClause(s *Stmt) {
 		curIf.ElsePos = elsePos
 		curIf.Else = p.followStmts("else", curIf.ElsePos, "fi")
 	}
+	p.popOpen()
 	rif.FiPos = p.stmtEnd(rif, "if", "fi")
 	curIf.FiPos = rif.FiPos
 	s.Cmd = rif
@@ -1771,22 +2207,27 @@ func (p *Parser) ifClause(s *Stmt) {
 
 func (p *Parser) whileClause(s *Stmt, until bool) {
 	wc := &WhileClause{WhilePos: p.pos, Until: until}
+	p.tokKind(TokKeyword)
 	rsrv := "while"
 	rsrvCond := "while <cond>"
 	if wc.Until {
 		rsrv = "until"
 		rsrvCond = "until <cond>"
 	}
+	p.pushOpen(rsrv)
 	p.next()
 	wc.Cond = p.followStmts(rsrv, wc.WhilePos, "do")
 	wc.DoPos = p.followRsrv(wc.WhilePos, rsrvCond, "do")
 	wc.Do = p.followStmts("do", wc.DoPos, "done")
+	p.popOpen()
 	wc.DonePos = p.stmtEnd(wc, rsrv, "done")
 	s.Cmd = wc
 }
 
 func (p *Parser) forClause(s *Stmt) {
 	fc := &ForClause{ForPos: p.pos}
+	p.tokKind(TokKeyword)
+	p.pushOpen("for")
 	p.next()
 	fc.Loop = p.loop(fc.ForPos)
 	fc.DoPos = p.followRsrv(fc.ForPos, "for foo [in words]", "do")
@@ -1794,6 +2235,7 @@ func (p *Parser) forClause(s *Stmt) {
 	s.Comments = append(s.Comments, p.accComs...)
 	p.accComs = nil
 	fc.Do = p.followStmts("do", fc.DoPos, "done")
+	p.popOpen()
 	fc.DonePos = p.stmtEnd(fc, "for", "done")
 	s.Cmd = fc
 }
@@ -1853,16 +2295,21 @@ func (p *Parser) wordIter(ftok string, fpos Pos) *WordIter {
 
 func (p *Parser) selectClause(s *Stmt) {
 	fc := &ForClause{ForPos: p.pos, Select: true}
+	p.tokKind(TokKeyword)
+	p.pushOpen("select")
 	p.next()
 	fc.Loop = p.wordIter("select", fc.ForPos)
 	fc.DoPos = p.followRsrv(fc.ForPos, "select foo [in words]", "do")
 	fc.Do = p.followStmts("do", fc.DoPos, "done")
+	p.popOpen()
 	fc.DonePos = p.stmtEnd(fc, "select", "done")
 	s.Cmd = fc
 }
 
 func (p *Parser) caseClause(s *Stmt) {
 	cc := &CaseClause{Case: p.pos}
+	p.tokKind(TokKeyword)
+	p.pushOpen("case")
 	p.next()
 	cc.Word = p.followWord("case", cc.Case)
 	end := "esac"
@@ -1877,6 +2324,7 @@ func (p *Parser) caseClause(s *Stmt) {
 	}
 	cc.Items = p.caseItems(end)
 	cc.Last, p.accComs = p.accComs, nil
+	p.popOpen()
 	cc.Esac = p.stmtEnd(cc, "case", end)
 	s.Cmd = cc
 }
@@ -1931,11 +2379,14 @@ func (p *Parser) caseItems(stop string) (items []*CaseItem) {
 
 func (p *Parser) testClause(s *Stmt) {
 	tc := &TestClause{Left: p.pos}
+	p.tokKind(TokKeyword)
+	p.pushOpen("[[")
 	p.next()
 	if _, ok := p.gotRsrv("]]"); ok || p.tok == _EOF {
 		p.posErr(tc.Left, "test clause requires at least one expression")
 	}
 	tc.X = p.testExpr(dblLeftBrack, tc.Left, false)
+	p.popOpen()
 	tc.Right = p.pos
 	if _, ok := p.gotRsrv("]]"); !ok {
 		p.matchingErr(tc.Left, "[[", "]]")
@@ -1971,6 +2422,7 @@ func (p *Parser) testExpr(ftok token, fpos Pos, pastAndOr bool) TestExpr {
 		if p.tok = token(testBinaryOp(p.val)); p.tok == illegalTok {
 			p.curErr("not a valid test operator: %s", p.val)
 		}
+		p.tokKind(TokOperator)
 	}
 	b := &BinaryTest{
 		OpPos: p.pos,
@@ -2017,9 +2469,11 @@ func (p *Parser) testExprBase(ftok token, fpos Pos) TestExpr {
 		case tsRefVar, tsModif: // not available in mksh
 			if p.lang == LangBash {
 				p.tok = op
+				p.tokKind(TokOperator)
 			}
 		default:
 			p.tok = op
+			p.tokKind(TokOperator)
 		}
 	}
 	switch p.tok {
@@ -2099,9 +2553,11 @@ func isBashCompoundCommand(tok token, val string) bool {
 
 func (p *Parser) timeClause(s *Stmt) {
 	tc := &TimeClause{Time: p.pos}
+	p.tokKind(TokKeyword)
 	p.next()
-	if _, ok := p.gotRsrv("-p"); ok {
+	if p.tok == _LitWord && p.val == "-p" {
 		tc.PosixFormat = true
+		p.next()
 	}
 	tc.Stmt = p.gotStmtPipe(p.stmt(p.pos))
 	s.Cmd = tc
@@ -2109,6 +2565,7 @@ func (p *Parser) timeClause(s *Stmt) {
 
 func (p *Parser) coprocClause(s *Stmt) {
 	cc := &CoprocClause{Coproc: p.pos}
+	p.tokKind(TokKeyword)
 	if p.next(); isBashCompoundCommand(p.tok, p.val) {
 		// has no name
 		cc.Stmt = p.gotStmtPipe(p.stmt(p.pos))
@@ -2157,6 +2614,7 @@ func (p *Parser) letClause(s *Stmt) {
 
 func (p *Parser) bashFuncDecl(s *Stmt) {
 	fpos := p.pos
+	p.tokKind(TokKeyword)
 	if p.next(); p.tok != _LitWord {
 		if w := p.followWord("function", fpos); p.err == nil {
 			p.posErr(w.Pos(), "invalid func name")
@@ -2242,9 +2700,11 @@ func (p *Parser) funcDecl(s *Stmt, name *Lit, pos Pos) {
 		RsrvWord: pos != name.ValuePos,
 		Name:     name,
 	}
+	p.pushOpen("()")
 	p.got(_Newl)
 	if fd.Body = p.getStmt(false, false, true); fd.Body == nil {
 		p.followErr(fd.Pos(), "foo()", "a statement")
 	}
+	p.popOpen()
 	s.Cmd = fd
 }
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"reflect"
@@ -1824,6 +1825,163 @@ func TestParseErrMirBSDKorn(t *testing.T) {
 	}
 }
 
+var recoverTests = []struct {
+	in   string
+	errs []string
+	bad  []string
+}{
+	{
+		"foo; bar",
+		nil,
+		nil,
+	},
+	{
+		"echo $((1 +))\necho ok",
+		[]string{"1:11: + must be followed by an expression"},
+		[]string{"1:1-1:14"},
+	},
+	{
+		"a; b )); c\nfor\nd",
+		[]string{
+			"1:6: a command can only contain words and redirects",
+			`2:1: "for" must be followed by a literal`,
+		},
+		[]string{"1:4-1:8", "2:1-2:4"},
+	},
+	{
+		"if a; then\n\tb )\n\tc\nfi; foo(",
+		[]string{
+			"2:4: a command can only contain words and redirects",
+			`4:5: "foo(" must be followed by )`,
+		},
+		[]string{"2:2-2:5", "4:5-4:9"},
+	},
+	{
+		"x=$(a; b ))\n{ c; ;; d; }\n`e )`",
+		[]string{
+			"1:11: a command can only contain words and redirects",
+			"2:6: ;; can only be used in a case clause",
+			"3:4: a command can only contain words and redirects",
+		},
+		[]string{"1:1-1:12", "2:6-2:10", "3:2-3:5"},
+	},
+	{
+		"foo\necho 'bar",
+		[]string{"2:6: reached EOF without closing quote '"},
+		[]string{"2:1-2:10"},
+	},
+}
+
+func TestParseRecover(t *testing.T) {
+	t.Parallel()
+	p := NewParser(RecoverErrors)
+	for i, tc := range recoverTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader(tc.in), "")
+			if f == nil {
+				t.Fatalf("Expected a program in %q", tc.in)
+			}
+			var gotErrs []string
+			if err != nil {
+				for _, err := range err.(ErrorList) {
+					gotErrs = append(gotErrs, err.Error())
+				}
+			}
+			if !reflect.DeepEqual(gotErrs, tc.errs) {
+				t.Fatalf("Errors mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.errs, gotErrs)
+			}
+			var gotBad []string
+			Walk(f, func(node Node) bool {
+				if b, ok := node.(*BadCmd); ok {
+					gotBad = append(gotBad, fmt.Sprintf("%s-%s", b.Pos(), b.End()))
+				}
+				return true
+			})
+			if !reflect.DeepEqual(gotBad, tc.bad) {
+				t.Fatalf("Bad commands mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.bad, gotBad)
+			}
+		})
+	}
+}
+
+func TestParseRecoverErrorCases(t *testing.T) {
+	t.Parallel()
+	p := NewParser(KeepComments)
+	rp := NewParser(KeepComments, RecoverErrors)
+	for i, c := range shellTests {
+		want := c.common
+		if c.bsmk != nil {
+			want = c.bsmk
+		}
+		if c.bash != nil {
+			want = c.bash
+		}
+		if want == nil {
+			continue
+		}
+		_, err := p.Parse(strings.NewReader(c.in), "")
+		f, rerr := rp.Parse(strings.NewReader(c.in), "")
+		if f == nil {
+			t.Fatalf("%03d: Expected a program in %q", i, c.in)
+		}
+		// the first error must be the one found without recovering
+		errs, _ := rerr.(ErrorList)
+		if err == nil || len(errs) == 0 || errs[0].Error() != err.Error() {
+			t.Fatalf("%03d: Error mismatch in %q\nwant: %v\ngot:  %v",
+				i, c.in, err, rerr)
+		}
+	}
+}
+
+func TestParseRecoverCorpus(t *testing.T) {
+	t.Parallel()
+	p := NewParser(KeepComments, RecoverErrors)
+	printer := NewPrinter()
+	var inputs []string
+	for _, c := range fileTests {
+		inputs = append(inputs, c.Strs[0])
+	}
+	for _, c := range shellTests {
+		inputs = append(inputs, c.in)
+	}
+	check := func(in string) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("panic with %q: %v", in, r)
+			}
+		}()
+		f, _ := p.Parse(strings.NewReader(in), "")
+		if f == nil {
+			t.Fatalf("Expected a program in %q", in)
+		}
+		// recovered subtrees must be whole nodes, as Walk panics
+		// on nil ones
+		Walk(f, func(node Node) bool { return true })
+		NewCommentMap(f)
+		printer.Print(ioutil.Discard, f)
+		p.Tokens(strings.NewReader(in), "")
+		p.Interactive(strings.NewReader(in), func([]*Stmt) bool {
+			return true
+		})
+	}
+	check("<<a <<0\n$(<<$<<)")
+	check("<<E;OF\n$(()a")
+	for _, in := range inputs {
+		// truncate the input, and remove each of its bytes; also
+		// try it within a heredoc body and a command substitution
+		for i := range in {
+			for _, prefix := range [...]string{"", "<<A <<B; c\n", "$("} {
+				check(prefix + in[:i])
+				if !testing.Short() {
+					check(prefix + in[:i] + in[i+1:])
+				}
+			}
+		}
+	}
+}
+
 func TestInputName(t *testing.T) {
 	t.Parallel()
 	in := "("
@@ -1943,6 +2101,263 @@ func TestParseStmtsStopEarly(t *testing.T) {
 	}
 }
 
+var interactiveTests = []struct {
+	in   []string
+	want []string
+	err  string
+}{
+	{
+		[]string{"foo\n", "bar; baz\n"},
+		[]string{"1", "2"},
+		"",
+	},
+	{
+		[]string{"\n", "# foo\n", "bar"},
+		[]string{"0", "0", "1"},
+		"",
+	},
+	{
+		[]string{"if true; then\n", "echo \"foo\n", "bar\"\n", "fi\n"},
+		[]string{"> if", "> if \"", "> if", "1"},
+		"",
+	},
+	{
+		[]string{"foo |\n", "bar &&\n", "baz\n"},
+		[]string{"> |", "> &&", "1"},
+		"",
+	},
+	{
+		[]string{"echo foo \\\n", "bar\\\n", "baz\n"},
+		[]string{"> \\", "> \\", "1"},
+		"",
+	},
+	{
+		[]string{"# foo \\\n", "bar\n"},
+		[]string{"0", "1"},
+		"",
+	},
+	{
+		[]string{"cat <<-A; cat <<B\n", "foo\n", "\tA\n", "bar\n", "B\n"},
+		[]string{"> <<-", "> <<-", "> <<", "> <<", "2"},
+		"",
+	},
+	{
+		[]string{"f() {\n", "echo $(\n", "foo)\n", "}\n"},
+		[]string{"> () {", "> () { $(", "> () {", "1"},
+		"",
+	},
+	{
+		[]string{"foo\n", "bar )\n", "baz\n"},
+		[]string{"1"},
+		"2:5: a command can only contain words and redirects",
+	},
+	{
+		[]string{"foo\n", "case x in\n"},
+		[]string{"1", "> case"},
+		"incomplete: 2:1: case statement must end with \"esac\"",
+	},
+	{
+		[]string{"echo 'foo\n"},
+		[]string{"> '"},
+		"incomplete: 1:6: reached EOF without closing quote '",
+	},
+}
+
+func TestInteractive(t *testing.T) {
+	t.Parallel()
+	p := NewParser()
+	for i, c := range interactiveTests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			cr := &chunkedReader{c.in, make(chan bool, len(c.in))}
+			for range c.in {
+				cr.cont <- true
+			}
+			var got []string
+			err := p.Interactive(cr, func(stmts []*Stmt) bool {
+				if p.Incomplete() {
+					open := p.OpenConstructs()
+					got = append(got, "> "+strings.Join(open, " "))
+				} else {
+					got = append(got, fmt.Sprint(len(stmts)))
+				}
+				return true
+			})
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+				if IsIncomplete(err) {
+					gotErr = "incomplete: " + gotErr
+				}
+			}
+			if gotErr != c.err {
+				t.Fatalf("Error mismatch in %q\nwant: %s\ngot:  %s",
+					c.in, c.err, gotErr)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("Callbacks mismatch in %q\nwant: %q\ngot:  %q",
+					c.in, c.want, got)
+			}
+		})
+	}
+}
+
+func TestInteractiveStopEarly(t *testing.T) {
+	t.Parallel()
+	in := []string{"a\n", "b &\n", "c\n"}
+	p := NewParser()
+	cr := &chunkedReader{in, make(chan bool, len(in))}
+	for range in {
+		cr.cont <- true
+	}
+	calls := 0
+	err := p.Interactive(cr, func(stmts []*Stmt) bool {
+		calls++
+		return !stmts[0].Background
+	})
+	if err != nil {
+		t.Fatalf("Expected no error in %q: %v", in, err)
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 calls in %q, got %d", in, calls)
+	}
+}
+
+var tokenTests = []struct {
+	in   string
+	want []string
+}{
+	{
+		"foo bar # baz",
+		[]string{"lit foo", "lit bar", "comment # baz"},
+	},
+	{
+		"if a; then b; fi",
+		[]string{
+			"keyword if", "lit a", "operator ;", "keyword then",
+			"lit b", "operator ;", "keyword fi",
+		},
+	},
+	{
+		"echo if then >&2",
+		[]string{"lit echo", "lit if", "lit then", "operator >&", "lit 2"},
+	},
+	{
+		`echo "a $b ${c:-d}" 'e' $'f'`,
+		[]string{
+			"lit echo", `string "`, "string a ", "expansion $",
+			"param b", "string  ", "expansion ${", "param c",
+			"operator :-", "lit d", "expansion }", `string "`,
+			"string '", "string e", "string '",
+			"string $'", "string f", "string '",
+		},
+	},
+	{
+		"$(a) $((1 + 2)) `b` <(c)",
+		[]string{
+			"expansion $(", "lit a", "expansion )",
+			"expansion $((", "lit 1", "operator +", "lit 2",
+			"expansion ))", "expansion `", "lit b", "expansion `",
+			"expansion <(", "lit c", "expansion )",
+		},
+	},
+	{
+		"((x++)); [[ -f a && b == c ]]",
+		[]string{
+			"operator ((", "lit x", "operator ++", "operator ))",
+			"operator ;", "keyword [[", "operator -f", "lit a",
+			"operator &&", "lit b", "operator ==", "lit c",
+			"keyword ]]",
+		},
+	},
+	{
+		"cat <<EOF; cat <<'X'\nfoo $bar\nEOF\nbaz\nX",
+		[]string{
+			"lit cat", "operator <<", "lit EOF", "operator ;",
+			"lit cat", "operator <<", "string '", "string X",
+			"string '", "heredoc foo ", "expansion $",
+			"param bar", "heredoc \n", "heredoc baz\n",
+		},
+	},
+	{
+		"for i in a; do echo @(b|c); done",
+		[]string{
+			"keyword for", "lit i", "keyword in", "lit a",
+			"operator ;", "keyword do", "lit echo", "operator @(",
+			"lit b|c", "operator )", "operator ;", "keyword done",
+		},
+	},
+	{
+		"b[1]=x; a[i+1]+=y; declare c[2]",
+		[]string{
+			"lit b", "operator [", "lit 1", "operator ]", "lit =x",
+			"operator ;", "lit a", "operator [", "lit i",
+			"operator +", "lit 1", "operator ]", "lit +=y",
+			"operator ;", "lit declare", "lit c", "operator [",
+			"lit 2", "operator ]",
+		},
+	},
+	{
+		"echo ${a[1]} $[1+2]",
+		[]string{
+			"lit echo", "expansion ${", "param a", "operator [",
+			"lit 1", "operator ]", "expansion }", "expansion $[",
+			"lit 1", "operator +", "lit 2", "expansion ]",
+		},
+	},
+	{
+		"a\nb )\nc",
+		[]string{"lit a", "lit b", "operator )", "lit c"},
+	},
+}
+
+func TestTokens(t *testing.T) {
+	t.Parallel()
+	p := NewParser(RecoverErrors)
+	for i, c := range tokenTests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			toks, _ := p.Tokens(strings.NewReader(c.in), "")
+			var got []string
+			for _, tok := range toks {
+				got = append(got, tok.Kind.String()+" "+tok.Value)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("Tokens mismatch in %q\nwant: %q\ngot:  %q",
+					c.in, c.want, got)
+			}
+		})
+	}
+}
+
+func TestTokensPositions(t *testing.T) {
+	t.Parallel()
+	p := NewParser()
+	for i, c := range fileTests {
+		for j, in := range c.Strs {
+			toks, err := p.Tokens(strings.NewReader(in), "")
+			if err != nil {
+				continue
+			}
+			var last Pos
+			for _, tok := range toks {
+				if last.After(tok.Pos()) || tok.Pos().After(tok.End()) {
+					t.Fatalf("%03d-%d: token %q out of order in %q",
+						i, j, tok.Value, in)
+				}
+				last = tok.End()
+				src := in[tok.Pos().Offset():tok.End().Offset()]
+				if tok.Kind == TokHeredoc || strings.Contains(src, "\\") {
+					// the values may be different
+					continue
+				}
+				if src != tok.Value {
+					t.Fatalf("%03d-%d: token %q has source %q in %q",
+						i, j, tok.Value, src, in)
+				}
+			}
+		}
+	}
+}
+
 var stopAtTests = []struct {
 	in   string
 	stop string
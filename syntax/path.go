@@ -0,0 +1,52 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+// NodePath returns the innermost node in f which contains the byte offset
+// offs, followed by all of its ancestors, finishing with f. A node contains
+// the offsets from its Pos, inclusive, to its End, exclusive. If no node
+// contains offs, such as when it is past the end of f, NodePath returns nil.
+//
+// The ancestors of a node are the ones that hold it in the syntax tree, even
+// if they don't contain its position. For example, the ancestors of a
+// heredoc body's literal include its Redirect and Stmt, even if the body
+// starts in the line after them.
+func NodePath(f *File, offs uint) []Node {
+	return nodePath(f, func(node Node) bool {
+		return node.Pos().Offset() <= offs && offs < node.End().Offset()
+	})
+}
+
+// NodePathLineCol is like NodePath, but it takes a line and column number
+// instead of a byte offset. Both start at 1, and columns count in bytes.
+func NodePathLineCol(f *File, line, col uint) []Node {
+	before := func(p Pos) bool {
+		return p.Line() < line || (p.Line() == line && p.Col() <= col)
+	}
+	return nodePath(f, func(node Node) bool {
+		return before(node.Pos()) && !before(node.End())
+	})
+}
+
+func nodePath(f *File, contains func(Node) bool) []Node {
+	var stack, path []Node
+	Apply(f, func(c *Cursor) bool {
+		node := c.Node()
+		stack = append(stack, node)
+		// the parser never produces nodes with invalid positions, but
+		// Apply may have added them
+		if node.Pos().IsValid() && contains(node) && len(stack) >= len(path) {
+			path = append(path[:0], stack...)
+		}
+		return true
+	}, func(c *Cursor) bool {
+		stack = stack[:len(stack)-1]
+		return true
+	})
+	// innermost node first
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
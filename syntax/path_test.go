@@ -0,0 +1,160 @@
+// Copyright (c) 2018, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var nodePathTests = []struct {
+	in, at string
+	want   []string
+}{
+	{"", "", nil},
+	{"foo bar", " ", []string{"*syntax.CallExpr", "*syntax.Stmt", "*syntax.File"}},
+	{
+		"foo bar",
+		"bar",
+		[]string{"*syntax.Lit", "*syntax.Word", "*syntax.CallExpr",
+			"*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"foo a$bar",
+		"bar",
+		[]string{"*syntax.Lit", "*syntax.ParamExp", "*syntax.Word",
+			"*syntax.CallExpr", "*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"foo a$bar",
+		"$",
+		[]string{"*syntax.ParamExp", "*syntax.Word",
+			"*syntax.CallExpr", "*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"foo \"${bar}\"",
+		"bar",
+		[]string{"*syntax.Lit", "*syntax.ParamExp", "*syntax.DblQuoted",
+			"*syntax.Word", "*syntax.CallExpr", "*syntax.Stmt",
+			"*syntax.File"},
+	},
+	{
+		"foo ${bar:1:$n}",
+		"n}",
+		[]string{"*syntax.Lit", "*syntax.ParamExp", "*syntax.Word",
+			"*syntax.ParamExp", "*syntax.Word", "*syntax.CallExpr",
+			"*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"{ foo; } >out",
+		"out",
+		[]string{"*syntax.Lit", "*syntax.Word", "*syntax.Redirect",
+			"*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"cat <<EOF\nfoo $bar\nEOF",
+		"bar",
+		[]string{"*syntax.Lit", "*syntax.ParamExp", "*syntax.Word",
+			"*syntax.Redirect", "*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"cat <<EOF\nfoo $bar\nEOF",
+		"foo",
+		[]string{"*syntax.Lit", "*syntax.Word", "*syntax.Redirect",
+			"*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"if a; then\n\tcat <<-EOF\n\t\tfoo\n\tEOF\nfi",
+		"foo",
+		[]string{"*syntax.Lit", "*syntax.Word", "*syntax.Redirect",
+			"*syntax.Stmt", "*syntax.IfClause", "*syntax.Stmt",
+			"*syntax.File"},
+	},
+	{
+		"foo # bar",
+		"bar",
+		[]string{"*syntax.Comment", "*syntax.Stmt", "*syntax.File"},
+	},
+	{
+		"local foo=bar",
+		"local",
+		[]string{"*syntax.Lit", "*syntax.DeclClause", "*syntax.Stmt",
+			"*syntax.File"},
+	},
+	{"foo\n\nbar", "\n\n", []string{"*syntax.File"}},
+	{"foo\n", "\n", nil},
+}
+
+func TestNodePath(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	for i, tc := range nodePathTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			offs := strings.Index(tc.in, tc.at)
+			var got []string
+			for _, node := range NodePath(f, uint(offs)) {
+				got = append(got, fmt.Sprintf("%T", node))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("NodePath mismatch in %q at %d\nwant: %q\ngot:  %q",
+					tc.in, offs, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNodePathAllOffsets(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments)
+	for i, c := range fileTests {
+		in := c.Strs[0]
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(in), "")
+			if err != nil {
+				return
+			}
+			parents := make(map[Node]Node)
+			Apply(f, func(c *Cursor) bool {
+				parents[c.Node()] = c.Parent()
+				return true
+			}, nil)
+			line, col := uint(1), uint(1)
+			for offs := uint(0); offs <= uint(len(in)); offs++ {
+				path := NodePath(f, offs)
+				if len(path) > 0 {
+					node := path[0]
+					if node.Pos().Offset() > offs || node.End().Offset() <= offs {
+						t.Fatalf("%T at %d does not contain %d in %q",
+							node, node.Pos().Offset(), offs, in)
+					}
+					for i, node := range path[:len(path)-1] {
+						if parents[node] != path[i+1] {
+							t.Fatalf("%T is not the parent of %T in %q",
+								path[i+1], node, in)
+						}
+					}
+					if path[len(path)-1] != f {
+						t.Fatalf("path does not end with the file in %q", in)
+					}
+				}
+				lcPath := NodePathLineCol(f, line, col)
+				if !reflect.DeepEqual(path, lcPath) {
+					t.Fatalf("NodePathLineCol mismatch in %q at %d:%d",
+						in, line, col)
+				}
+				if offs < uint(len(in)) && in[offs] == '\n' {
+					line, col = line+1, 1
+				} else {
+					col++
+				}
+			}
+		})
+	}
+}
@@ -47,6 +47,13 @@ func KeepPadding(p *Printer) {
 // whitespace is avoided when possible.
 func Minify(p *Printer) { p.minify = true }
 
+// SkipDeleted will make the printer not leave empty lines in place of the
+// statements and comments recorded in d, unless there were empty lines
+// around them.
+func SkipDeleted(d *DeletedLines) func(*Printer) {
+	return func(p *Printer) { p.deleted = d }
+}
+
 // NewPrinter allocates a new Printer and applies any number of options.
 func NewPrinter(options ...func(*Printer)) *Printer {
 	p := &Printer{
@@ -134,6 +141,8 @@ type Printer struct {
 	keepPadding    bool
 	minify         bool
 
+	deleted *DeletedLines
+
 	wantSpace   bool
 	wantNewline bool
 	wroteSemi   bool
@@ -405,12 +414,11 @@ func (p *Printer) comment(c Comment) {
 
 func (p *Printer) flushComments() {
 	for i, c := range p.pendingComments {
-		p.firstLine = false
 		// We can't call any of the newline methods, as they call this
 		// function and we'd recurse forever.
 		cline := c.Hash.Line()
 		switch {
-		case i > 0, cline > p.line && p.line > 0:
+		case i > 0, cline > p.line && !p.firstLine:
 			p.WriteByte('\n')
 			if cline > p.line+1 {
 				p.WriteByte('\n')
@@ -423,6 +431,7 @@ func (p *Printer) flushComments() {
 				p.spaces(p.commentPadding + 1)
 			}
 		}
+		p.firstLine = false
 		// don't go back one line, which may happen in some edge cases
 		if p.line < cline {
 			p.line = cline
@@ -1038,6 +1047,8 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 			p.space()
 			p.arithmExpr(n, true, false)
 		}
+	case *BadCmd:
+		// the source that could not be parsed isn't kept
 	}
 	return startRedirs
 }
@@ -1091,31 +1102,67 @@ func (p *Printer) stmtList(sl StmtList) {
 		pos := s.Pos()
 		var endCom *Comment
 		var midComs []Comment
-		for _, c := range s.Comments {
-			if c.End().After(s.End()) {
-				endCom = &c
-				break
+		comLine := uint(0)
+		if del := p.deleted.lines(s); !pos.IsValid() || del.to < pos.Line() {
+			p.skipDeleted(del)
+		}
+		// a new statement must not claim any real lines, so that
+		// the comments of the next statement aren't printed inline
+		newStmt := !pos.IsValid()
+		realLine := p.line
+		if newStmt {
+			// a new statement, such as one added via Apply; don't
+			// add empty lines around it, and put its comments in
+			// the lines before it
+			line := p.line
+			if len(s.Comments) > 0 {
+				line++
 			}
-			if c.Pos().After(s.Pos()) {
-				midComs = append(midComs, c)
-				continue
+			for _, c := range s.Comments {
+				if l := c.End().Line(); l > comLine {
+					comLine = l
+				}
+				c.Hash = Pos{line: uint16(line)}
+				p.comment(c)
+			}
+			pos = Pos{line: uint16(line)}
+			if comLine > realLine {
+				// the comments were moved from another statement
+				realLine = comLine
+			}
+		} else {
+			for _, c := range s.Comments {
+				if c.End().After(s.End()) {
+					endCom = &c
+					break
+				}
+				if c.Pos().After(s.Pos()) {
+					midComs = append(midComs, c)
+					continue
+				}
+				p.comment(c)
 			}
-			p.comment(c)
 		}
 		if !p.minify || p.wantSpace {
 			p.newlines(pos)
 		}
 		p.line = pos.Line()
+		if comLine > p.line {
+			// the comments were moved from another statement
+			p.line = comLine
+		}
 		if !p.hasInline(s) {
 			inlineIndent = 0
 			p.commentPadding = 0
 			p.comments(midComs)
 			p.stmt(s)
+			p.afterStmt(s, newStmt, realLine)
 			p.wantNewline = true
 			continue
 		}
 		p.comments(midComs)
 		p.stmt(s)
+		p.afterStmt(s, newStmt, realLine)
 		if s.Pos().Line() > lastIndentedLine+1 {
 			inlineIndent = 0
 		}
@@ -1146,6 +1193,24 @@ func (p *Printer) stmtList(sl StmtList) {
 	p.comments(sl.Last)
 }
 
+// skipDeleted moves past a range of deleted lines, if they follow the
+// current line, so that no empty line is left in their place.
+func (p *Printer) skipDeleted(del lineRange) {
+	if del.from > 0 && del.from <= p.line+1 && del.to > p.line {
+		p.line = del.to
+	}
+}
+
+// afterStmt updates the current line once s has been printed. A new
+// statement goes back to the last real line, as it has no lines of its own.
+func (p *Printer) afterStmt(s *Stmt, newStmt bool, realLine uint) {
+	if newStmt {
+		p.line = realLine
+	} else if del := p.deleted.lines(s); del.from > s.Pos().Line() {
+		p.skipDeleted(del)
+	}
+}
+
 type byteCounter int
 
 func (c *byteCounter) WriteByte(b byte) error {
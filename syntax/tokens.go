@@ -344,3 +344,54 @@ func (o UnAritOperator) String() string   { return token(o).String() }
 func (o BinAritOperator) String() string  { return token(o).String() }
 func (o UnTestOperator) String() string   { return token(o).String() }
 func (o BinTestOperator) String() string  { return token(o).String() }
+
+// Token is a single token of a shell program, as returned by
+// Parser.Tokens.
+type Token struct {
+	Kind TokenKind
+
+	ValuePos Pos
+	ValueEnd Pos
+
+	// Value is the token's text. It can differ from the source, as
+	// escaped newlines and the escaping done within backquotes are
+	// removed, and heredoc bodies do not include their closing word.
+	// Use the token's positions to find its exact source text.
+	Value string
+}
+
+func (t Token) Pos() Pos { return t.ValuePos }
+func (t Token) End() Pos { return t.ValueEnd }
+
+// TokenKind describes what a token represents, mainly for the purpose of
+// syntax highlighting.
+type TokenKind uint8
+
+const (
+	TokLit       TokenKind = iota + 1 // unquoted literal text
+	TokKeyword                        // reserved word, like if or done
+	TokOperator                       // operator, like ; or >
+	TokString                         // quotes and the literal text within
+	TokParam                          // parameter name in an expansion
+	TokExpansion                      // expansion delimiter, like $( or }
+	TokHeredoc                        // heredoc body
+	TokComment                        // comment, including its #
+)
+
+var tokKindNames = [...]string{
+	TokLit:       "lit",
+	TokKeyword:   "keyword",
+	TokOperator:  "operator",
+	TokString:    "string",
+	TokParam:     "param",
+	TokExpansion: "expansion",
+	TokHeredoc:   "heredoc",
+	TokComment:   "comment",
+}
+
+func (k TokenKind) String() string {
+	if int(k) < len(tokKindNames) && tokKindNames[k] != "" {
+		return tokKindNames[k]
+	}
+	return "illegal"
+}
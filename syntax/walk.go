@@ -127,6 +127,14 @@ func Walk(node Node, f func(Node) bool) {
 		if x.Index != nil {
 			Walk(x.Index, f)
 		}
+		if x.Slice != nil {
+			if x.Slice.Offset != nil {
+				Walk(x.Slice.Offset, f)
+			}
+			if x.Slice.Length != nil {
+				Walk(x.Slice.Length, f)
+			}
+		}
 		if x.Repl != nil {
 			if x.Repl.Orig != nil {
 				Walk(x.Repl.Orig, f)
@@ -177,6 +185,9 @@ func Walk(node Node, f func(Node) bool) {
 	case *TestClause:
 		Walk(x.X, f)
 	case *DeclClause:
+		if x.Variant != nil {
+			Walk(x.Variant, f)
+		}
 		walkWords(x.Opts, f)
 		for _, a := range x.Assigns {
 			Walk(a, f)
@@ -217,6 +228,7 @@ func Walk(node Node, f func(Node) bool) {
 		for _, expr := range x.Exprs {
 			Walk(expr, f)
 		}
+	case *BadCmd:
 	default:
 		panic(fmt.Sprintf("syntax.Walk: unexpected node type %T", x))
 	}